@@ -0,0 +1,142 @@
+package alerts
+
+import (
+	"deforestation/models"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Evaluate checks every enabled rule that applies to the area against the
+// given history entry. It opens an alert for each rule whose threshold is
+// crossed and resolves outstanding alerts for rules that no longer fire.
+// The newly opened alerts are returned.
+func Evaluate(db *gorm.DB, area models.Area, history models.History) ([]models.Alert, error) {
+	// Rules without an area follow the areas of their owner. Members of the
+	// area's organization may also set rules on that area specifically, and
+	// rules of users who left the organization no longer apply.
+	query := db.Where("enabled = ? AND ((area_id IS NULL AND user_id = ?) OR area_id = ?)", true, area.UserID, area.ID)
+	if area.OrganizationID == nil {
+		query = query.Where("user_id = ?", area.UserID)
+	} else {
+		query = query.Where("user_id IN (SELECT user_id FROM memberships WHERE organization_id = ? AND deleted_at IS NULL)",
+			*area.OrganizationID)
+	}
+
+	var rules []models.AlertRule
+	if err := query.Find(&rules).Error; err != nil {
+		return nil, err
+	}
+
+	var fired []models.Alert
+	for _, rule := range rules {
+		value, ok, err := measure(db, rule.Kind, history)
+		if err != nil {
+			return fired, err
+		}
+
+		var existing models.Alert
+		err = db.Where("rule_id = ? AND area_id = ? AND state <> ?", rule.ID, area.ID, models.AlertStateResolved).
+			First(&existing).Error
+		if err != nil && !gorm.IsRecordNotFoundError(err) {
+			return fired, err
+		}
+		outstanding := err == nil
+
+		if !ok || value < rule.Threshold {
+			if outstanding {
+				now := time.Now()
+				existing.State = models.AlertStateResolved
+				existing.ResolvedAt = &now
+				if err := db.Save(&existing).Error; err != nil {
+					return fired, err
+				}
+			}
+			continue
+		}
+
+		if outstanding {
+			// Keep a single alert per rule and area until it is resolved
+			existing.Value = value
+			existing.HistoryID = history.ID
+			if err := db.Save(&existing).Error; err != nil {
+				return fired, err
+			}
+			continue
+		}
+
+		alert := models.Alert{
+			RuleID:    rule.ID,
+			UserID:    rule.UserID,
+			AreaID:    area.ID,
+			HistoryID: history.ID,
+			Kind:      rule.Kind,
+			Threshold: rule.Threshold,
+			Value:     value,
+			State:     models.AlertStateOpen,
+			Message:   message(area, rule, value),
+		}
+		if err := db.Create(&alert).Error; err != nil {
+			return fired, err
+		}
+		fired = append(fired, alert)
+	}
+
+	return fired, nil
+}
+
+// measure computes the value a rule kind is compared against. ok is false
+// when there is not enough history to compute it yet.
+func measure(db *gorm.DB, kind string, history models.History) (float64, bool, error) {
+	switch kind {
+	case models.AlertKindAbsolute:
+		return history.DeforestedArea, true, nil
+	case models.AlertKindWeekOverWeek:
+		var previous models.History
+		err := db.Where("area_id = ? AND date < ?", history.AreaID, history.Date).
+			Order("date desc").First(&previous).Error
+		if gorm.IsRecordNotFoundError(err) {
+			return 0, false, nil
+		}
+		if err != nil {
+			return 0, false, err
+		}
+		return history.DeforestedArea - previous.DeforestedArea, true, nil
+	case models.AlertKindCumulative:
+		var baseline models.History
+		err := db.Where("area_id = ?", history.AreaID).Order("date asc").First(&baseline).Error
+		if gorm.IsRecordNotFoundError(err) {
+			return 0, false, nil
+		}
+		if err != nil {
+			return 0, false, err
+		}
+		if baseline.ID == history.ID {
+			return 0, false, nil
+		}
+		return history.DeforestedArea - baseline.DeforestedArea, true, nil
+	default:
+		return 0, false, fmt.Errorf("unknown alert rule kind %q", kind)
+	}
+}
+
+func message(area models.Area, rule models.AlertRule, value float64) string {
+	switch rule.Kind {
+	case models.AlertKindWeekOverWeek:
+		return fmt.Sprintf("%s: deforested area grew by %.2f%% since the previous capture (threshold %.2f%%)", area.AreaName, value, rule.Threshold)
+	case models.AlertKindCumulative:
+		return fmt.Sprintf("%s: deforested area grew by %.2f%% since the baseline capture (threshold %.2f%%)", area.AreaName, value, rule.Threshold)
+	default:
+		return fmt.Sprintf("%s: deforested area reached %.2f%% (threshold %.2f%%)", area.AreaName, value, rule.Threshold)
+	}
+}
+
+// ValidKind reports whether kind is a supported alert rule kind.
+func ValidKind(kind string) bool {
+	switch kind {
+	case models.AlertKindAbsolute, models.AlertKindWeekOverWeek, models.AlertKindCumulative:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,228 @@
+package alerts
+
+import (
+	"deforestation/models"
+	"deforestation/testdb"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+func TestValidKind(t *testing.T) {
+	tests := map[string]bool{
+		models.AlertKindAbsolute:     true,
+		models.AlertKindWeekOverWeek: true,
+		models.AlertKindCumulative:   true,
+		"":                           false,
+		"Absolute":                   false,
+		"weekly":                     false,
+	}
+	for kind, want := range tests {
+		if got := ValidKind(kind); got != want {
+			t.Errorf("ValidKind(%q) = %v, want %v", kind, got, want)
+		}
+	}
+}
+
+// capture records a history entry of the area, days after a fixed start
+func capture(t *testing.T, db *gorm.DB, area models.Area, days int, deforested float64) models.History {
+	t.Helper()
+	history := models.History{
+		Date:            time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC).AddDate(0, 0, days),
+		ImagePath:       "image.png",
+		MaskedImagePath: "mask.png",
+		DeforestedArea:  deforested,
+		AreaID:          area.ID,
+	}
+	if err := db.Create(&history).Error; err != nil {
+		t.Fatal(err)
+	}
+	return history
+}
+
+func TestMeasure(t *testing.T) {
+	db := testdb.Open(t)
+	area := models.Area{AreaName: "Reserve", UserID: 1}
+	if err := db.Create(&area).Error; err != nil {
+		t.Fatal(err)
+	}
+	first := capture(t, db, area, 0, 10)
+	second := capture(t, db, area, 7, 12.5)
+	third := capture(t, db, area, 14, 11)
+
+	tests := []struct {
+		name    string
+		kind    string
+		history models.History
+		value   float64
+		ok      bool
+		err     bool
+	}{
+		{"absolute", models.AlertKindAbsolute, second, 12.5, true, false},
+		{"absolute of the first capture", models.AlertKindAbsolute, first, 10, true, false},
+		{"week over week without a previous capture", models.AlertKindWeekOverWeek, first, 0, false, false},
+		{"week over week growth", models.AlertKindWeekOverWeek, second, 2.5, true, false},
+		{"week over week shrink", models.AlertKindWeekOverWeek, third, -1.5, true, false},
+		{"cumulative of the baseline", models.AlertKindCumulative, first, 0, false, false},
+		{"cumulative", models.AlertKindCumulative, third, 1, true, false},
+		{"unknown kind", "weekly", second, 0, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, ok, err := measure(db, tt.kind, tt.history)
+			if (err != nil) != tt.err {
+				t.Fatalf("measure error = %v, want error %v", err, tt.err)
+			}
+			if value != tt.value || ok != tt.ok {
+				t.Errorf("measure = %v, %v, want %v, %v", value, ok, tt.value, tt.ok)
+			}
+		})
+	}
+}
+
+func TestEvaluateStates(t *testing.T) {
+	db := testdb.Open(t)
+	area := models.Area{AreaName: "Reserve", UserID: 1}
+	if err := db.Create(&area).Error; err != nil {
+		t.Fatal(err)
+	}
+	rule := models.AlertRule{UserID: 1, Kind: models.AlertKindAbsolute, Threshold: 10, Enabled: true}
+	if err := db.Create(&rule).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// Each step captures the area and expects the alerts opened by the
+	// capture and the state of every alert of the rule so far
+	steps := []struct {
+		deforested float64
+		fired      int
+		states     []string
+	}{
+		{5, 0, nil},
+		{12, 1, []string{models.AlertStateOpen}},
+		{15, 0, []string{models.AlertStateOpen}},
+		{10, 0, []string{models.AlertStateOpen}},
+		{8, 0, []string{models.AlertStateResolved}},
+		{8, 0, []string{models.AlertStateResolved}},
+		{11, 1, []string{models.AlertStateResolved, models.AlertStateOpen}},
+	}
+	for n, step := range steps {
+		history := capture(t, db, area, 7*n, step.deforested)
+		fired, err := Evaluate(db, area, history)
+		if err != nil {
+			t.Fatalf("step %d: %v", n, err)
+		}
+		if len(fired) != step.fired {
+			t.Errorf("step %d opened %d alerts, want %d", n, len(fired), step.fired)
+		}
+
+		var alerts []models.Alert
+		if err := db.Where("rule_id = ?", rule.ID).Order("id").Find(&alerts).Error; err != nil {
+			t.Fatal(err)
+		}
+		var states []string
+		for _, alert := range alerts {
+			states = append(states, alert.State)
+		}
+		if !reflect.DeepEqual(states, step.states) {
+			t.Fatalf("step %d alert states = %v, want %v", n, states, step.states)
+		}
+
+		// The outstanding alert follows the latest capture
+		last := alerts[len(alerts)-1:]
+		if len(last) == 1 && last[0].State == models.AlertStateOpen {
+			if last[0].Value != step.deforested || last[0].HistoryID != history.ID {
+				t.Errorf("step %d open alert value %v of history %d, want %v of %d",
+					n, last[0].Value, last[0].HistoryID, step.deforested, history.ID)
+			}
+		}
+		if len(last) == 1 && last[0].State == models.AlertStateResolved && last[0].ResolvedAt == nil {
+			t.Errorf("step %d resolved alert has no resolution time", n)
+		}
+	}
+}
+
+func TestEvaluateScope(t *testing.T) {
+	db := testdb.Open(t)
+
+	create := func(value interface{}) {
+		t.Helper()
+		if err := db.Create(value).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	creator := models.User{Username: "creator", Password: "x"}
+	member := models.User{Username: "member", Password: "x"}
+	former := models.User{Username: "former", Password: "x"}
+	outsider := models.User{Username: "outsider", Password: "x"}
+	for _, user := range []*models.User{&creator, &member, &former, &outsider} {
+		create(user)
+	}
+	org := models.Organization{Name: "Reserve"}
+	create(&org)
+	create(&models.Membership{OrganizationID: org.ID, UserID: creator.ID, Role: models.RoleOwner})
+	create(&models.Membership{OrganizationID: org.ID, UserID: member.ID, Role: models.RoleViewer})
+	left := models.Membership{OrganizationID: org.ID, UserID: former.ID, Role: models.RoleEditor}
+	create(&left)
+	if err := db.Delete(&left).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	private := models.Area{AreaName: "private", UserID: creator.ID}
+	shared := models.Area{AreaName: "shared", UserID: creator.ID, OrganizationID: &org.ID}
+	create(&private)
+	create(&shared)
+
+	rule := func(user models.User, area *models.Area, enabled bool) models.AlertRule {
+		t.Helper()
+		r := models.AlertRule{UserID: user.ID, Kind: models.AlertKindAbsolute, Enabled: enabled}
+		if area != nil {
+			r.AreaID = &area.ID
+		}
+		create(&r)
+		return r
+	}
+	creatorAll := rule(creator, nil, true)
+	rule(creator, nil, false)
+	creatorPrivate := rule(creator, &private, true)
+	creatorShared := rule(creator, &shared, true)
+	rule(member, nil, true)
+	memberShared := rule(member, &shared, true)
+	rule(member, &private, true)
+	rule(former, &shared, true)
+	rule(outsider, &shared, true)
+	rule(outsider, &private, true)
+
+	tests := []struct {
+		name  string
+		area  models.Area
+		rules []uint
+	}{
+		{"private area", private, []uint{creatorAll.ID, creatorPrivate.ID}},
+		{"shared area", shared, []uint{creatorAll.ID, creatorShared.ID, memberShared.ID}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A zero threshold fires on any capture
+			fired, err := Evaluate(db, tt.area, capture(t, db, tt.area, 0, 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var rules []uint
+			for _, alert := range fired {
+				rules = append(rules, alert.RuleID)
+				if alert.AreaID != tt.area.ID {
+					t.Errorf("alert of rule %d opened for area %d", alert.RuleID, alert.AreaID)
+				}
+			}
+			sort.Slice(rules, func(i, j int) bool { return rules[i] < rules[j] })
+			if !reflect.DeepEqual(rules, tt.rules) {
+				t.Errorf("fired rules = %v, want %v", rules, tt.rules)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+// Package apikeys issues and verifies the API keys machine clients use
+// instead of logging in. Keys look like dfk_<prefix>_<secret>.
+package apikeys
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"deforestation/models"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// KeyPrefix starts every API key, so keys are recognisable in an
+// Authorization header and by secret scanners
+const KeyPrefix = "dfk_"
+
+// ErrInvalidKey is returned for malformed, unknown, expired or revoked keys
+var ErrInvalidKey = errors.New("invalid API key")
+
+// lastUsedResolution limits how often LastUsedAt is written for busy keys
+const lastUsedResolution = time.Minute
+
+// IsKey reports whether token looks like an API key rather than a JWT
+func IsKey(token string) bool {
+	return strings.HasPrefix(token, KeyPrefix)
+}
+
+// ValidScope reports whether scope is a known API key scope
+func ValidScope(scope string) bool {
+	return scope == models.ScopeRead || scope == models.ScopeWrite
+}
+
+// HasScope reports whether the key was granted scope
+func HasScope(key models.APIKey, scope string) bool {
+	for _, s := range strings.Split(key.Scopes, ",") {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Create issues a new key for a user. The returned plain text key is not
+// stored and cannot be shown again.
+func Create(db *gorm.DB, userID uint, name string, scopes []string, expiresAt *time.Time) (models.APIKey, string, error) {
+	prefix, err := randomString(6)
+	if err != nil {
+		return models.APIKey{}, "", err
+	}
+	secret, err := randomString(32)
+	if err != nil {
+		return models.APIKey{}, "", err
+	}
+	raw := KeyPrefix + prefix + "_" + secret
+
+	key := models.APIKey{
+		UserID:    userID,
+		Name:      name,
+		Prefix:    prefix,
+		KeyHash:   hashKey(raw),
+		Scopes:    strings.Join(scopes, ","),
+		ExpiresAt: expiresAt,
+	}
+	if err := db.Create(&key).Error; err != nil {
+		return models.APIKey{}, "", err
+	}
+	return key, raw, nil
+}
+
+// Authenticate looks up the key and records its use
+func Authenticate(db *gorm.DB, raw string) (models.APIKey, error) {
+	var key models.APIKey
+
+	rest := strings.TrimPrefix(raw, KeyPrefix)
+	prefix, _, ok := strings.Cut(rest, "_")
+	if !IsKey(raw) || !ok || prefix == "" {
+		return key, ErrInvalidKey
+	}
+
+	if err := db.Where("prefix = ?", prefix).First(&key).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return key, ErrInvalidKey
+		}
+		return key, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashKey(raw)), []byte(key.KeyHash)) != 1 {
+		return key, ErrInvalidKey
+	}
+
+	now := time.Now()
+	if key.RevokedAt != nil || (key.ExpiresAt != nil && now.After(*key.ExpiresAt)) {
+		return key, ErrInvalidKey
+	}
+
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= lastUsedResolution {
+		if err := db.Model(&key).UpdateColumn("last_used_at", now).Error; err != nil {
+			return key, err
+		}
+		key.LastUsedAt = &now
+	}
+
+	return key, nil
+}
+
+// Revoke disables a key for good
+func Revoke(db *gorm.DB, key *models.APIKey) error {
+	now := time.Now()
+	if err := db.Model(key).Update("revoked_at", now).Error; err != nil {
+		return err
+	}
+	key.RevokedAt = &now
+	return nil
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	// The separator must not appear in the random parts
+	return strings.ReplaceAll(base64.RawURLEncoding.EncodeToString(b), "_", "-"), nil
+}
+
+func hashKey(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,154 @@
+package apikeys
+
+import (
+	"deforestation/models"
+	"deforestation/testdb"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsKey(t *testing.T) {
+	tests := map[string]bool{
+		"dfk_abcdefgh_secret":    true,
+		"dfk_":                   true,
+		"DFK_abcdefgh_secret":    false,
+		"eyJhbGciOiJIUzI1NiJ9.x": false,
+		"":                       false,
+	}
+	for token, want := range tests {
+		if got := IsKey(token); got != want {
+			t.Errorf("IsKey(%q) = %v, want %v", token, got, want)
+		}
+	}
+}
+
+func TestScopes(t *testing.T) {
+	tests := []struct {
+		scopes string
+		scope  string
+		valid  bool
+		has    bool
+	}{
+		{"read", models.ScopeRead, true, true},
+		{"read,write", models.ScopeWrite, true, true},
+		{"read", models.ScopeWrite, true, false},
+		{"", models.ScopeRead, true, false},
+		{"read, write", models.ScopeWrite, true, false},
+		{"readwrite", models.ScopeRead, true, false},
+		{"admin", "admin", false, true},
+		{"read", "Read", false, false},
+	}
+	for _, tt := range tests {
+		if got := ValidScope(tt.scope); got != tt.valid {
+			t.Errorf("ValidScope(%q) = %v, want %v", tt.scope, got, tt.valid)
+		}
+		if got := HasScope(models.APIKey{Scopes: tt.scopes}, tt.scope); got != tt.has {
+			t.Errorf("HasScope(%q, %q) = %v, want %v", tt.scopes, tt.scope, got, tt.has)
+		}
+	}
+}
+
+func TestHashKey(t *testing.T) {
+	tests := map[string]string{
+		"":    "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		"abc": "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+	}
+	for raw, want := range tests {
+		if got := hashKey(raw); got != want {
+			t.Errorf("hashKey(%q) = %s, want %s", raw, got, want)
+		}
+	}
+}
+
+func TestRandomString(t *testing.T) {
+	for _, n := range []int{6, 32} {
+		for i := 0; i < 100; i++ {
+			s, err := randomString(n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := (n*8 + 5) / 6; len(s) != want || strings.Contains(s, "_") {
+				t.Fatalf("randomString(%d) = %q, want %d characters without the separator", n, s, want)
+			}
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	db := testdb.Open(t)
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+
+	create := func(expiresAt *time.Time) (models.APIKey, string) {
+		t.Helper()
+		key, raw, err := Create(db, 1, "ci", []string{models.ScopeRead, models.ScopeWrite}, expiresAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key, raw
+	}
+
+	valid, validRaw := create(nil)
+	_, expiringRaw := create(&future)
+	_, expiredRaw := create(&past)
+	revoked, revokedRaw := create(nil)
+	if err := Revoke(db, &revoked); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(validRaw, KeyPrefix+valid.Prefix+"_") {
+		t.Errorf("key %q does not start with its prefix %q", validRaw, valid.Prefix)
+	}
+	if valid.KeyHash != hashKey(validRaw) || strings.Contains(valid.KeyHash, validRaw) {
+		t.Errorf("stored hash %q of %q", valid.KeyHash, validRaw)
+	}
+	if !HasScope(valid, models.ScopeRead) || !HasScope(valid, models.ScopeWrite) {
+		t.Errorf("scopes %q", valid.Scopes)
+	}
+
+	tests := []struct {
+		name string
+		raw  string
+		want error
+	}{
+		{"valid", validRaw, nil},
+		{"not yet expired", expiringRaw, nil},
+		{"expired", expiredRaw, ErrInvalidKey},
+		{"revoked", revokedRaw, ErrInvalidKey},
+		{"wrong secret", validRaw[:len(validRaw)-1] + "x", ErrInvalidKey},
+		{"secret of another key", KeyPrefix + valid.Prefix + "_" + strings.SplitN(revokedRaw, "_", 3)[2], ErrInvalidKey},
+		{"unknown prefix", KeyPrefix + "unknown_secret", ErrInvalidKey},
+		{"no prefix", strings.TrimPrefix(validRaw, KeyPrefix), ErrInvalidKey},
+		{"no separator", KeyPrefix + valid.Prefix, ErrInvalidKey},
+		{"empty prefix", KeyPrefix + "_secret", ErrInvalidKey},
+		{"empty", "", ErrInvalidKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := Authenticate(db, tt.raw)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Authenticate = %v, want %v", err, tt.want)
+			}
+			if err == nil && key.LastUsedAt == nil {
+				t.Error("use of the key was not recorded")
+			}
+		})
+	}
+
+	t.Run("last use", func(t *testing.T) {
+		first, err := Authenticate(db, validRaw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := Authenticate(db, validRaw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Uses within lastUsedResolution do not write the key again
+		if !second.LastUsedAt.Equal(*first.LastUsedAt) {
+			t.Errorf("last use moved from %v to %v", *first.LastUsedAt, *second.LastUsedAt)
+		}
+	})
+}
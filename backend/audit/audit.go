@@ -0,0 +1,74 @@
+// Package audit writes the append only audit log of security relevant and
+// data changing events
+package audit
+
+import (
+	"deforestation/models"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Audited actions
+const (
+	ActionSignup       = "user.signup"
+	ActionLogin        = "user.login"
+	ActionAreaCreate   = "area.create"
+	ActionAreaDelete   = "area.delete"
+	ActionScheduledRun = "analysis.scheduled"
+)
+
+// Audited resource types
+const (
+	ResourceUser = "user"
+	ResourceArea = "area"
+)
+
+const (
+	maxDetailLength   = 512
+	maxUsernameLength = 128
+)
+
+// AdminsFromEnv reads the usernames allowed to read the whole audit log,
+// including logins to unknown accounts, from AUDIT_ADMINS
+func AdminsFromEnv() map[string]bool {
+	admins := map[string]bool{}
+	for _, username := range strings.Split(os.Getenv("AUDIT_ADMINS"), ",") {
+		if username = strings.TrimSpace(username); username != "" {
+			admins[username] = true
+		}
+	}
+	return admins
+}
+
+// Record appends an entry to the audit log. A failure to write it is logged
+// but does not fail the audited operation.
+func Record(db *gorm.DB, entry models.AuditLog) {
+	entry.ID = 0
+	entry.Detail = truncate(entry.Detail, maxDetailLength)
+	entry.Username = truncate(entry.Username, maxUsernameLength)
+	if err := db.Create(&entry).Error; err != nil {
+		log.Printf("Error writing audit log entry %s: %v", entry.Action, err)
+	}
+}
+
+// ForArea returns an entry about an area, attributed to the area's
+// organization so its owners can read it
+func ForArea(action string, area models.Area) models.AuditLog {
+	id := area.ID
+	return models.AuditLog{
+		Action:         action,
+		ResourceType:   ResourceArea,
+		ResourceID:     &id,
+		OrganizationID: area.OrganizationID,
+	}
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
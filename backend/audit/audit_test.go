@@ -0,0 +1,112 @@
+package audit
+
+import (
+	"deforestation/models"
+	"deforestation/testdb"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAdminsFromEnv(t *testing.T) {
+	tests := map[string]map[string]bool{
+		"":                  {},
+		"admin":             {"admin": true},
+		" admin , ana ,, ":  {"admin": true, "ana": true},
+		"admin,admin,Admin": {"admin": true, "Admin": true},
+	}
+	for env, want := range tests {
+		t.Setenv("AUDIT_ADMINS", env)
+		if got := AdminsFromEnv(); !reflect.DeepEqual(got, want) {
+			t.Errorf("AUDIT_ADMINS=%q: admins = %v, want %v", env, got, want)
+		}
+	}
+}
+
+func TestForArea(t *testing.T) {
+	orgID := uint(3)
+	private := models.Area{UserID: 1}
+	private.ID = 7
+	shared := models.Area{UserID: 1, OrganizationID: &orgID}
+	shared.ID = 8
+
+	tests := []struct {
+		name string
+		area models.Area
+		org  *uint
+	}{
+		{"private area", private, nil},
+		{"shared area", shared, &orgID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := ForArea(ActionAreaDelete, tt.area)
+			if entry.Action != ActionAreaDelete || entry.ResourceType != ResourceArea {
+				t.Errorf("entry = %s on %s", entry.Action, entry.ResourceType)
+			}
+			if entry.ResourceID == nil || *entry.ResourceID != tt.area.ID {
+				t.Errorf("resource = %v, want %d", entry.ResourceID, tt.area.ID)
+			}
+			if !reflect.DeepEqual(entry.OrganizationID, tt.org) {
+				t.Errorf("organization = %v, want %v", entry.OrganizationID, tt.org)
+			}
+		})
+	}
+
+	// The entry keeps its own copy of the ID
+	entry := ForArea(ActionAreaCreate, private)
+	private.ID = 9
+	if *entry.ResourceID != 7 {
+		t.Errorf("resource changed with the area to %d", *entry.ResourceID)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"", 3, ""},
+		{"abc", 3, "abc"},
+		{"abcd", 3, "abc"},
+		{"abc", 0, ""},
+	}
+	for _, tt := range tests {
+		if got := truncate(tt.s, tt.n); got != tt.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestRecord(t *testing.T) {
+	db := testdb.Open(t)
+
+	actor := uint(4)
+	entries := []models.AuditLog{
+		{ActorID: &actor, Username: "ana", Action: ActionLogin, ResourceType: ResourceUser, Outcome: models.AuditSucceeded},
+		// An ID set by the caller is not reused, entries are only appended
+		{ID: 1, Username: strings.Repeat("u", 200), Action: ActionLogin, Outcome: models.AuditFailed,
+			Detail: strings.Repeat("d", 600)},
+	}
+	for _, entry := range entries {
+		Record(db, entry)
+	}
+
+	var got []models.AuditLog
+	if err := db.Order("id").Find(&got).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(entries) {
+		t.Fatalf("recorded %d entries, want %d", len(got), len(entries))
+	}
+	if got[0].ActorID == nil || *got[0].ActorID != actor || got[0].Username != "ana" || got[0].CreatedAt.IsZero() {
+		t.Errorf("first entry = %+v", got[0])
+	}
+	if len(got[1].Username) != maxUsernameLength || len(got[1].Detail) != maxDetailLength {
+		t.Errorf("long entry kept a %d byte username and a %d byte detail", len(got[1].Username), len(got[1].Detail))
+	}
+
+	// A failing write does not fail the caller
+	Record(db, models.AuditLog{Action: strings.Repeat("a", 100), Outcome: models.AuditSucceeded})
+}
@@ -1,35 +1,69 @@
 package auth
 
 import (
+	"errors"
+	"fmt"
+	"os"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 )
 
-var jwtKey = []byte("secret_key") // Use a secure key in production
-
 type Claims struct {
 	Username string `json:"username"`
+	// SessionID identifies the session the token was issued for
+	SessionID uint `json:"sid"`
 	jwt.StandardClaims
 }
 
-func GenerateJWT(username string) (string, error) {
-	expirationTime := time.Now().Add(24 * time.Hour)
+var errNoKeys = errors.New("auth: signing keys are not initialized")
+
+// AccessTokenTTL is how long access tokens are valid, JWT_ACCESS_TTL or 15
+// minutes. Clients renew them with their refresh token.
+var AccessTokenTTL = durationFromEnv("JWT_ACCESS_TTL", 15*time.Minute)
+
+// GenerateJWT issues a short-lived access token for a session
+func GenerateJWT(username string, sessionID uint) (string, error) {
+	if keys == nil {
+		return "", errNoKeys
+	}
+
+	now := time.Now()
 	claims := &Claims{
-		Username: username,
+		Username:  username,
+		SessionID: sessionID,
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(AccessTokenTTL).Unix(),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtKey)
+	token := jwt.NewWithClaims(keys.Method, claims)
+	token.Header["kid"] = keys.Active.ID
+	return token.SignedString(keys.Active.signKey)
 }
 
+// ParseJWT verifies a token with the key named by its kid header. Tokens
+// signed with any other algorithm than the configured one are rejected, so
+// a public key can never be used as an HMAC secret.
 func ParseJWT(tokenStr string) (*Claims, error) {
+	if keys == nil {
+		return nil, errNoKeys
+	}
+
+	parser := &jwt.Parser{ValidMethods: []string{keys.Method.Alg()}}
 	claims := &Claims{}
-	token, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtKey, nil
+	token, err := parser.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Method.Alg() != keys.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		key, ok := keys.Lookup(kid)
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		return key.verifyKey, nil
 	})
 
 	if err != nil {
@@ -42,3 +76,10 @@ func ParseJWT(tokenStr string) (*Claims, error) {
 
 	return claims, nil
 }
+
+func durationFromEnv(name string, fallback time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(name)); err == nil && d > 0 {
+		return d
+	}
+	return fallback
+}
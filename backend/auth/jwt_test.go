@@ -0,0 +1,260 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// writePEM writes key to a file of the test's temporary directory
+func writePEM(t *testing.T, name string, key interface{}) string {
+	t.Helper()
+	var block *pem.Block
+	switch k := key.(type) {
+	case *rsa.PublicKey, ed25519.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "PUBLIC KEY", Bytes: der}
+	default:
+		der, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	}
+	path := filepath.Join(t.TempDir(), name+".pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// useKeys installs the key set described by env for the test
+func useKeys(t *testing.T, env map[string]string) *KeySet {
+	t.Helper()
+	for _, name := range []string{"JWT_ALG", "JWT_SECRET_KEYS", "JWT_PRIVATE_KEYS", "JWT_PUBLIC_KEYS", "JWT_ACTIVE_KID"} {
+		t.Setenv(name, env[name])
+	}
+	set, err := KeysFromEnv()
+	if err != nil {
+		t.Fatalf("KeysFromEnv: %v", err)
+	}
+
+	previous := keys
+	keys = set
+	t.Cleanup(func() { keys = previous })
+	return set
+}
+
+func rsaKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, expires time.Time) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, &Claims{
+		Username:       "ana",
+		SessionID:      3,
+		StandardClaims: jwt.StandardClaims{IssuedAt: time.Now().Unix(), ExpiresAt: expires.Unix()},
+	})
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestParseJWTRS256(t *testing.T) {
+	current, previous, retired := rsaKey(t), rsaKey(t), rsaKey(t)
+	useKeys(t, map[string]string{
+		"JWT_ALG":          "RS256",
+		"JWT_PRIVATE_KEYS": "current:" + writePEM(t, "current", current) + ",previous:" + writePEM(t, "previous", previous),
+		"JWT_PUBLIC_KEYS":  "retired:" + writePEM(t, "retired", &retired.PublicKey),
+		"JWT_ACTIVE_KID":   "current",
+	})
+	hour := time.Now().Add(time.Hour)
+
+	issued, err := GenerateJWT("ana", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := ParseJWT(issued)
+	if err != nil {
+		t.Fatalf("ParseJWT of an issued token: %v", err)
+	}
+	if claims.Username != "ana" || claims.SessionID != 3 {
+		t.Errorf("claims = %+v", claims)
+	}
+	token, _, err := new(jwt.Parser).ParseUnverified(issued, &Claims{})
+	if err != nil || token.Header["kid"] != "current" || token.Header["alg"] != "RS256" {
+		t.Errorf("issued token header = %v, %v", token.Header, err)
+	}
+
+	accepted := map[string]string{
+		"signed with the previous key": signToken(t, jwt.SigningMethodRS256, "previous", previous, hour),
+		"signed with a retired key":    signToken(t, jwt.SigningMethodRS256, "retired", retired, hour),
+	}
+	for name, token := range accepted {
+		if _, err := ParseJWT(token); err != nil {
+			t.Errorf("%s: ParseJWT = %v", name, err)
+		}
+	}
+
+	publicPEM, err := os.ReadFile(writePEM(t, "public", &current.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected := map[string]string{
+		"alg none":                signToken(t, jwt.SigningMethodNone, "current", jwt.UnsafeAllowNoneSignatureType, hour),
+		"HS256 with a public key": signToken(t, jwt.SigningMethodHS256, "current", publicPEM, hour),
+		"unknown kid":             signToken(t, jwt.SigningMethodRS256, "other", current, hour),
+		"no kid":                  signToken(t, jwt.SigningMethodRS256, "", current, hour),
+		"kid of another key":      signToken(t, jwt.SigningMethodRS256, "previous", current, hour),
+		"unconfigured key":        signToken(t, jwt.SigningMethodRS256, "current", rsaKey(t), hour),
+		"expired":                 signToken(t, jwt.SigningMethodRS256, "current", current, time.Now().Add(-time.Minute)),
+		"tampered":                issued[:strings.LastIndex(issued, ".")] + ".AAAA",
+		"garbage":                 "not.a.token",
+	}
+	for name, token := range rejected {
+		if _, err := ParseJWT(token); err == nil {
+			t.Errorf("%s: ParseJWT accepted the token", name)
+		}
+	}
+}
+
+func TestParseJWTHS256(t *testing.T) {
+	secret := strings.Repeat("s", 32)
+	useKeys(t, map[string]string{"JWT_SECRET_KEYS": "a:" + secret + ",b:" + strings.Repeat("t", 32), "JWT_ACTIVE_KID": "b"})
+	hour := time.Now().Add(time.Hour)
+
+	if _, err := ParseJWT(signToken(t, jwt.SigningMethodHS256, "a", []byte(secret), hour)); err != nil {
+		t.Errorf("token of the previous secret: %v", err)
+	}
+	if _, err := ParseJWT(signToken(t, jwt.SigningMethodHS256, "b", []byte(secret), hour)); err == nil {
+		t.Error("token signed with another secret than its kid was accepted")
+	}
+	if _, err := ParseJWT(signToken(t, jwt.SigningMethodNone, "a", jwt.UnsafeAllowNoneSignatureType, hour)); err == nil {
+		t.Error("alg none was accepted")
+	}
+	if jwks := JWKS(); len(jwks) != 0 {
+		t.Errorf("JWKS published %d symmetric keys", len(jwks))
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	current, retired := rsaKey(t), rsaKey(t)
+	useKeys(t, map[string]string{
+		"JWT_ALG":          "RS256",
+		"JWT_PRIVATE_KEYS": "current:" + writePEM(t, "current", current),
+		"JWT_PUBLIC_KEYS":  "retired:" + writePEM(t, "retired", &retired.PublicKey),
+	})
+
+	jwks := JWKS()
+	if len(jwks) != 2 || jwks[0].Kid != "current" || jwks[1].Kid != "retired" {
+		t.Fatalf("JWKS = %+v", jwks)
+	}
+	for i, want := range []*rsa.PublicKey{&current.PublicKey, &retired.PublicKey} {
+		jwk := jwks[i]
+		if jwk.Kty != "RSA" || jwk.Alg != "RS256" || jwk.Use != "sig" || jwk.Crv != "" || jwk.X != "" {
+			t.Errorf("JWK %s = %+v", jwk.Kid, jwk)
+		}
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil || new(big.Int).SetBytes(n).Cmp(want.N) != 0 {
+			t.Errorf("JWK %s modulus does not match the key", jwk.Kid)
+		}
+		// 65537 encodes as the three bytes AQAB
+		if jwk.E != "AQAB" {
+			t.Errorf("JWK %s exponent = %q, want AQAB", jwk.Kid, jwk.E)
+		}
+	}
+}
+
+func TestJWKSEdDSA(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useKeys(t, map[string]string{"JWT_ALG": "EdDSA", "JWT_PRIVATE_KEYS": "ed:" + writePEM(t, "ed", private)})
+
+	jwks := JWKS()
+	if len(jwks) != 1 {
+		t.Fatalf("JWKS = %+v", jwks)
+	}
+	jwk := jwks[0]
+	x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+	if jwk.Kty != "OKP" || jwk.Crv != "Ed25519" || jwk.Alg != "EdDSA" || err != nil || !public.Equal(ed25519.PublicKey(x)) {
+		t.Errorf("JWK = %+v", jwk)
+	}
+	if jwk.N != "" || jwk.E != "" {
+		t.Errorf("OKP key has RSA members: %+v", jwk)
+	}
+
+	issued, err := GenerateJWT("ana", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseJWT(issued); err != nil {
+		t.Errorf("ParseJWT of an EdDSA token: %v", err)
+	}
+}
+
+func TestKeysFromEnvErrors(t *testing.T) {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPath := writePEM(t, "rsa", rsaKey(t))
+
+	tests := map[string]map[string]string{
+		"short secret":           {"JWT_SECRET_KEYS": "a:short"},
+		"malformed list":         {"JWT_SECRET_KEYS": "no-separator"},
+		"unknown algorithm":      {"JWT_ALG": "ES512"},
+		"key of another type":    {"JWT_ALG": "EdDSA", "JWT_PRIVATE_KEYS": "a:" + rsaPath},
+		"active key not listed":  {"JWT_ALG": "RS256", "JWT_PRIVATE_KEYS": "a:" + rsaPath, "JWT_ACTIVE_KID": "b"},
+		"active key is public":   {"JWT_ALG": "EdDSA", "JWT_PUBLIC_KEYS": "a:" + writePEM(t, "ed", public), "JWT_ACTIVE_KID": "a"},
+		"missing file":           {"JWT_ALG": "RS256", "JWT_PRIVATE_KEYS": "a:" + filepath.Join(t.TempDir(), "missing.pem")},
+		"no key in release mode": {"GIN_MODE": "release"},
+	}
+	for name, env := range tests {
+		for _, variable := range []string{"JWT_ALG", "JWT_SECRET_KEYS", "JWT_PRIVATE_KEYS", "JWT_PUBLIC_KEYS", "JWT_ACTIVE_KID", "GIN_MODE"} {
+			t.Setenv(variable, env[variable])
+		}
+		if _, err := KeysFromEnv(); err == nil {
+			t.Errorf("%s: KeysFromEnv succeeded", name)
+		}
+	}
+}
+
+func TestKeysFromEnvRandomKey(t *testing.T) {
+	for _, variable := range []string{"JWT_ALG", "JWT_SECRET_KEYS", "JWT_PRIVATE_KEYS", "JWT_PUBLIC_KEYS", "JWT_ACTIVE_KID", "GIN_MODE"} {
+		t.Setenv(variable, "")
+	}
+	set, err := KeysFromEnv()
+	if err != nil {
+		t.Fatalf("KeysFromEnv without keys in development: %v", err)
+	}
+	if set.Active == nil || set.Active.signKey == nil {
+		t.Error("no random signing key")
+	}
+}
@@ -0,0 +1,291 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Key is one key tokens may be signed or verified with. Retired keys only
+// carry a verification key until the tokens they signed have expired.
+type Key struct {
+	ID        string
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// KeySet holds the keys of the configured signing algorithm
+type KeySet struct {
+	Method jwt.SigningMethod
+	Active *Key
+	keys   map[string]*Key
+	// order keeps the configured order for the JWKS document
+	order []string
+}
+
+var keys *KeySet
+
+// Init loads the token signing keys from the environment:
+//
+//   - JWT_ALG selects HS256 (default), RS256 or EdDSA
+//   - JWT_SECRET_KEYS lists HS256 secrets as "kid:secret,kid:secret"
+//   - JWT_PRIVATE_KEYS lists RS256 or EdDSA PEM private keys as "kid:path"
+//   - JWT_PUBLIC_KEYS lists PEM public keys of retired keys as "kid:path"
+//   - JWT_ACTIVE_KID names the signing key, by default the first one listed
+//
+// Without any key a random one is generated, so tokens do not survive a
+// restart. That is only meant for development: with GIN_MODE=release Init
+// fails instead.
+func Init() error {
+	set, err := KeysFromEnv()
+	if err != nil {
+		return err
+	}
+	keys = set
+	return nil
+}
+
+// KeysFromEnv builds the key set described by the JWT_* variables
+func KeysFromEnv() (*KeySet, error) {
+	alg := os.Getenv("JWT_ALG")
+	if alg == "" {
+		alg = jwt.SigningMethodHS256.Alg()
+	}
+
+	set := &KeySet{keys: map[string]*Key{}}
+	switch alg {
+	case jwt.SigningMethodHS256.Alg():
+		set.Method = jwt.SigningMethodHS256
+		entries, err := parseKeyList(os.Getenv("JWT_SECRET_KEYS"))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			secret := []byte(entry[1])
+			if len(secret) < 32 {
+				return nil, fmt.Errorf("JWT secret %q must be at least 32 bytes long", entry[0])
+			}
+			set.add(&Key{ID: entry[0], signKey: secret, verifyKey: secret})
+		}
+	case jwt.SigningMethodRS256.Alg(), SigningMethodEdDSA.Alg():
+		set.Method = jwt.GetSigningMethod(alg)
+		if err := set.loadPEMKeys(os.Getenv("JWT_PRIVATE_KEYS"), true); err != nil {
+			return nil, err
+		}
+		if err := set.loadPEMKeys(os.Getenv("JWT_PUBLIC_KEYS"), false); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported JWT_ALG %q", alg)
+	}
+
+	if len(set.keys) == 0 {
+		// A random key logs everyone out on every restart and differs
+		// between replicas, so production setups must configure one
+		if os.Getenv("GIN_MODE") == "release" {
+			return nil, errors.New("no JWT signing keys configured, set JWT_SECRET_KEYS or JWT_PRIVATE_KEYS")
+		}
+		key, err := generateKey(set.Method)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("WARNING: no JWT signing keys configured, using a random %s key. Tokens will not survive a restart "+
+			"and other instances will reject them. This is only meant for development, the backend refuses to start "+
+			"this way with GIN_MODE=release.", alg)
+		set.add(key)
+	}
+
+	activeID := os.Getenv("JWT_ACTIVE_KID")
+	if activeID == "" {
+		for _, id := range set.order {
+			if set.keys[id].signKey != nil {
+				activeID = id
+				break
+			}
+		}
+	}
+	active, ok := set.keys[activeID]
+	if !ok || active.signKey == nil {
+		return nil, fmt.Errorf("no private JWT key with kid %q", activeID)
+	}
+	set.Active = active
+
+	return set, nil
+}
+
+func (s *KeySet) add(key *Key) {
+	if _, ok := s.keys[key.ID]; !ok {
+		s.order = append(s.order, key.ID)
+	}
+	s.keys[key.ID] = key
+}
+
+// Lookup returns the key identified by kid
+func (s *KeySet) Lookup(kid string) (*Key, bool) {
+	key, ok := s.keys[kid]
+	return key, ok
+}
+
+func (s *KeySet) loadPEMKeys(list string, private bool) error {
+	entries, err := parseKeyList(list)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		data, err := os.ReadFile(entry[1])
+		if err != nil {
+			return fmt.Errorf("reading JWT key %q: %w", entry[0], err)
+		}
+		key, err := parsePEMKey(s.Method, entry[0], data, private)
+		if err != nil {
+			return fmt.Errorf("parsing JWT key %q: %w", entry[0], err)
+		}
+		s.add(key)
+	}
+	return nil
+}
+
+// parseKeyList splits "kid:value,kid:value" into pairs
+func parseKeyList(list string) ([][2]string, error) {
+	var entries [][2]string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kid, value, ok := strings.Cut(item, ":")
+		if !ok || kid == "" || value == "" {
+			return nil, fmt.Errorf("invalid JWT key entry %q, expected kid:value", item)
+		}
+		entries = append(entries, [2]string{kid, value})
+	}
+	return entries, nil
+}
+
+func parsePEMKey(method jwt.SigningMethod, kid string, data []byte, private bool) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	var parsed interface{}
+	var err error
+	switch {
+	case private && block.Type == "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case private:
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case block.Type == "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := &Key{ID: kid}
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.signKey, key.verifyKey = k, &k.PublicKey
+	case *rsa.PublicKey:
+		key.verifyKey = k
+	case ed25519.PrivateKey:
+		key.signKey, key.verifyKey = k, k.Public()
+	case ed25519.PublicKey:
+		key.verifyKey = k
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+
+	if !keyMatches(method, key.verifyKey) {
+		return nil, fmt.Errorf("key type %T cannot be used with %s", parsed, method.Alg())
+	}
+	return key, nil
+}
+
+func keyMatches(method jwt.SigningMethod, verifyKey interface{}) bool {
+	switch verifyKey.(type) {
+	case *rsa.PublicKey:
+		return method == jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		return method == SigningMethodEdDSA
+	}
+	return false
+}
+
+func generateKey(method jwt.SigningMethod) (*Key, error) {
+	key := &Key{ID: "dev"}
+	switch method {
+	case jwt.SigningMethodHS256:
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		key.signKey, key.verifyKey = secret, secret
+	case jwt.SigningMethodRS256:
+		private, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		key.signKey, key.verifyKey = private, &private.PublicKey
+	case SigningMethodEdDSA:
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		key.signKey, key.verifyKey = private, public
+	}
+	return key, nil
+}
+
+// JWK is a public key in JSON Web Key format (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKS returns the public keys tokens may be verified with. Symmetric keys
+// are never published, so the set is empty with HS256.
+func JWKS() []JWK {
+	jwks := []JWK{}
+	if keys == nil {
+		return jwks
+	}
+
+	for _, id := range keys.order {
+		jwk := JWK{Kid: id, Use: "sig", Alg: keys.Method.Alg()}
+		switch k := keys.keys[id].verifyKey.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(k.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(k)
+		default:
+			continue
+		}
+		jwks = append(jwks, jwk)
+	}
+	return jwks
+}
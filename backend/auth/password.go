@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// PasswordPolicy describes the passwords users may choose
+type PasswordPolicy struct {
+	MinLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+}
+
+// maxPasswordLength is the number of bytes bcrypt takes into account
+const maxPasswordLength = 72
+
+// PasswordPolicyFromEnv reads PASSWORD_MIN_LENGTH (default 10) and
+// PASSWORD_REQUIRE_UPPER, _LOWER, _DIGIT (default true) and _SYMBOL
+// (default false)
+func PasswordPolicyFromEnv() PasswordPolicy {
+	policy := PasswordPolicy{
+		MinLength:     10,
+		RequireUpper:  envBool("PASSWORD_REQUIRE_UPPER", true),
+		RequireLower:  envBool("PASSWORD_REQUIRE_LOWER", true),
+		RequireDigit:  envBool("PASSWORD_REQUIRE_DIGIT", true),
+		RequireSymbol: envBool("PASSWORD_REQUIRE_SYMBOL", false),
+	}
+	if n, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH")); err == nil && n > 0 {
+		policy.MinLength = n
+	}
+	return policy
+}
+
+func envBool(name string, fallback bool) bool {
+	if v, err := strconv.ParseBool(os.Getenv(name)); err == nil {
+		return v
+	}
+	return fallback
+}
+
+// Validate returns an error listing every rule password breaks
+func (p PasswordPolicy) Validate(password, username string) error {
+	var problems []string
+
+	if len([]rune(password)) < p.MinLength {
+		problems = append(problems, fmt.Sprintf("be at least %d characters long", p.MinLength))
+	}
+	if len(password) > maxPasswordLength {
+		problems = append(problems, fmt.Sprintf("be at most %d bytes long", maxPasswordLength))
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			symbol = true
+		}
+	}
+	if p.RequireUpper && !upper {
+		problems = append(problems, "contain an uppercase letter")
+	}
+	if p.RequireLower && !lower {
+		problems = append(problems, "contain a lowercase letter")
+	}
+	if p.RequireDigit && !digit {
+		problems = append(problems, "contain a digit")
+	}
+	if p.RequireSymbol && !symbol {
+		problems = append(problems, "contain a symbol")
+	}
+
+	if username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		problems = append(problems, "not contain the username")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("password must %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
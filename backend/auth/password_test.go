@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPasswordPolicyValidate(t *testing.T) {
+	policy := PasswordPolicy{MinLength: 10, RequireUpper: true, RequireLower: true, RequireDigit: true}
+	symbols := PasswordPolicy{MinLength: 8, RequireSymbol: true}
+
+	tests := []struct {
+		name     string
+		policy   PasswordPolicy
+		password string
+		username string
+		problems []string
+	}{
+		{"valid", policy, "Forest2024canopy", "ana", nil},
+		{"too short", policy, "Forest24", "ana", []string{"at least 10 characters"}},
+		{"length counts characters", policy, "Ñandú2024ü", "ana", nil},
+		{"too long for bcrypt", policy, "Forest2024" + strings.Repeat("a", 63), "ana", []string{"at most 72 bytes"}},
+		{"missing uppercase", policy, "forest2024canopy", "ana", []string{"uppercase"}},
+		{"missing lowercase", policy, "FOREST2024CANOPY", "ana", []string{"lowercase"}},
+		{"missing digit", policy, "ForestCanopyTrees", "ana", []string{"digit"}},
+		{"several problems", policy, "forest", "ana", []string{"at least 10 characters", "uppercase", "digit"}},
+		{"contains the username", policy, "Forest2024Canopy", "canopy", []string{"username"}},
+		{"symbol required", symbols, "canopies", "", []string{"symbol"}},
+		{"space counts as symbol", symbols, "tall trees", "", nil},
+		{"symbol present", symbols, "canopy-1", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Validate(tt.password, tt.username)
+			if len(tt.problems) == 0 {
+				if err != nil {
+					t.Errorf("Validate = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Validate = nil, want problems %q", tt.problems)
+			}
+			for _, problem := range tt.problems {
+				if !strings.Contains(err.Error(), problem) {
+					t.Errorf("Validate = %q, want it to mention %q", err, problem)
+				}
+			}
+		})
+	}
+}
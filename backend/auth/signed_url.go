@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// MaxImageURLTTL is the longest a signed image URL stays valid. Signed URLs
+// are not tied to a user, so they keep working after the user lost access.
+const MaxImageURLTTL = time.Hour
+
+// imageURLKey signs image URLs. Without IMAGE_URL_SECRET a random key is
+// used, so signed URLs do not survive a restart and are not shared between
+// replicas.
+var imageURLKey = loadImageURLKey()
+
+// ImageURLSecretConfigured reports whether IMAGE_URL_SECRET is set, so that
+// signed URLs survive a restart
+func ImageURLSecretConfigured() bool {
+	return os.Getenv("IMAGE_URL_SECRET") != ""
+}
+
+func loadImageURLKey() []byte {
+	if secret := os.Getenv("IMAGE_URL_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatalf("Error generating image URL key: %v", err)
+	}
+	log.Println("IMAGE_URL_SECRET is not set, signed image URLs are only valid until restart")
+	return key
+}
+
+// SignImageURL returns the path and query of a URL granting access to the
+// image stored under key until ttl has passed, without an Authorization
+// header. ttl is capped at MaxImageURLTTL.
+func SignImageURL(key string, ttl time.Duration) (string, time.Time) {
+	if ttl > MaxImageURLTTL {
+		ttl = MaxImageURLTTL
+	}
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("signature", imageSignature(key, expires.Unix()))
+
+	return "/images/" + url.PathEscape(key) + "?" + query.Encode(), expires
+}
+
+// VerifyImageSignature reports whether signature grants access to key and
+// has not expired yet
+func VerifyImageSignature(key, expires, signature string) bool {
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > unix {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(imageSignature(key, unix)))
+}
+
+func imageSignature(key string, expires int64) string {
+	mac := hmac.New(sha256.New, imageURLKey)
+	mac.Write([]byte(key + "\n" + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignImageURL(t *testing.T) {
+	tests := []struct {
+		name string
+		ttl  time.Duration
+		want time.Duration
+	}{
+		{"short", 5 * time.Minute, 5 * time.Minute},
+		{"maximum", MaxImageURLTTL, MaxImageURLTTL},
+		{"capped", 7 * 24 * time.Hour, MaxImageURLTTL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signed, expires := SignImageURL("areas/1/a b.png", tt.ttl)
+			if d := time.Until(expires); d > tt.want || d < tt.want-2*time.Second {
+				t.Errorf("expires in %v, want %v", d, tt.want)
+			}
+
+			path, rawQuery, _ := strings.Cut(signed, "?")
+			if path != "/images/areas%2F1%2Fa%20b.png" {
+				t.Errorf("path = %q", path)
+			}
+			query, err := url.ParseQuery(rawQuery)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expiresParam, signature := query.Get("expires"), query.Get("signature")
+			if !VerifyImageSignature("areas/1/a b.png", expiresParam, signature) {
+				t.Error("signature rejected")
+			}
+			if VerifyImageSignature("areas/1/other.png", expiresParam, signature) {
+				t.Error("signature accepted for another image")
+			}
+			if VerifyImageSignature("areas/1/a b.png", expiresParam+"0", signature) {
+				t.Error("signature accepted with a later expiry")
+			}
+		})
+	}
+
+	past := time.Now().Add(-time.Minute).Unix()
+	if VerifyImageSignature("key", strconv.FormatInt(past, 10), imageSignature("key", past)) {
+		t.Error("expired signature accepted")
+	}
+}
@@ -0,0 +1,100 @@
+// Package authz decides who may act on areas, their captures and the
+// resources attached to them. Handlers load records through it instead of
+// comparing user IDs themselves, so every endpoint applies the same policy.
+package authz
+
+import (
+	"deforestation/models"
+	"errors"
+)
+
+// Action is something a subject wants to do with a resource
+type Action string
+
+const (
+	ActionRead    Action = "read"
+	ActionUpdate  Action = "update"
+	ActionDelete  Action = "delete"
+	ActionAnalyze Action = "analyze"
+)
+
+var (
+	// ErrNotFound is returned when the record does not exist or belongs to
+	// a deleted area
+	ErrNotFound = errors.New("not found")
+	// ErrForbidden is returned when the record exists but the subject may
+	// not perform the action on it
+	ErrForbidden = errors.New("forbidden")
+)
+
+// Subject is the authenticated user performing an action along with the
+// roles they hold, keyed by organization ID
+type Subject struct {
+	UserID uint
+	Roles  map[uint]string
+}
+
+// Role returns the role of the subject in an organization, or an empty
+// string when they are not a member
+func (s Subject) Role(organizationID uint) string {
+	return s.Roles[organizationID]
+}
+
+// Resource describes a record as far as the policy is concerned
+type Resource struct {
+	Kind           string
+	OwnerID        uint
+	OrganizationID *uint
+}
+
+// KindOrganization is the kind of the organizations themselves, which only
+// their owners may change
+const KindOrganization = "organization"
+
+// rolePermissions lists what each role may do with the resources of its
+// organization
+var rolePermissions = map[string]map[Action]bool{
+	models.RoleOwner:  {ActionRead: true, ActionUpdate: true, ActionDelete: true, ActionAnalyze: true},
+	models.RoleEditor: {ActionRead: true, ActionUpdate: true, ActionDelete: true, ActionAnalyze: true},
+	models.RoleViewer: {ActionRead: true},
+}
+
+// Authorize returns ErrForbidden unless subject may perform action on
+// resource. Owners may perform every action on their own private resources.
+// On the resources of an organization only the role counts, including for
+// their creator: viewers only read, editors also change, delete and analyze,
+// and only owners manage the organization itself.
+func Authorize(subject Subject, action Action, resource Resource) error {
+	if !validAction(action) || subject.UserID == 0 {
+		return ErrForbidden
+	}
+	if resource.OrganizationID == nil {
+		if resource.OwnerID != 0 && resource.OwnerID == subject.UserID {
+			return nil
+		}
+		return ErrForbidden
+	}
+
+	role := subject.Role(*resource.OrganizationID)
+	if resource.Kind == KindOrganization && action != ActionRead && role != models.RoleOwner {
+		return ErrForbidden
+	}
+	if !rolePermissions[role][action] {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// ValidRole reports whether role is one of the organization roles
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+func validAction(action Action) bool {
+	switch action {
+	case ActionRead, ActionUpdate, ActionDelete, ActionAnalyze:
+		return true
+	}
+	return false
+}
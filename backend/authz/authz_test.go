@@ -0,0 +1,184 @@
+package authz
+
+import (
+	"deforestation/models"
+	"deforestation/testdb"
+	"reflect"
+	"testing"
+)
+
+func TestAuthorize(t *testing.T) {
+	orgID, otherOrgID := uint(10), uint(11)
+	owned := Resource{Kind: "area", OwnerID: 1}
+	shared := Resource{Kind: "area", OwnerID: 1, OrganizationID: &orgID}
+	organization := Resource{Kind: KindOrganization, OrganizationID: &orgID}
+
+	member := func(userID uint, role string) Subject {
+		return Subject{UserID: userID, Roles: map[uint]string{orgID: role}}
+	}
+
+	tests := []struct {
+		name     string
+		subject  Subject
+		action   Action
+		resource Resource
+		want     error
+	}{
+		{"owner reads", Subject{UserID: 1}, ActionRead, owned, nil},
+		{"owner updates", Subject{UserID: 1}, ActionUpdate, owned, nil},
+		{"owner deletes", Subject{UserID: 1}, ActionDelete, owned, nil},
+		{"owner analyzes", Subject{UserID: 1}, ActionAnalyze, owned, nil},
+		{"other user reads", Subject{UserID: 2}, ActionRead, owned, ErrForbidden},
+		{"other user deletes", Subject{UserID: 2}, ActionDelete, owned, ErrForbidden},
+		{"anonymous reads", Subject{}, ActionRead, owned, ErrForbidden},
+		{"anonymous reads unowned", Subject{}, ActionRead, Resource{Kind: "area"}, ErrForbidden},
+		{"unknown action", Subject{UserID: 1}, Action("share"), owned, ErrForbidden},
+		{"creator deletes shared area", Subject{UserID: 1}, ActionDelete, shared, ErrForbidden},
+		{"creator demoted to viewer updates shared area", Subject{UserID: 1, Roles: map[uint]string{orgID: models.RoleViewer}}, ActionUpdate, shared, ErrForbidden},
+		{"creator demoted to viewer reads shared area", Subject{UserID: 1, Roles: map[uint]string{orgID: models.RoleViewer}}, ActionRead, shared, nil},
+		{"removed member reads shared area", Subject{UserID: 1}, ActionRead, shared, ErrForbidden},
+		{"removed member analyzes shared area", Subject{UserID: 1}, ActionAnalyze, shared, ErrForbidden},
+		{"creator editor deletes shared area", member(1, models.RoleEditor), ActionDelete, shared, nil},
+		{"viewer reads shared area", member(2, models.RoleViewer), ActionRead, shared, nil},
+		{"viewer updates shared area", member(2, models.RoleViewer), ActionUpdate, shared, ErrForbidden},
+		{"viewer deletes shared area", member(2, models.RoleViewer), ActionDelete, shared, ErrForbidden},
+		{"viewer analyzes shared area", member(2, models.RoleViewer), ActionAnalyze, shared, ErrForbidden},
+		{"editor updates shared area", member(2, models.RoleEditor), ActionUpdate, shared, nil},
+		{"editor analyzes shared area", member(2, models.RoleEditor), ActionAnalyze, shared, nil},
+		{"owner deletes shared area", member(2, models.RoleOwner), ActionDelete, shared, nil},
+		{"member of another organization", Subject{UserID: 2, Roles: map[uint]string{otherOrgID: models.RoleOwner}}, ActionRead, shared, ErrForbidden},
+		{"unknown role", member(2, "admin"), ActionRead, shared, ErrForbidden},
+		{"viewer reads organization", member(2, models.RoleViewer), ActionRead, organization, nil},
+		{"editor updates organization", member(2, models.RoleEditor), ActionUpdate, organization, ErrForbidden},
+		{"owner updates organization", member(2, models.RoleOwner), ActionUpdate, organization, nil},
+		{"owner deletes organization", member(2, models.RoleOwner), ActionDelete, organization, nil},
+		{"non member reads organization", Subject{UserID: 3}, ActionRead, organization, ErrForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Authorize(tt.subject, tt.action, tt.resource); got != tt.want {
+				t.Errorf("Authorize() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResourceOf(t *testing.T) {
+	areaID := uint(3)
+
+	tests := []struct {
+		name   string
+		record interface{}
+		want   Resource
+	}{
+		{"area", &models.Area{UserID: 1}, Resource{Kind: "area", OwnerID: 1}},
+		{"alert rule", &models.AlertRule{UserID: 2, AreaID: &areaID}, Resource{Kind: "alert_rule", OwnerID: 2}},
+		{"alert", &models.Alert{UserID: 3}, Resource{Kind: "alert", OwnerID: 3}},
+		{"webhook", &models.Webhook{UserID: 4}, Resource{Kind: "webhook", OwnerID: 4}},
+		{"api key", &models.APIKey{UserID: 5}, Resource{Kind: "api_key", OwnerID: 5}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resourceOf(nil, tt.record)
+			if err != nil {
+				t.Fatalf("resourceOf() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("resourceOf() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := resourceOf(nil, &models.User{}); err == nil {
+		t.Error("resourceOf() accepted an unsupported record")
+	}
+}
+
+func TestReaders(t *testing.T) {
+	db := testdb.Open(t)
+
+	create := func(value interface{}) {
+		t.Helper()
+		if err := db.Create(value).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	creator := models.User{Username: "creator", Password: "x"}
+	viewer := models.User{Username: "viewer", Password: "x"}
+	outsider := models.User{Username: "outsider", Password: "x"}
+	for _, user := range []*models.User{&creator, &viewer, &outsider} {
+		create(user)
+	}
+	org := models.Organization{Name: "Reserve"}
+	create(&org)
+	owner := models.Membership{OrganizationID: org.ID, UserID: outsider.ID, Role: models.RoleOwner}
+	create(&owner)
+	create(&models.Membership{OrganizationID: org.ID, UserID: viewer.ID, Role: models.RoleViewer})
+	// The creator left the organization after creating the shared area
+	left := models.Membership{OrganizationID: org.ID, UserID: creator.ID, Role: models.RoleEditor}
+	create(&left)
+	if err := db.Delete(&left).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete(&owner).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	private := models.Area{AreaName: "private", UserID: creator.ID}
+	shared := models.Area{AreaName: "shared", UserID: creator.ID, OrganizationID: &org.ID}
+	deleted := models.Area{AreaName: "deleted", UserID: creator.ID}
+	for _, area := range []*models.Area{&private, &shared, &deleted} {
+		create(area)
+	}
+	if err := db.Delete(&deleted).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		area    models.Area
+		readers []uint
+	}{
+		{"private area", private, []uint{creator.ID}},
+		{"shared area", shared, []uint{viewer.ID}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Readers(db, tt.area)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.readers) {
+				t.Errorf("Readers = %v, want %v", got, tt.readers)
+			}
+		})
+	}
+
+	canRead := []struct {
+		name string
+		user models.User
+		area models.Area
+		want bool
+	}{
+		{"creator of a private area", creator, private, true},
+		{"other user on a private area", viewer, private, false},
+		{"creator who left", creator, shared, false},
+		{"viewer", viewer, shared, true},
+		{"removed owner", outsider, shared, false},
+		{"deleted area", creator, deleted, false},
+	}
+	for _, tt := range canRead {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := CanRead(db, tt.user.ID, tt.area.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("CanRead = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
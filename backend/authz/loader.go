@@ -0,0 +1,162 @@
+package authz
+
+import (
+	"deforestation/models"
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+)
+
+// SubjectFor loads the organization roles of a user
+func SubjectFor(db *gorm.DB, userID uint) (Subject, error) {
+	subject := Subject{UserID: userID, Roles: map[uint]string{}}
+
+	var memberships []models.Membership
+	if err := db.Where("user_id = ?", userID).Find(&memberships).Error; err != nil {
+		return subject, err
+	}
+	for _, membership := range memberships {
+		subject.Roles[membership.OrganizationID] = membership.Role
+	}
+	return subject, nil
+}
+
+// Load fetches the record with the given primary key into out, which must
+// be a pointer to one of the models known to the policy, and checks that
+// subject may perform action on it
+func Load(db *gorm.DB, subject Subject, action Action, out interface{}, id interface{}) error {
+	if err := db.First(out, id).Error; err != nil {
+		return lookupError(err)
+	}
+
+	resource, err := resourceOf(db, out)
+	if err != nil {
+		return err
+	}
+	return Authorize(subject, action, resource)
+}
+
+// LoadHistory fetches a capture along with its area and checks that subject
+// may perform action on the area
+func LoadHistory(db *gorm.DB, subject Subject, action Action, id interface{}) (models.History, models.Area, error) {
+	var history models.History
+	if err := db.First(&history, id).Error; err != nil {
+		return history, models.Area{}, lookupError(err)
+	}
+
+	area, err := LoadHistoryArea(db, subject, action, history)
+	return history, area, err
+}
+
+// LoadHistoryByImage fetches the capture referencing the object key as its
+// original or masked image and checks that subject may perform action on
+// its area
+func LoadHistoryByImage(db *gorm.DB, subject Subject, action Action, key string) (models.History, models.Area, error) {
+	var history models.History
+	if err := db.Where("image_path = ? OR masked_image_path = ?", key, key).First(&history).Error; err != nil {
+		return history, models.Area{}, lookupError(err)
+	}
+
+	area, err := LoadHistoryArea(db, subject, action, history)
+	return history, area, err
+}
+
+// LoadHistoryArea fetches the area of a capture and checks that subject may
+// perform action on it. Captures of deleted areas are reported as missing.
+func LoadHistoryArea(db *gorm.DB, subject Subject, action Action, history models.History) (models.Area, error) {
+	var area models.Area
+	if err := Load(db, subject, action, &area, history.AreaID); err != nil {
+		return area, err
+	}
+	return area, nil
+}
+
+// readableAreas matches the private areas of a user and the areas of any of
+// their organizations, whatever their role
+const readableAreas = `(user_id = ? AND organization_id IS NULL) OR organization_id IN
+	(SELECT organization_id FROM memberships WHERE user_id = ? AND deleted_at IS NULL)`
+
+// Areas scopes a query to the areas subject may read
+func Areas(db *gorm.DB, subject Subject) *gorm.DB {
+	return db.Model(&models.Area{}).Where(readableAreas, subject.UserID, subject.UserID)
+}
+
+// Histories scopes a query to the captures of the areas subject may read
+func Histories(db *gorm.DB, subject Subject) *gorm.DB {
+	return db.Model(&models.History{}).
+		Where("area_id IN (SELECT id FROM areas WHERE deleted_at IS NULL AND ("+readableAreas+"))",
+			subject.UserID, subject.UserID)
+}
+
+// Readers returns the users who may read area: the creator of a private
+// area, or every current member of the organization of a shared one
+func Readers(db *gorm.DB, area models.Area) ([]uint, error) {
+	if area.OrganizationID == nil {
+		return []uint{area.UserID}, nil
+	}
+
+	var userIDs []uint
+	err := db.Model(&models.Membership{}).Where("organization_id = ?", *area.OrganizationID).
+		Order("user_id").Pluck("user_id", &userIDs).Error
+	return userIDs, err
+}
+
+// CanRead reports whether a user may still read an area. Work done on their
+// behalf after the request that started it checks again, since they may
+// have left the organization in the meantime.
+func CanRead(db *gorm.DB, userID, areaID uint) (bool, error) {
+	subject, err := SubjectFor(db, userID)
+	if err != nil {
+		return false, err
+	}
+
+	var area models.Area
+	switch err := Load(db, subject, ActionRead, &area, areaID); err {
+	case nil:
+		return true, nil
+	case ErrNotFound, ErrForbidden:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// Organizations scopes a query to the organizations subject is a member of
+func Organizations(db *gorm.DB, subject Subject) *gorm.DB {
+	return db.Model(&models.Organization{}).
+		Where("id IN (SELECT organization_id FROM memberships WHERE user_id = ? AND deleted_at IS NULL)", subject.UserID)
+}
+
+// resourceOf describes a loaded record for the policy. Captures belong to
+// their area, so describing one requires a lookup.
+func resourceOf(db *gorm.DB, record interface{}) (Resource, error) {
+	switch r := record.(type) {
+	case *models.Area:
+		return Resource{Kind: "area", OwnerID: r.UserID, OrganizationID: r.OrganizationID}, nil
+	case *models.History:
+		var area models.Area
+		if err := db.First(&area, r.AreaID).Error; err != nil {
+			return Resource{}, lookupError(err)
+		}
+		return Resource{Kind: "history", OwnerID: area.UserID, OrganizationID: area.OrganizationID}, nil
+	case *models.Organization:
+		id := r.ID
+		return Resource{Kind: KindOrganization, OrganizationID: &id}, nil
+	case *models.AlertRule:
+		return Resource{Kind: "alert_rule", OwnerID: r.UserID}, nil
+	case *models.Alert:
+		return Resource{Kind: "alert", OwnerID: r.UserID}, nil
+	case *models.Webhook:
+		return Resource{Kind: "webhook", OwnerID: r.UserID}, nil
+	case *models.APIKey:
+		return Resource{Kind: "api_key", OwnerID: r.UserID}, nil
+	}
+	return Resource{}, fmt.Errorf("authz: unsupported resource %T", record)
+}
+
+func lookupError(err error) error {
+	if gorm.IsRecordNotFoundError(err) {
+		return ErrNotFound
+	}
+	return err
+}
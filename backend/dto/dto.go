@@ -0,0 +1,110 @@
+// Package dto defines the JSON representations of users, areas and
+// histories returned by the API. Handlers serialize these three through
+// the types below rather than the persistence models, so columns such as
+// password hashes cannot leak; other resources are still returned as
+// models. The field names match the ones clients already rely on.
+package dto
+
+import (
+	"deforestation/models"
+	"time"
+)
+
+// User is the public profile of a user
+type User struct {
+	ID        uint      `json:"ID"`
+	CreatedAt time.Time `json:"CreatedAt"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email"`
+	// SSO reports whether the user signs in through an identity provider
+	SSO bool `json:"sso"`
+}
+
+func NewUser(u models.User) User {
+	return User{
+		ID:        u.ID,
+		CreatedAt: u.CreatedAt,
+		Username:  u.Username,
+		Email:     u.Email,
+		SSO:       u.OIDCSubject != nil,
+	}
+}
+
+// Area is a monitored area
+type Area struct {
+	ID             uint      `json:"ID"`
+	CreatedAt      time.Time `json:"CreatedAt"`
+	UpdatedAt      time.Time `json:"UpdatedAt"`
+	AreaName       string    `json:"AreaName"`
+	TopRightLat    float64   `json:"TopRightLat"`
+	TopRightLon    float64   `json:"TopRightLon"`
+	BottomLeftLat  float64   `json:"BottomLeftLat"`
+	BottomLeftLon  float64   `json:"BottomLeftLon"`
+	DeforestedArea float64   `json:"DeforestedArea"`
+	UserID         uint      `json:"UserID"`
+	OrganizationID *uint     `json:"OrganizationID"`
+}
+
+func NewArea(a models.Area) Area {
+	return Area{
+		ID:             a.ID,
+		CreatedAt:      a.CreatedAt,
+		UpdatedAt:      a.UpdatedAt,
+		AreaName:       a.AreaName,
+		TopRightLat:    a.TopRightLat,
+		TopRightLon:    a.TopRightLon,
+		BottomLeftLat:  a.BottomLeftLat,
+		BottomLeftLon:  a.BottomLeftLon,
+		DeforestedArea: a.DeforestedArea,
+		UserID:         a.UserID,
+		OrganizationID: a.OrganizationID,
+	}
+}
+
+func NewAreas(areas []models.Area) []Area {
+	out := make([]Area, len(areas))
+	for i, a := range areas {
+		out[i] = NewArea(a)
+	}
+	return out
+}
+
+// History is one capture of an area. Area is only set when the area was
+// loaded along with the capture.
+type History struct {
+	ID              uint      `json:"ID"`
+	CreatedAt       time.Time `json:"CreatedAt"`
+	UpdatedAt       time.Time `json:"UpdatedAt"`
+	Date            time.Time `json:"Date"`
+	ImagePath       string    `json:"ImagePath"`
+	MaskedImagePath string    `json:"MaskedImagePath"`
+	DeforestedArea  float64   `json:"DeforestedArea"`
+	AreaID          uint      `json:"AreaID"`
+	Area            *Area     `json:"Area,omitempty"`
+}
+
+func NewHistory(h models.History) History {
+	history := History{
+		ID:              h.ID,
+		CreatedAt:       h.CreatedAt,
+		UpdatedAt:       h.UpdatedAt,
+		Date:            h.Date,
+		ImagePath:       h.ImagePath,
+		MaskedImagePath: h.MaskedImagePath,
+		DeforestedArea:  h.DeforestedArea,
+		AreaID:          h.AreaID,
+	}
+	if h.Area.ID != 0 {
+		area := NewArea(h.Area)
+		history.Area = &area
+	}
+	return history
+}
+
+func NewHistories(histories []models.History) []History {
+	out := make([]History, len(histories))
+	for i, h := range histories {
+		out[i] = NewHistory(h)
+	}
+	return out
+}
@@ -0,0 +1,190 @@
+// Package export streams the history time series of areas as CSV or Parquet.
+package export
+
+import (
+	"deforestation/models"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Row is one capture of an area together with the analysis run that
+// produced it
+type Row struct {
+	AreaID             uint
+	AreaName           string
+	HistoryID          uint
+	Date               time.Time
+	DeforestedPercent  float64
+	DeforestedHectares float64
+	SurfaceHectares    float64
+	ImagePath          string
+	MaskedImagePath    string
+	RunID              *uint
+	RunStatus          *string
+	RunStartedAt       *time.Time
+	RunFinishedAt      *time.Time
+}
+
+// Writer receives the exported rows one at a time
+type Writer interface {
+	Write(row Row) error
+	Close() error
+}
+
+var columns = []string{
+	"area_id", "area_name", "history_id", "date", "deforested_percent", "deforested_hectares",
+	"surface_hectares", "image_path", "masked_image_path", "run_id", "run_status",
+	"run_started_at", "run_finished_at",
+}
+
+// Histories streams the captures of the private areas of the user and of
+// the areas of their organizations, or of a single area when areaID is not nil,
+// ordered by area and date
+func Histories(db *gorm.DB, userID uint, areaID *uint, out Writer) error {
+	query := `SELECT h.id, h.date, h.deforested_area, h.image_path, h.masked_image_path,
+		a.id, a.area_name, a.top_right_lat, a.top_right_lon, a.bottom_left_lat, a.bottom_left_lon,
+		r.id, r.status, r.started_at, r.finished_at
+	FROM histories h
+	JOIN areas a ON a.id = h.area_id AND a.deleted_at IS NULL
+	LEFT JOIN analysis_runs r ON r.history_id = h.id AND r.deleted_at IS NULL
+	WHERE h.deleted_at IS NULL AND ((a.user_id = ? AND a.organization_id IS NULL) OR a.organization_id IN
+		(SELECT organization_id FROM memberships WHERE user_id = ? AND deleted_at IS NULL))`
+	args := []interface{}{userID, userID}
+	if areaID != nil {
+		query += " AND a.id = ?"
+		args = append(args, *areaID)
+	}
+	query += " ORDER BY a.id, h.date"
+
+	rows, err := db.Raw(query, args...).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row Row
+		var area models.Area
+		if err := rows.Scan(&row.HistoryID, &row.Date, &row.DeforestedPercent, &row.ImagePath, &row.MaskedImagePath,
+			&row.AreaID, &row.AreaName, &area.TopRightLat, &area.TopRightLon, &area.BottomLeftLat, &area.BottomLeftLon,
+			&row.RunID, &row.RunStatus, &row.RunStartedAt, &row.RunFinishedAt); err != nil {
+			return err
+		}
+
+		row.SurfaceHectares = area.SurfaceKm2() * 100
+		row.DeforestedHectares = row.SurfaceHectares * row.DeforestedPercent / 100
+
+		if err := out.Write(row); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	return out.Close()
+}
+
+// flushEvery is the number of CSV rows written between flushes to the client
+const flushEvery = 500
+
+type csvWriter struct {
+	w      *csv.Writer
+	dst    io.Writer
+	header bool
+	count  int
+}
+
+// NewCSVWriter writes rows as CSV with a header line. When w is an
+// http.Flusher the response is flushed periodically.
+func NewCSVWriter(w io.Writer) Writer {
+	return &csvWriter{w: csv.NewWriter(w), dst: w}
+}
+
+func (c *csvWriter) Write(row Row) error {
+	if !c.header {
+		c.header = true
+		if err := c.w.Write(columns); err != nil {
+			return err
+		}
+	}
+
+	record := []string{
+		strconv.FormatUint(uint64(row.AreaID), 10),
+		row.AreaName,
+		strconv.FormatUint(uint64(row.HistoryID), 10),
+		row.Date.UTC().Format(time.RFC3339),
+		strconv.FormatFloat(row.DeforestedPercent, 'f', 4, 64),
+		strconv.FormatFloat(row.DeforestedHectares, 'f', 2, 64),
+		strconv.FormatFloat(row.SurfaceHectares, 'f', 2, 64),
+		row.ImagePath,
+		row.MaskedImagePath,
+		"", "", "", "",
+	}
+	if row.RunID != nil {
+		record[9] = strconv.FormatUint(uint64(*row.RunID), 10)
+	}
+	if row.RunStatus != nil {
+		record[10] = *row.RunStatus
+	}
+	if row.RunStartedAt != nil {
+		record[11] = row.RunStartedAt.UTC().Format(time.RFC3339)
+	}
+	if row.RunFinishedAt != nil {
+		record[12] = row.RunFinishedAt.UTC().Format(time.RFC3339)
+	}
+
+	if err := c.w.Write(record); err != nil {
+		return err
+	}
+
+	c.count++
+	if c.count%flushEvery == 0 {
+		c.flush()
+	}
+	return c.w.Error()
+}
+
+func (c *csvWriter) Close() error {
+	if !c.header {
+		c.header = true
+		if err := c.w.Write(columns); err != nil {
+			return err
+		}
+	}
+	c.flush()
+	return c.w.Error()
+}
+
+func (c *csvWriter) flush() {
+	c.w.Flush()
+	if f, ok := c.dst.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// NewWriter returns the writer for format, which is csv or parquet
+func NewWriter(format string, w io.Writer) (Writer, error) {
+	switch format {
+	case "", "csv":
+		return NewCSVWriter(w), nil
+	case "parquet":
+		return NewParquetWriter(w), nil
+	default:
+		return nil, fmt.Errorf("unsupported export format %q", format)
+	}
+}
+
+// ContentType returns the MIME type and file extension of an export format
+func ContentType(format string) (string, string) {
+	if format == "parquet" {
+		return "application/vnd.apache.parquet", "parquet"
+	}
+	return "text/csv; charset=utf-8", "csv"
+}
@@ -0,0 +1,75 @@
+package export
+
+import (
+	"io"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// rowGroupSize bounds the number of rows buffered in memory before a row
+// group is written out
+const rowGroupSize = 10000
+
+// parquetRow is the Parquet schema of a Row. Its columns follow the order of
+// the CSV header. The run columns are optional: zero values, which runs
+// never have, are written as nulls. Run times are Unix milliseconds, as a
+// zero time.Time is not written as null.
+type parquetRow struct {
+	AreaID             int64     `parquet:"area_id"`
+	AreaName           string    `parquet:"area_name"`
+	HistoryID          int64     `parquet:"history_id"`
+	Date               time.Time `parquet:"date,timestamp(millisecond)"`
+	DeforestedPercent  float64   `parquet:"deforested_percent"`
+	DeforestedHectares float64   `parquet:"deforested_hectares"`
+	SurfaceHectares    float64   `parquet:"surface_hectares"`
+	ImagePath          string    `parquet:"image_path"`
+	MaskedImagePath    string    `parquet:"masked_image_path"`
+	RunID              int64     `parquet:"run_id,optional"`
+	RunStatus          string    `parquet:"run_status,optional"`
+	RunStartedAt       int64     `parquet:"run_started_at,optional,timestamp(millisecond)"`
+	RunFinishedAt      int64     `parquet:"run_finished_at,optional,timestamp(millisecond)"`
+}
+
+type parquetWriter struct {
+	w *parquet.GenericWriter[parquetRow]
+}
+
+// NewParquetWriter writes rows as a Parquet file, buffering at most one row
+// group in memory
+func NewParquetWriter(w io.Writer) Writer {
+	return &parquetWriter{w: parquet.NewGenericWriter[parquetRow](w, parquet.MaxRowsPerRowGroup(rowGroupSize))}
+}
+
+func (p *parquetWriter) Write(row Row) error {
+	record := parquetRow{
+		AreaID:             int64(row.AreaID),
+		AreaName:           row.AreaName,
+		HistoryID:          int64(row.HistoryID),
+		Date:               row.Date,
+		DeforestedPercent:  row.DeforestedPercent,
+		DeforestedHectares: row.DeforestedHectares,
+		SurfaceHectares:    row.SurfaceHectares,
+		ImagePath:          row.ImagePath,
+		MaskedImagePath:    row.MaskedImagePath,
+	}
+	if row.RunID != nil {
+		record.RunID = int64(*row.RunID)
+	}
+	if row.RunStatus != nil {
+		record.RunStatus = *row.RunStatus
+	}
+	if row.RunStartedAt != nil {
+		record.RunStartedAt = row.RunStartedAt.UnixMilli()
+	}
+	if row.RunFinishedAt != nil {
+		record.RunFinishedAt = row.RunFinishedAt.UnixMilli()
+	}
+
+	_, err := p.w.Write([]parquetRow{record})
+	return err
+}
+
+func (p *parquetWriter) Close() error {
+	return p.w.Close()
+}
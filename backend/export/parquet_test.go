@@ -0,0 +1,212 @@
+package export
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/deprecated"
+	"github.com/parquet-go/parquet-go/format"
+)
+
+// exportRows returns n rows, every other one without an analysis run
+func exportRows(n int) []Row {
+	date := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	rows := make([]Row, n)
+	for i := range rows {
+		rows[i] = Row{
+			AreaID:             uint(i/100 + 1),
+			AreaName:           "Área " + string(rune('A'+i%26)),
+			HistoryID:          uint(i + 1),
+			Date:               date.Add(time.Duration(i) * time.Hour),
+			DeforestedPercent:  float64(i%100) / 4,
+			DeforestedHectares: float64(i) * 1.5,
+			SurfaceHectares:    1234.5,
+			ImagePath:          "area.png",
+			MaskedImagePath:    "",
+		}
+		if i%2 == 0 {
+			runID, status := uint(i+7), "succeeded"
+			started, finished := rows[i].Date, rows[i].Date.Add(90*time.Second)
+			rows[i].RunID, rows[i].RunStatus = &runID, &status
+			rows[i].RunStartedAt, rows[i].RunFinishedAt = &started, &finished
+		}
+	}
+	return rows
+}
+
+func writeParquet(t *testing.T, rows []Row) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := NewParquetWriter(&buf)
+	for _, row := range rows {
+		if err := w.Write(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestParquetFooter(t *testing.T) {
+	data := writeParquet(t, exportRows(2*rowGroupSize+5))
+
+	file, err := parquet.OpenFile(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	meta := file.Metadata()
+
+	if meta.NumRows != 2*rowGroupSize+5 {
+		t.Errorf("num_rows = %d", meta.NumRows)
+	}
+	if len(meta.RowGroups) != 3 {
+		t.Fatalf("%d row groups, want 3", len(meta.RowGroups))
+	}
+	for i, want := range []int64{rowGroupSize, rowGroupSize, 5} {
+		if got := meta.RowGroups[i].NumRows; got != want {
+			t.Errorf("row group %d has %d rows, want %d", i, got, want)
+		}
+	}
+
+	schema := meta.Schema
+	if len(schema) != len(columns)+1 || int(schema[0].NumChildren) != len(columns) {
+		t.Fatalf("schema has %d elements with %d children", len(schema), schema[0].NumChildren)
+	}
+	wantTypes := map[string]struct {
+		physical  format.Type
+		converted deprecated.ConvertedType
+		optional  bool
+	}{
+		"area_id":            {format.Int64, deprecated.Int64, false},
+		"area_name":          {format.ByteArray, deprecated.UTF8, false},
+		"date":               {format.Int64, deprecated.TimestampMillis, false},
+		"deforested_percent": {format.Double, -1, false},
+		"run_id":             {format.Int64, deprecated.Int64, true},
+		"run_status":         {format.ByteArray, deprecated.UTF8, true},
+		"run_finished_at":    {format.Int64, deprecated.TimestampMillis, true},
+	}
+	for i, element := range schema[1:] {
+		if element.Name != columns[i] {
+			t.Errorf("column %d is %q, want %q", i, element.Name, columns[i])
+		}
+		want, ok := wantTypes[element.Name]
+		if !ok {
+			continue
+		}
+		if element.Type == nil || *element.Type != want.physical {
+			t.Errorf("%s has type %v, want %v", element.Name, element.Type, want.physical)
+		}
+		if converted := element.ConvertedType; (converted == nil) != (want.converted < 0) ||
+			converted != nil && *converted != want.converted {
+			t.Errorf("%s has converted type %v, want %v", element.Name, converted, want.converted)
+		}
+		optional := element.RepetitionType != nil && *element.RepetitionType == format.Optional
+		if optional != want.optional {
+			t.Errorf("%s optional = %v, want %v", element.Name, optional, want.optional)
+		}
+	}
+
+	for i, group := range meta.RowGroups {
+		for j, chunk := range group.Columns {
+			if chunk.MetaData.DataPageOffset < int64(len("PAR1")) {
+				t.Errorf("row group %d column %d has its data page at %d", i, j, chunk.MetaData.DataPageOffset)
+			}
+			if chunk.MetaData.NumValues != group.NumRows {
+				t.Errorf("row group %d column %d has %d values for %d rows", i, j, chunk.MetaData.NumValues, group.NumRows)
+			}
+		}
+	}
+}
+
+func TestParquetRoundTrip(t *testing.T) {
+	want := exportRows(rowGroupSize + 3)
+	data := writeParquet(t, want)
+
+	reader := parquet.NewReader(bytes.NewReader(data))
+	defer reader.Close()
+
+	var got []parquet.Row
+	buf := make([]parquet.Row, 100)
+	for {
+		n, err := reader.ReadRows(buf)
+		for _, row := range buf[:n] {
+			got = append(got, row.Clone())
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatalf("ReadRows: %v", err)
+		}
+	}
+	if len(got) != len(want) {
+		t.Fatalf("read %d rows, want %d", len(got), len(want))
+	}
+
+	optionalInt64 := func(v parquet.Value) *int64 {
+		if v.IsNull() {
+			return nil
+		}
+		i := v.Int64()
+		return &i
+	}
+	millis := func(t *time.Time) *int64 {
+		if t == nil {
+			return nil
+		}
+		ms := t.UnixMilli()
+		return &ms
+	}
+	equal := func(a, b *int64) bool {
+		return a == nil && b == nil || a != nil && b != nil && *a == *b
+	}
+
+	for i, row := range got {
+		w := want[i]
+		if len(row) != len(columns) {
+			t.Fatalf("row %d has %d values", i, len(row))
+		}
+		if row[0].Int64() != int64(w.AreaID) || string(row[1].ByteArray()) != w.AreaName ||
+			row[2].Int64() != int64(w.HistoryID) || row[3].Int64() != w.Date.UnixMilli() {
+			t.Fatalf("row %d = %v, want %+v", i, row, w)
+		}
+		if row[4].Double() != w.DeforestedPercent || row[5].Double() != w.DeforestedHectares ||
+			row[6].Double() != w.SurfaceHectares {
+			t.Fatalf("row %d doubles = %v, want %+v", i, row[4:7], w)
+		}
+		if string(row[7].ByteArray()) != w.ImagePath || string(row[8].ByteArray()) != w.MaskedImagePath {
+			t.Fatalf("row %d paths = %v, want %+v", i, row[7:9], w)
+		}
+
+		var runID *int64
+		if w.RunID != nil {
+			id := int64(*w.RunID)
+			runID = &id
+		}
+		if !equal(optionalInt64(row[9]), runID) ||
+			!equal(optionalInt64(row[11]), millis(w.RunStartedAt)) ||
+			!equal(optionalInt64(row[12]), millis(w.RunFinishedAt)) {
+			t.Fatalf("row %d run = %v, want %+v", i, row[9:], w)
+		}
+		if row[10].IsNull() != (w.RunStatus == nil) || w.RunStatus != nil && string(row[10].ByteArray()) != *w.RunStatus {
+			t.Fatalf("row %d run status = %v", i, row[10])
+		}
+	}
+}
+
+func TestParquetEmpty(t *testing.T) {
+	data := writeParquet(t, nil)
+
+	file, err := parquet.OpenFile(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	if file.NumRows() != 0 || len(file.Metadata().RowGroups) != 0 {
+		t.Errorf("empty export has %d rows in %d row groups", file.NumRows(), len(file.Metadata().RowGroups))
+	}
+}
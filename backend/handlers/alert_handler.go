@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"deforestation/alerts"
+	"deforestation/authz"
+	"deforestation/models"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+type CreateAlertRuleInput struct {
+	AreaID    *uint    `json:"area_id"`
+	Kind      string   `json:"kind" binding:"required"`
+	Threshold *float64 `json:"threshold" binding:"required"`
+	Enabled   *bool    `json:"enabled"`
+}
+
+// CreateAlertRule registers a new alert rule for the current user
+func CreateAlertRule(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetUint("userID")
+
+		var input CreateAlertRuleInput
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if !alerts.ValidKind(input.Kind) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid alert rule kind"})
+			return
+		}
+
+		if input.AreaID != nil {
+			var area models.Area
+			err := authz.Load(db, subjectOf(db, c), authz.ActionRead, &area, *input.AreaID)
+			if !authorized(c, err, "area") {
+				return
+			}
+		}
+
+		rule := models.AlertRule{
+			UserID:    userID,
+			AreaID:    input.AreaID,
+			Kind:      input.Kind,
+			Threshold: *input.Threshold,
+			Enabled:   input.Enabled == nil || *input.Enabled,
+		}
+
+		if err := db.Create(&rule).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{"data": rule})
+	}
+}
+
+// GetAlertRules returns the alert rules of the current user
+func GetAlertRules(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetUint("userID")
+
+		var rules []models.AlertRule
+		if err := db.Where("user_id = ?", userID).Find(&rules).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"data": rules})
+	}
+}
+
+// DeleteAlertRule deletes an alert rule of the current user
+func DeleteAlertRule(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var rule models.AlertRule
+		if !load(db, c, authz.ActionDelete, &rule, "alert rule") {
+			return
+		}
+
+		if err := db.Delete(&rule).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Alert rule deleted successfully"})
+	}
+}
+
+// GetAlerts returns the alerts of the current user, optionally filtered by
+// state and area
+func GetAlerts(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		query := db.Where("user_id = ?", c.GetUint("userID"))
+
+		if state := c.Query("state"); state != "" {
+			query = query.Where("state = ?", state)
+		}
+		if areaID := c.Query("area_id"); areaID != "" {
+			query = query.Where("area_id = ?", areaID)
+		}
+
+		var results []models.Alert
+		if err := query.Order("created_at desc").Find(&results).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"data": results})
+	}
+}
+
+// GetAlert returns a single alert by ID
+func GetAlert(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		alert, ok := loadAlert(db, c, authz.ActionRead)
+		if !ok {
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"data": alert})
+	}
+}
+
+// AcknowledgeAlert moves an open alert to the acknowledged state
+func AcknowledgeAlert(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		alert, ok := loadAlert(db, c, authz.ActionUpdate)
+		if !ok {
+			return
+		}
+
+		if alert.State != models.AlertStateOpen {
+			c.JSON(http.StatusConflict, gin.H{"error": "Only open alerts can be acknowledged"})
+			return
+		}
+
+		now := time.Now()
+		alert.State = models.AlertStateAcknowledged
+		alert.AcknowledgedAt = &now
+		if err := db.Save(&alert).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"data": alert})
+	}
+}
+
+// ResolveAlert closes an open or acknowledged alert
+func ResolveAlert(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		alert, ok := loadAlert(db, c, authz.ActionUpdate)
+		if !ok {
+			return
+		}
+
+		if alert.State == models.AlertStateResolved {
+			c.JSON(http.StatusConflict, gin.H{"error": "Alert is already resolved"})
+			return
+		}
+
+		now := time.Now()
+		alert.State = models.AlertStateResolved
+		alert.ResolvedAt = &now
+		if err := db.Save(&alert).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"data": alert})
+	}
+}
+
+func loadAlert(db *gorm.DB, c *gin.Context, action authz.Action) (models.Alert, bool) {
+	var alert models.Alert
+	ok := load(db, c, action, &alert, "alert")
+	return alert, ok
+}
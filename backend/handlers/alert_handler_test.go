@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/gin-gonic/gin/binding"
+)
+
+func TestCreateAlertRuleInputBinding(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		ok   bool
+	}{
+		{"threshold", `{"kind": "absolute", "threshold": 5}`, true},
+		{"zero threshold", `{"kind": "absolute", "threshold": 0}`, true},
+		{"negative threshold", `{"kind": "absolute", "threshold": -1.5}`, true},
+		{"missing threshold", `{"kind": "absolute"}`, false},
+		{"null threshold", `{"kind": "absolute", "threshold": null}`, false},
+		{"missing kind", `{"threshold": 5}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var input CreateAlertRuleInput
+			err := binding.JSON.BindBody([]byte(tt.body), &input)
+			if (err == nil) != tt.ok {
+				t.Fatalf("BindBody = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"deforestation/apikeys"
+	"deforestation/authz"
+	"deforestation/models"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+type CreateAPIKeyInput struct {
+	Name      string     `json:"name" binding:"required"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// CreateAPIKey issues an API key for the current user. Keys are read-only
+// unless the write scope is requested. The key is only returned in this
+// response.
+func CreateAPIKey(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var input CreateAPIKeyInput
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		scopes := []string{models.ScopeRead}
+		for _, scope := range input.Scopes {
+			if !apikeys.ValidScope(scope) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown scope: " + scope})
+				return
+			}
+			if scope == models.ScopeWrite {
+				scopes = append(scopes, models.ScopeWrite)
+			}
+		}
+
+		if input.ExpiresAt != nil && !input.ExpiresAt.After(time.Now()) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Expiry must be in the future"})
+			return
+		}
+
+		key, raw, err := apikeys.Create(db, c.GetUint("userID"), input.Name, scopes, input.ExpiresAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{"data": key, "key": raw})
+	}
+}
+
+// GetAPIKeys returns the API keys of the current user, including revoked
+// ones
+func GetAPIKeys(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var keys []models.APIKey
+		if err := db.Where("user_id = ?", c.GetUint("userID")).Order("created_at desc").Find(&keys).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"data": keys})
+	}
+}
+
+// RevokeAPIKey disables an API key of the current user
+func RevokeAPIKey(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var key models.APIKey
+		if !load(db, c, authz.ActionDelete, &key, "API key") {
+			return
+		}
+
+		if key.RevokedAt == nil {
+			if err := apikeys.Revoke(db, &key); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{"data": key})
+	}
+}
@@ -1,11 +1,26 @@
 package handlers
 
 import (
+	"bytes"
+	"deforestation/audit"
+	"deforestation/authz"
+	"deforestation/dto"
 	"deforestation/jobs"
 	"deforestation/models"
+	"deforestation/quota"
+	"deforestation/ratelimit"
+	"deforestation/renditions"
+	"deforestation/reports"
+	"deforestation/retention"
+	"deforestation/storage"
+	"deforestation/tileapi"
 	"deforestation/utils"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
-	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
@@ -17,9 +32,19 @@ type CreateAreaInput struct {
 	TopRightLon   float64 `json:"top_right_lon" binding:"required"`
 	BottomLeftLat float64 `json:"bottom_left_lat" binding:"required"`
 	BottomLeftLon float64 `json:"bottom_left_lon" binding:"required"`
+	// OrganizationID optionally shares the new area with an organization
+	OrganizationID *uint `json:"organization_id"`
 }
 
+type MoveAreaInput struct {
+	OrganizationID *uint `json:"organization_id"`
+}
+
+// CreateArea adds an area and runs its first analysis. The area is only
+// stored when its first analysis fits in the quotas too.
 func CreateArea(db *gorm.DB) gin.HandlerFunc {
+	limits := quota.DefaultsFromEnv()
+
 	return func(c *gin.Context) {
 		userID := c.GetUint("userID")
 
@@ -35,107 +60,340 @@ func CreateArea(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
+		if input.OrganizationID != nil && !canAddAreas(db, c, *input.OrganizationID) {
+			return
+		}
+
 		area := models.Area{
-			AreaName:      input.AreaName,
-			TopRightLat:   input.TopRightLat,
-			TopRightLon:   input.TopRightLon,
-			BottomLeftLat: input.BottomLeftLat,
-			BottomLeftLon: input.BottomLeftLon,
-			UserID:        userID,
+			AreaName:       input.AreaName,
+			TopRightLat:    input.TopRightLat,
+			TopRightLon:    input.TopRightLon,
+			BottomLeftLat:  input.BottomLeftLat,
+			BottomLeftLon:  input.BottomLeftLon,
+			UserID:         userID,
+			OrganizationID: input.OrganizationID,
 		}
 
-		db.Create(&area)
+		// The first analysis is taken in the same transaction as the area, so
+		// a request refused by a quota leaves nothing behind and can be retried
+		var run models.AnalysisRun
+		account := quota.AccountOf(area)
+		err := quota.Lock(db, account, func(tx *gorm.DB) error {
+			now := time.Now()
+			if err := quota.CheckArea(tx, limits, account, area, now); err != nil {
+				return err
+			}
+			if err := tx.Create(&area).Error; err != nil {
+				return err
+			}
+			var err error
+			run, err = utils.StartAnalysis(tx, area, false, now)
+			return err
+		})
+		if !withinQuotas(c, err) {
+			return
+		}
+		auditRequest(db, c, audit.ForArea(audit.ActionAreaCreate, area))
 
 		// Save job schedule
 		jobSchedule := models.JobSchedule{AreaID: area.ID}
 		db.Create(&jobSchedule)
 
 		// Start job for the new area here
-		jobs.StartWeeklyJob(area.ID, utils.GetSatelliteImage)
-		err := utils.GetSatelliteImage(area.ID)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"err": err})
+		jobs.StartWeeklyJob(db, area.ID, utils.RunScheduledCapture)
+
+		// The area exists from here on. A failed capture is recorded in its
+		// analysis run and notified to its readers, the weekly job tries again.
+		if err := utils.Analyse(db, area, run); err != nil {
+			log.Printf("Error analysing new area %d: %v", area.ID, err)
 		}
 
-		c.JSON(http.StatusOK, gin.H{"data": area})
+		c.JSON(http.StatusOK, gin.H{"data": dto.NewArea(area)})
 	}
 }
 
 // GetArea fetches an area by its ID
 func GetArea(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		idStr := c.Param("id")
-		userID := c.GetUint("userID")
-		id, err := strconv.Atoi(idStr)
+		area, ok := loadArea(db, c, authz.ActionRead)
+		if !ok {
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"data": dto.NewArea(area)})
+	}
+}
+
+var areaSortColumns = map[string]string{
+	"date":            "created_at",
+	"deforested_area": "deforested_area",
+}
+
+// GetAllAreas fetches a page of the areas of the current user
+func GetAllAreas(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		lq, err := parseListQuery(c, areaSortColumns, "date", "created_at")
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid area ID"})
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
-		var area models.Area
-		if err := db.First(&area, id).Error; err != nil {
-			if gorm.IsRecordNotFoundError(err) {
-				c.JSON(http.StatusNotFound, gin.H{"error": "Area not found"})
+		query := lq.filter(authz.Areas(db, subjectOf(db, c)))
+
+		var total int
+		if err := query.Count(&total).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		paged, err := lq.page(query)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var areas []models.Area
+		if err := paged.Find(&areas).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		next := ""
+		if len(areas) > lq.limit {
+			areas = areas[:lq.limit]
+			last := areas[len(areas)-1]
+			if lq.sortColumn == "created_at" {
+				next = lq.nextCursor(last.CreatedAt, last.ID)
 			} else {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				next = lq.nextCursor(last.DeforestedArea, last.ID)
 			}
+		}
+
+		lq.respond(c, dto.NewAreas(areas), total, next)
+	}
+}
+
+// DeleteArea deletes an area by its ID, along with the images of its
+// captures and their cached renditions
+func DeleteArea(db *gorm.DB, cache *renditions.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		area, ok := loadArea(db, c, authz.ActionDelete)
+		if !ok {
 			return
 		}
 
-		if area.UserID != userID {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "You do not have access to this area"})
+		// Delete the area
+		if err := db.Delete(&area).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
 		}
+		auditRequest(db, c, audit.ForArea(audit.ActionAreaDelete, area))
 
-		c.JSON(http.StatusOK, gin.H{"data": area})
+		// The captures are kept for the record, their images are not. Anything
+		// left behind is picked up by the nightly garbage collection.
+		if report, err := retention.PurgeArea(c.Request.Context(), db, storage.GetStore(), cache, area.ID); err != nil {
+			log.Printf("Error purging images of area %d: %v", area.ID, err)
+		} else {
+			log.Printf("Purged %d images (%d bytes) of area %d", report.DeletedObjects, report.ReclaimedBytes, area.ID)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Area deleted successfully"})
 	}
 }
 
-// GetAllAreas fetches an area by its ID
-func GetAllAreas(db *gorm.DB) gin.HandlerFunc {
+// AnalyzeArea captures and analyses an area right away instead of waiting
+// for its weekly job, and returns the resulting analysis run
+func AnalyzeArea(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		userID := c.GetUint("userID")
+		area, ok := loadArea(db, c, authz.ActionAnalyze)
+		if !ok {
+			return
+		}
 
-		var areas []models.Area
-		if err := db.Where("user_id = ?", userID).Find(&areas).Error; err != nil {
-			if gorm.IsRecordNotFoundError(err) {
-				c.JSON(http.StatusNotFound, gin.H{"error": "Area not found"})
-			} else {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		started := time.Now().Truncate(time.Microsecond)
+		analysisErr := utils.GetSatelliteImage(area.ID)
+
+		// Captures over the analysis or the tile quota do not start at all
+		var exceeded *quota.ExceededError
+		var exhausted *tileapi.ExhaustedError
+		if errors.As(analysisErr, &exceeded) || errors.As(analysisErr, &exhausted) {
+			withinQuotas(c, analysisErr)
+			return
+		}
+
+		// Capture failures are recorded as a failed run, which is returned
+		// below. Without a run the analysis could not even start.
+		var run models.AnalysisRun
+		if err := db.Where("area_id = ? AND started_at >= ?", area.ID, started).
+			Order("started_at desc").First(&run).Error; err != nil {
+			if analysisErr != nil {
+				err = analysisErr
 			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"data": areas})
+		status := http.StatusOK
+		if run.Status == models.AnalysisRunFailed {
+			status = http.StatusBadGateway
+		}
+		c.JSON(status, gin.H{"data": run})
 	}
 }
 
-// DeleteArea deletes an area by its ID
-func DeleteArea(db *gorm.DB) gin.HandlerFunc {
+// MoveArea shares an area with an organization, moves it to another one or,
+// with a null organization_id, makes it private to its creator again
+func MoveArea(db *gorm.DB) gin.HandlerFunc {
+	limits := quota.DefaultsFromEnv()
+
 	return func(c *gin.Context) {
-		idStr := c.Param("id")
-		id, err := strconv.Atoi(idStr)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid area ID"})
+		area, ok := loadArea(db, c, authz.ActionUpdate)
+		if !ok {
 			return
 		}
 
-		// Check if the area exists
-		var area models.Area
-		if err := db.First(&area, id).Error; err != nil {
-			if gorm.IsRecordNotFoundError(err) {
-				c.JSON(http.StatusNotFound, gin.H{"error": "Area not found"})
-			} else {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		var input MoveAreaInput
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if input.OrganizationID != nil && !canAddAreas(db, c, *input.OrganizationID) {
+			return
+		}
+
+		moved := area
+		moved.OrganizationID = input.OrganizationID
+		account := quota.AccountOf(moved)
+		err := quota.Lock(db, account, func(tx *gorm.DB) error {
+			if !account.Same(quota.AccountOf(area)) {
+				if err := quota.CheckArea(tx, limits, account, moved, time.Now()); err != nil {
+					return err
+				}
 			}
+			return tx.Model(&area).Update("organization_id", input.OrganizationID).Error
+		})
+		if !withinQuota(c, err) {
 			return
 		}
+		area.OrganizationID = input.OrganizationID
 
-		// Delete the area
-		if err := db.Delete(&area).Error; err != nil {
+		c.JSON(http.StatusOK, gin.H{"data": dto.NewArea(area)})
+	}
+}
+
+// withinQuota writes a 403 response when err is a quota error, and a 500
+// response for any other error
+func withinQuota(c *gin.Context, err error) bool {
+	var exceeded *quota.ExceededError
+	if errors.As(err, &exceeded) {
+		c.JSON(http.StatusForbidden, gin.H{"error": exceeded.Error()})
+		return false
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// withinQuotas answers like withinTileQuota when err is an exhausted tile
+// quota, and like withinQuota otherwise
+func withinQuotas(c *gin.Context, err error) bool {
+	var exhausted *tileapi.ExhaustedError
+	if errors.As(err, &exhausted) {
+		return withinTileQuota(c, err)
+	}
+	return withinQuota(c, err)
+}
+
+// withinTileQuota answers 503 with a Retry-After header when err is an
+// exhausted tile quota, and 500 for other errors
+func withinTileQuota(c *gin.Context, err error) bool {
+	var exhausted *tileapi.ExhaustedError
+	if errors.As(err, &exhausted) {
+		c.Header("Retry-After", ratelimit.RetryAfter(exhausted.RetryAfter()))
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": exhausted.Error()})
+		return false
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// canAddAreas checks that the user may add areas to an organization, which
+// takes the same role as changing its existing areas
+func canAddAreas(db *gorm.DB, c *gin.Context, organizationID uint) bool {
+	var organization models.Organization
+	err := authz.Load(db, subjectOf(db, c), authz.ActionRead, &organization, organizationID)
+	if err == nil {
+		err = authz.Authorize(subjectOf(db, c), authz.ActionUpdate,
+			authz.Resource{Kind: "area", OrganizationID: &organization.ID})
+	}
+	return authorized(c, err, "organization")
+}
+
+// GetAreaReport renders a PDF report of an area's history. The optional
+// dates query parameter is a comma separated list of up to
+// reports.MaxReportDates YYYY-MM-DD dates whose closest captures are shown
+// side by side.
+func GetAreaReport(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		area, ok := loadArea(db, c, authz.ActionRead)
+		if !ok {
+			return
+		}
+
+		var dates []time.Time
+		if param := c.Query("dates"); param != "" {
+			values := strings.Split(param, ",")
+			if len(values) > reports.MaxReportDates {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d dates are allowed", reports.MaxReportDates)})
+				return
+			}
+			for _, s := range values {
+				date, err := time.Parse("2006-01-02", strings.TrimSpace(s))
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date: " + s})
+					return
+				}
+				dates = append(dates, date)
+			}
+		}
+
+		var buf bytes.Buffer
+		if err := reports.AreaReport(db, storage.GetStore(), area, dates, &buf); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"message": "Area deleted successfully"})
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"area_%d_report.pdf\"", area.ID))
+		c.Data(http.StatusOK, "application/pdf", buf.Bytes())
+	}
+}
+
+// GetAreaTimeSeries buckets an area's deforestation history per week or
+// month and estimates its trend
+func GetAreaTimeSeries(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		area, ok := loadArea(db, c, authz.ActionRead)
+		if !ok {
+			return
+		}
+
+		var histories []models.History
+		if err := db.Where("area_id = ?", area.ID).Order("date asc").Find(&histories).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		series, err := reports.BuildTimeSeries(histories, area.SurfaceKm2()*100,
+			c.DefaultQuery("interval", "month"), c.DefaultQuery("agg", "avg"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"data": series})
 	}
 }
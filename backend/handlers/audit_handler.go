@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"deforestation/audit"
+	"deforestation/authz"
+	"deforestation/models"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+var auditSortColumns = map[string]string{
+	"date": "created_at",
+}
+
+// GetAuditLog returns a page of the audit log entries the current user may
+// read: their own events, the events of their private areas and, for the
+// organizations they own, the events of the organization's areas and the
+// signups and logins of members since they joined. Users listed in
+// AUDIT_ADMINS read the whole log. organization_id narrows it down to one
+// organization; action, outcome and actor_id filter the entries.
+func GetAuditLog(db *gorm.DB) gin.HandlerFunc {
+	admins := audit.AdminsFromEnv()
+
+	return func(c *gin.Context) {
+		subject := subjectOf(db, c)
+		admin := isAuditAdmin(db, subject.UserID, admins)
+
+		query := db.Model(&models.AuditLog{})
+		if s := c.Query("organization_id"); s != "" {
+			organizationID, err := strconv.Atoi(s)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid organization ID"})
+				return
+			}
+			if !admin && subject.Role(uint(organizationID)) != models.RoleOwner {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Only organization owners can read the audit log"})
+				return
+			}
+			query = organizationAudit(query, []uint{uint(organizationID)})
+		} else if !admin {
+			query = userAudit(query, subject)
+		}
+
+		lq, err := parseListQuery(c, auditSortColumns, "-date", "created_at")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		for _, column := range []string{"action", "outcome"} {
+			if value := c.Query(column); value != "" {
+				query = query.Where(column+" = ?", value)
+			}
+		}
+		if s := c.Query("actor_id"); s != "" {
+			actorID, err := strconv.Atoi(s)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid actor ID"})
+				return
+			}
+			query = query.Where("actor_id = ?", actorID)
+		}
+		query = lq.filter(query)
+
+		var total int
+		if err := query.Count(&total).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		paged, err := lq.page(query)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var entries []models.AuditLog
+		if err := paged.Find(&entries).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		next := ""
+		if len(entries) > lq.limit {
+			entries = entries[:lq.limit]
+			last := entries[len(entries)-1]
+			next = lq.nextCursor(last.CreatedAt, last.ID)
+		}
+
+		lq.respond(c, entries, total, next)
+	}
+}
+
+// memberEvents matches the signups and logins of the members of some
+// organizations, from the time they joined
+const memberEvents = "(resource_type = ? AND EXISTS (SELECT 1 FROM memberships m " +
+	"WHERE m.user_id = audit_logs.actor_id AND m.organization_id IN (?) " +
+	"AND m.deleted_at IS NULL AND m.created_at <= audit_logs.created_at))"
+
+// organizationAudit limits the log to the events of the organizations
+func organizationAudit(query *gorm.DB, organizations []uint) *gorm.DB {
+	return query.Where("organization_id IN (?) OR "+memberEvents, organizations, audit.ResourceUser, organizations)
+}
+
+// userAudit limits the log to the events of the subject, of their private
+// areas and of the organizations they own
+func userAudit(query *gorm.DB, subject authz.Subject) *gorm.DB {
+	where := "actor_id = ? OR (resource_type = ? AND organization_id IS NULL AND " +
+		"resource_id IN (SELECT id FROM areas WHERE user_id = ?))"
+	args := []interface{}{subject.UserID, audit.ResourceArea, subject.UserID}
+
+	var owned []uint
+	for organizationID, role := range subject.Roles {
+		if role == models.RoleOwner {
+			owned = append(owned, organizationID)
+		}
+	}
+	if len(owned) > 0 {
+		where += " OR organization_id IN (?) OR " + memberEvents
+		args = append(args, owned, audit.ResourceUser, owned)
+	}
+
+	return query.Where(where, args...)
+}
+
+func isAuditAdmin(db *gorm.DB, userID uint, admins map[string]bool) bool {
+	if len(admins) == 0 {
+		return false
+	}
+	var user models.User
+	if err := db.Select("username").Where("id = ?", userID).First(&user).Error; err != nil {
+		return false
+	}
+	return admins[user.Username]
+}
+
+// auditRequest records an event caused by the current request, attributed
+// to the authenticated user unless the entry names its actor
+func auditRequest(db *gorm.DB, c *gin.Context, entry models.AuditLog) {
+	if entry.ActorID == nil {
+		if userID := c.GetUint("userID"); userID != 0 {
+			entry.ActorID = &userID
+		}
+	}
+	entry.IP = c.ClientIP()
+	audit.Record(db, entry)
+}
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"deforestation/audit"
+	"deforestation/authz"
+	"deforestation/models"
+	"deforestation/testdb"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+func TestAuditScope(t *testing.T) {
+	db := testdb.Open(t)
+	joined := time.Now().Add(-24 * time.Hour)
+
+	create := func(value interface{}) {
+		t.Helper()
+		if err := db.Create(value).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	owner := models.User{Username: "owner", Password: "x"}
+	member := models.User{Username: "member", Password: "x"}
+	stranger := models.User{Username: "stranger", Password: "x"}
+	for _, user := range []*models.User{&owner, &member, &stranger} {
+		create(user)
+	}
+	org := models.Organization{Name: "Reserve"}
+	other := models.Organization{Name: "Other"}
+	create(&org)
+	create(&other)
+	founded := gorm.Model{CreatedAt: joined.Add(-48 * time.Hour)}
+	create(&models.Membership{Model: founded, OrganizationID: org.ID, UserID: owner.ID, Role: models.RoleOwner})
+	create(&models.Membership{Model: gorm.Model{CreatedAt: joined}, OrganizationID: org.ID, UserID: member.ID, Role: models.RoleEditor})
+	create(&models.Membership{Model: founded, OrganizationID: other.ID, UserID: stranger.ID, Role: models.RoleOwner})
+
+	orgArea := models.Area{AreaName: "shared", UserID: member.ID, OrganizationID: &org.ID}
+	privateArea := models.Area{AreaName: "private", UserID: stranger.ID}
+	create(&orgArea)
+	create(&privateArea)
+
+	// Events, named for the assertions below
+	events := map[string]models.AuditLog{
+		"member login before joining": {CreatedAt: joined.Add(-time.Hour), ActorID: &member.ID,
+			Action: audit.ActionLogin, ResourceType: audit.ResourceUser, ResourceID: &member.ID},
+		"member login after joining": {CreatedAt: joined.Add(time.Hour), ActorID: &member.ID,
+			Action: audit.ActionLogin, ResourceType: audit.ResourceUser, ResourceID: &member.ID},
+		"login to an unknown account": {CreatedAt: joined, Username: "nobody",
+			Action: audit.ActionLogin, ResourceType: audit.ResourceUser, Outcome: models.AuditFailed},
+		"shared area created": {CreatedAt: joined.Add(2 * time.Hour), ActorID: &member.ID,
+			Action: audit.ActionAreaCreate, ResourceType: audit.ResourceArea, ResourceID: &orgArea.ID, OrganizationID: &org.ID},
+		"scheduled run of the shared area": {CreatedAt: joined.Add(3 * time.Hour),
+			Action: audit.ActionScheduledRun, ResourceType: audit.ResourceArea, ResourceID: &orgArea.ID, OrganizationID: &org.ID},
+		"scheduled run of the private area": {CreatedAt: joined.Add(3 * time.Hour),
+			Action: audit.ActionScheduledRun, ResourceType: audit.ResourceArea, ResourceID: &privateArea.ID},
+		"owner login": {CreatedAt: joined, ActorID: &owner.ID,
+			Action: audit.ActionLogin, ResourceType: audit.ResourceUser, ResourceID: &owner.ID},
+		"stranger login": {CreatedAt: joined.Add(time.Hour), ActorID: &stranger.ID,
+			Action: audit.ActionLogin, ResourceType: audit.ResourceUser, ResourceID: &stranger.ID},
+	}
+	names := map[uint]string{}
+	for name, entry := range events {
+		if entry.Outcome == "" {
+			entry.Outcome = models.AuditSucceeded
+		}
+		create(&entry)
+		names[entry.ID] = name
+	}
+
+	visible := func(query *gorm.DB) []string {
+		t.Helper()
+		var ids []uint
+		if err := query.Pluck("id", &ids).Error; err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, id := range ids {
+			got = append(got, names[id])
+		}
+		sort.Strings(got)
+		return got
+	}
+	subject := func(user models.User) authz.Subject {
+		t.Helper()
+		subject, err := authz.SubjectFor(db, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return subject
+	}
+
+	tests := []struct {
+		name  string
+		query *gorm.DB
+		want  []string
+	}{
+		{"owner", userAudit(db.Model(&models.AuditLog{}), subject(owner)), []string{
+			"member login after joining",
+			"owner login",
+			"scheduled run of the shared area",
+			"shared area created",
+		}},
+		{"member", userAudit(db.Model(&models.AuditLog{}), subject(member)), []string{
+			"member login after joining",
+			"member login before joining",
+			"shared area created",
+		}},
+		{"creator of a private area", userAudit(db.Model(&models.AuditLog{}), subject(stranger)), []string{
+			"scheduled run of the private area",
+			"stranger login",
+		}},
+		{"one organization", organizationAudit(db.Model(&models.AuditLog{}), []uint{org.ID}), []string{
+			"member login after joining",
+			"owner login",
+			"scheduled run of the shared area",
+			"shared area created",
+		}},
+		{"another organization", organizationAudit(db.Model(&models.AuditLog{}), []uint{other.ID}), []string{
+			"stranger login",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := visible(tt.query); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("visible events = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("admins", func(t *testing.T) {
+		admins := map[string]bool{"stranger": true}
+		if !isAuditAdmin(db, stranger.ID, admins) {
+			t.Error("stranger is not an admin")
+		}
+		if isAuditAdmin(db, owner.ID, admins) || isAuditAdmin(db, stranger.ID, nil) {
+			t.Error("admin without being listed")
+		}
+	})
+}
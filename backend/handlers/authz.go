@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"deforestation/authz"
+	"deforestation/models"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// subjectOf returns the authenticated user of the request along with their
+// organization roles, which are loaded once per request
+func subjectOf(db *gorm.DB, c *gin.Context) authz.Subject {
+	if subject, ok := c.Get("subject"); ok {
+		return subject.(authz.Subject)
+	}
+
+	subject, err := authz.SubjectFor(db, c.GetUint("userID"))
+	if err != nil {
+		// Without its roles the user can still reach their own resources
+		log.Printf("Error loading roles of user %d: %v", subject.UserID, err)
+	}
+	c.Set("subject", subject)
+	return subject
+}
+
+// paramID parses the :id route parameter, answering 400 when it is not a
+// valid ID. name is used in the error message, e.g. "area".
+func paramID(c *gin.Context, name string) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil || id == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + name + " ID"})
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// authorized answers with the status matching an authz lookup error and
+// reports whether the request may go on
+func authorized(c *gin.Context, err error, name string) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, authz.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": strings.ToUpper(name[:1]) + name[1:] + " not found"})
+	case errors.Is(err, authz.ErrForbidden):
+		c.JSON(http.StatusForbidden, gin.H{"error": "You do not have access to this " + name})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+	return false
+}
+
+// load fetches the record named by the :id route parameter into out and
+// checks that the user may perform action on it
+func load(db *gorm.DB, c *gin.Context, action authz.Action, out interface{}, name string) bool {
+	id, ok := paramID(c, name)
+	if !ok {
+		return false
+	}
+	return authorized(c, authz.Load(db, subjectOf(db, c), action, out, id), name)
+}
+
+func loadArea(db *gorm.DB, c *gin.Context, action authz.Action) (models.Area, bool) {
+	var area models.Area
+	ok := load(db, c, action, &area, "area")
+	return area, ok
+}
+
+func loadHistory(db *gorm.DB, c *gin.Context, action authz.Action) (models.History, models.Area, bool) {
+	id, ok := paramID(c, "history")
+	if !ok {
+		return models.History{}, models.Area{}, false
+	}
+	history, area, err := authz.LoadHistory(db, subjectOf(db, c), action, id)
+	return history, area, authorized(c, err, "history")
+}
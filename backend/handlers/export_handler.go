@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"deforestation/authz"
+	"deforestation/export"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// ExportAreaHistories streams the history of one area as CSV or Parquet
+func ExportAreaHistories(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		area, ok := loadArea(db, c, authz.ActionRead)
+		if !ok {
+			return
+		}
+
+		streamExport(db, c, &area.ID, fmt.Sprintf("area_%d_history", area.ID))
+	}
+}
+
+// ExportHistories streams the history of all areas of the current user as
+// CSV or Parquet
+func ExportHistories(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		streamExport(db, c, nil, "history")
+	}
+}
+
+func streamExport(db *gorm.DB, c *gin.Context, areaID *uint, filename string) {
+	format := c.DefaultQuery("format", "csv")
+	writer, err := export.NewWriter(format, c.Writer)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	contentType, extension := export.ContentType(format)
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.%s\"", filename, extension))
+	c.Status(http.StatusOK)
+
+	// The status line is already sent, so failures can only be logged
+	if err := export.Histories(db, c.GetUint("userID"), areaID, writer); err != nil {
+		log.Printf("Error exporting histories: %v", err)
+	}
+}
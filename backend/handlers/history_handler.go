@@ -1,86 +1,89 @@
 package handlers
 
 import (
+	"deforestation/authz"
 	"deforestation/database"
+	"deforestation/dto"
 	"deforestation/models"
 	"net/http"
-	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
 )
 
-// GetAllHistories returns all history items
+// GetAllHistories returns the history items of all areas of the current user
 func GetAllHistories(c *gin.Context) {
 	db := database.GetDB()
-
-	var histories []models.History
-	if err := db.Find(&histories).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	c.JSON(http.StatusOK, gin.H{"data": histories})
+	listHistories(c, authz.Histories(db, subjectOf(db, c)))
 }
 
 // GetHistoryByID returns a single history item by ID
 func GetHistoryByID(c *gin.Context) {
 	db := database.GetDB()
-	historyID := c.Param("id")
 
-	var history models.History
-	if err := db.First(&history, historyID).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "History not found"})
+	history, _, ok := loadHistory(db, c, authz.ActionRead)
+	if !ok {
 		return
 	}
 
-	var area models.Area
-	if err := db.First(&area, history.AreaID).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Area not found"})
-		return
-	}
+	c.JSON(http.StatusOK, dto.NewHistory(history))
+}
+
+// GetHistoriesByAreaID returns the history items of one area
+func GetHistoriesByAreaID(c *gin.Context) {
+	db := database.GetDB()
 
-	userID := c.GetUint("userID")
-	if userID != area.UserID {
-		c.JSON(http.StatusForbidden, gin.H{"error": "You do not have access to this entry"})
+	area, ok := loadArea(db, c, authz.ActionRead)
+	if !ok {
 		return
 	}
 
-	// Serve the image file
-	c.JSON(http.StatusOK, history)
+	listHistories(c, db.Model(&models.History{}).Where("area_id = ?", area.ID))
 }
 
-// GetAllHistories returns all history items
-func GetHistoriesByAreaID(c *gin.Context) {
-	db := database.GetDB()
-	idStr := c.Param("id")
-	id, err := strconv.Atoi(idStr)
+var historySortColumns = map[string]string{
+	"date":            "date",
+	"deforested_area": "deforested_area",
+}
+
+// listHistories writes one page of the histories matched by query
+func listHistories(c *gin.Context, query *gorm.DB) {
+	lq, err := parseListQuery(c, historySortColumns, "date", "date")
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid area ID"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	userID := c.GetUint("userID")
-	var area models.Area
-	if err := db.Where("id = ?", id).First(&area).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Area not found"})
+	query = lq.filter(query)
+
+	var total int
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	if userID != area.UserID {
-		c.JSON(http.StatusForbidden, gin.H{"error": "You do not have access to this entry"})
+	paged, err := lq.page(query)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
 	var histories []models.History
-	if err := db.Where("area_id = ?", id).Find(&histories).Error; err != nil {
-		if gorm.IsRecordNotFoundError(err) {
-			c.JSON(http.StatusNotFound, gin.H{"error": "No histories found for this area"})
+	if err := paged.Find(&histories).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	next := ""
+	if len(histories) > lq.limit {
+		histories = histories[:lq.limit]
+		last := histories[len(histories)-1]
+		if lq.sortColumn == "date" {
+			next = lq.nextCursor(last.Date, last.ID)
 		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			next = lq.nextCursor(last.DeforestedArea, last.ID)
 		}
-		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"data": histories})
+	lq.respond(c, dto.NewHistories(histories), total, next)
 }
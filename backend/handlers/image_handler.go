@@ -1,33 +1,214 @@
 package handlers
 
 import (
+	"crypto/sha256"
+	"deforestation/auth"
+	"deforestation/authz"
+	"deforestation/renditions"
+	"deforestation/storage"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
 	"net/http"
-	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
 )
 
-func GetImageByPath(db *gorm.DB) gin.HandlerFunc {
+const defaultImageURLTTL = 15 * time.Minute
+
+// GetImageByPath serves a stored image by its object key. The key must
+// belong to a capture of an area owned by the user, unless the request
+// carries a valid signature minted by GetImageURL. With any of the
+// w, h or format query parameters a resized rendition is served from the
+// rendition cache instead. Responses carry ETag and Last-Modified headers and
+// honour conditional requests.
+func GetImageByPath(db *gorm.DB, cache *renditions.Service) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		path := c.Param("path")
+		key := c.Param("path")
 
 		// Validate the path parameter
-		if path == "" {
+		if key == "" {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Image path is required"})
 			return
 		}
+		if !storage.ValidKey(key) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image path"})
+			return
+		}
 
-		// Construct the full file path
-		filePath := "/app/images/" + path
+		if !c.GetBool("signedImage") && !authorizeImage(db, c, key) {
+			return
+		}
 
-		// Check if the file exists
-		if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		store := storage.GetStore()
+		info, err := store.Stat(c.Request.Context(), key)
+		if errors.Is(err, storage.ErrNotFound) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
 			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		width, height, format := c.Query("w"), c.Query("h"), c.Query("format")
+		if width == "" && height == "" && format == "" {
+			etag := objectETag(info)
+			if notModified(c.Request, etag, info.ModTime) {
+				writeValidators(c, etag, info.ModTime)
+				c.Status(http.StatusNotModified)
+				return
+			}
+
+			r, info, err := store.Get(c.Request.Context(), key)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			defer r.Close()
+
+			contentType := mime.TypeByExtension(path.Ext(key))
+			if contentType == "" {
+				contentType = "application/octet-stream"
+			}
+			serveImage(c, r, info.Size, info.ModTime, etag, contentType)
+			return
 		}
 
-		// Serve the file
-		c.File(filePath)
+		opts := renditions.Options{Format: format}
+		if opts.Format == "" {
+			opts.Format = "jpeg"
+		}
+		if width != "" {
+			if opts.Width, err = strconv.Atoi(width); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid width"})
+				return
+			}
+		}
+		if height != "" {
+			if opts.Height, err = strconv.Atoi(height); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid height"})
+				return
+			}
+		}
+		if err := opts.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		etag := `"` + renditions.Key(info, opts) + `"`
+		if notModified(c.Request, etag, info.ModTime) {
+			writeValidators(c, etag, info.ModTime)
+			c.Status(http.StatusNotModified)
+			return
+		}
+
+		f, err := cache.Open(c.Request.Context(), store, info, opts)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer f.Close()
+
+		stat, err := f.Stat()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		serveImage(c, f, stat.Size(), info.ModTime, etag, opts.ContentType())
 	}
 }
+
+// authorizeImage resolves key to the capture referencing it and checks that
+// the area of that capture belongs to the user. Keys that are not referenced
+// by any capture are reported as missing.
+func authorizeImage(db *gorm.DB, c *gin.Context, key string) bool {
+	_, _, err := authz.LoadHistoryByImage(db, subjectOf(db, c), authz.ActionRead, key)
+	return authorized(c, err, "image")
+}
+
+// GetImageURL mints a short-lived signed URL for the original or masked
+// image of a capture, for use in places that cannot send an Authorization
+// header. ttl is given in seconds and capped at one hour.
+func GetImageURL(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		history, _, ok := loadHistory(db, c, authz.ActionRead)
+		if !ok {
+			return
+		}
+
+		var key string
+		switch c.DefaultQuery("layer", "original") {
+		case "original":
+			key = history.ImagePath
+		case "masked":
+			key = history.MaskedImagePath
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid layer"})
+			return
+		}
+		if key == "" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Image no longer available"})
+			return
+		}
+
+		ttl := defaultImageURLTTL
+		if value := c.Query("ttl"); value != "" {
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ttl"})
+				return
+			}
+			ttl = time.Duration(seconds) * time.Second
+			if ttl > auth.MaxImageURLTTL {
+				ttl = auth.MaxImageURLTTL
+			}
+		}
+
+		url, expires := auth.SignImageURL(key, ttl)
+		c.JSON(http.StatusOK, gin.H{"data": gin.H{"url": url, "expires_at": expires}})
+	}
+}
+
+// serveImage writes the image with validators derived from the source image
+func serveImage(c *gin.Context, r io.Reader, size int64, modTime time.Time, etag, contentType string) {
+	writeValidators(c, etag, modTime)
+	c.DataFromReader(http.StatusOK, size, contentType, r, nil)
+}
+
+func writeValidators(c *gin.Context, etag string, modTime time.Time) {
+	c.Header("ETag", etag)
+	c.Header("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	c.Header("Cache-Control", "private, max-age=86400")
+}
+
+// notModified evaluates If-None-Match, falling back to If-Modified-Since
+// when no entity tags were sent
+func notModified(r *http.Request, etag string, modTime time.Time) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == etag || candidate == "*" {
+				return true
+			}
+		}
+		return false
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !modTime.Truncate(time.Second).After(since)
+}
+
+func objectETag(info storage.ObjectInfo) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d", info.Key, info.ModTime.UnixNano(), info.Size)))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
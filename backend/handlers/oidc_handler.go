@@ -0,0 +1,243 @@
+package handlers
+
+import (
+	"deforestation/audit"
+	"deforestation/models"
+	"deforestation/oidc"
+	"deforestation/sessions"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	oidcStateCookie = "oidc_state"
+	oidcLoginTTL    = 10 * time.Minute
+)
+
+// OIDCLogin starts a single sign-on login by redirecting to the identity
+// provider. The state is also set in a cookie so the callback only completes
+// logins started by the same browser.
+func OIDCLogin(db *gorm.DB, provider *oidc.Provider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req, err := oidc.NewAuthRequest()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
+
+		redirect, err := provider.AuthCodeURL(c.Request.Context(), req)
+		if err != nil {
+			log.Printf("Error starting OIDC login: %v", err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Identity provider unavailable"})
+			return
+		}
+
+		// Attempts that were never completed are dropped along the way
+		db.Unscoped().Where("expires_at < ?", time.Now()).Delete(&models.OIDCLogin{})
+
+		login := models.OIDCLogin{
+			State:     req.State,
+			Nonce:     req.Nonce,
+			Verifier:  req.Verifier,
+			ExpiresAt: time.Now().Add(oidcLoginTTL),
+		}
+		if err := db.Create(&login).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		setStateCookie(c, provider, req.State, int(oidcLoginTTL.Seconds()))
+		c.Redirect(http.StatusFound, redirect)
+	}
+}
+
+// OIDCCallback completes a single sign-on login: it redeems the code,
+// verifies the ID token, links or provisions the user and starts a session
+func OIDCCallback(db *gorm.DB, provider *oidc.Provider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if errCode := c.Query("error"); errCode != "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Single sign-on failed: " + errCode})
+			return
+		}
+
+		state := c.Query("state")
+		cookie, err := c.Cookie(oidcStateCookie)
+		if state == "" || err != nil || cookie != state {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid login state"})
+			return
+		}
+		setStateCookie(c, provider, "", -1)
+
+		var login models.OIDCLogin
+		if err := db.Where("state = ?", state).First(&login).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid login state"})
+			return
+		}
+		// Every attempt is single use
+		db.Unscoped().Delete(&login)
+		if time.Now().After(login.ExpiresAt) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Login attempt expired"})
+			return
+		}
+
+		identity, err := provider.Exchange(c.Request.Context(), c.Query("code"), oidc.AuthRequest{
+			State:    login.State,
+			Nonce:    login.Nonce,
+			Verifier: login.Verifier,
+		})
+		if err != nil {
+			log.Printf("Error completing OIDC login: %v", err)
+			auditRequest(db, c, models.AuditLog{
+				Action:       audit.ActionLogin,
+				ResourceType: audit.ResourceUser,
+				Outcome:      models.AuditFailed,
+				Detail:       "single sign-on",
+			})
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Single sign-on failed"})
+			return
+		}
+
+		user, err := oidcUser(db, provider.Config, identity)
+		if errors.Is(err, errAmbiguousEmail) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Several accounts use this email address, sign in with your password instead"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		auditRequest(db, c, models.AuditLog{
+			ActorID:      &user.ID,
+			Username:     user.Username,
+			Action:       audit.ActionLogin,
+			ResourceType: audit.ResourceUser,
+			ResourceID:   &user.ID,
+			Outcome:      models.AuditSucceeded,
+			Detail:       "single sign-on",
+		})
+
+		tokens, err := sessions.Create(db, user, c.Request.UserAgent(), c.ClientIP())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
+
+		if provider.Config.PostLoginURL == "" {
+			c.JSON(http.StatusOK, tokens)
+			return
+		}
+
+		// The fragment keeps the tokens out of server logs and referrers
+		fragment := url.Values{
+			"token":         {tokens.AccessToken},
+			"refresh_token": {tokens.RefreshToken},
+			"expires_in":    {fmt.Sprint(tokens.ExpiresIn)},
+		}
+		c.Redirect(http.StatusFound, provider.Config.PostLoginURL+"#"+fragment.Encode())
+	}
+}
+
+func setStateCookie(c *gin.Context, provider *oidc.Provider, value string, maxAge int) {
+	secure := strings.HasPrefix(provider.Config.RedirectURL, "https://")
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, value, maxAge, "/auth/oidc", "", secure, true)
+}
+
+// errAmbiguousEmail is returned when several local users verified the email
+// address of a provider account, so there is no telling which to link
+var errAmbiguousEmail = errors.New("email address matches several users")
+
+// oidcUser returns the user linked to the provider account. When enabled,
+// unknown accounts are linked to the local user who verified the same email
+// address, which the provider must have verified too. Other accounts are
+// provisioned as new users without a local password.
+func oidcUser(db *gorm.DB, cfg oidc.Config, identity *oidc.Identity) (models.User, error) {
+	var user models.User
+	err := db.Where("oidc_issuer = ? AND oidc_subject = ?", identity.Issuer, identity.Subject).First(&user).Error
+	if err == nil {
+		return user, nil
+	} else if !gorm.IsRecordNotFoundError(err) {
+		return user, err
+	}
+
+	issuer, subject := identity.Issuer, identity.Subject
+
+	if cfg.LinkByEmail && identity.EmailVerified && identity.Email != "" {
+		// Local addresses are only trusted once verified, otherwise anyone
+		// could claim the address of a future single sign-on user
+		var matches []models.User
+		if err := db.Where("LOWER(email) = LOWER(?) AND oidc_subject IS NULL AND email_verified_at IS NOT NULL",
+			identity.Email).Limit(2).Find(&matches).Error; err != nil {
+			return user, err
+		}
+		if len(matches) > 1 {
+			return user, errAmbiguousEmail
+		}
+		if len(matches) == 1 {
+			user = matches[0]
+			user.OIDCIssuer, user.OIDCSubject = &issuer, &subject
+			if err := db.Model(&user).Updates(map[string]interface{}{
+				"oidc_issuer":  issuer,
+				"oidc_subject": subject,
+			}).Error; err != nil {
+				return user, err
+			}
+			return user, nil
+		}
+	}
+
+	username, err := availableUsername(db, identity)
+	if err != nil {
+		return user, err
+	}
+
+	user = models.User{
+		Username:    username,
+		OIDCIssuer:  &issuer,
+		OIDCSubject: &subject,
+	}
+	if identity.EmailVerified {
+		now := time.Now()
+		user.Email, user.EmailVerifiedAt = identity.Email, &now
+	}
+	if err := db.Create(&user).Error; err != nil {
+		return user, err
+	}
+	return user, nil
+}
+
+var usernameUnsafe = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// availableUsername derives a free username from the provider account
+func availableUsername(db *gorm.DB, identity *oidc.Identity) (string, error) {
+	base := identity.PreferredUsername
+	if base == "" {
+		base, _, _ = strings.Cut(identity.Email, "@")
+	}
+	base = strings.Trim(usernameUnsafe.ReplaceAllString(base, "-"), "-")
+	if base == "" {
+		base = "user"
+	}
+
+	candidate := base
+	for i := 2; i < 100; i++ {
+		var count int
+		if err := db.Unscoped().Model(&models.User{}).Where("username = ?", candidate).Count(&count).Error; err != nil {
+			return "", err
+		}
+		if count == 0 {
+			return candidate, nil
+		}
+		candidate = fmt.Sprintf("%s-%d", base, i)
+	}
+	return "", fmt.Errorf("no free username for %q", base)
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"deforestation/models"
+	"deforestation/oidc"
+	"deforestation/testdb"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestOIDCUser(t *testing.T) {
+	db := testdb.Open(t)
+	cfg := oidc.Config{LinkByEmail: true}
+	issuer := "https://idp.example.com"
+
+	verified := time.Now()
+	linked := models.User{Username: "linked", Email: "linked@example.com", OIDCIssuer: &issuer, OIDCSubject: strPtr("subject-1")}
+	local := models.User{Username: "local", Email: "Local@example.com", EmailVerifiedAt: &verified}
+	unverified := models.User{Username: "unverified", Email: "unverified@example.com"}
+	for _, user := range []*models.User{&linked, &local, &unverified} {
+		if err := db.Create(user).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("relinks by subject", func(t *testing.T) {
+		user, err := oidcUser(db, cfg, &oidc.Identity{Issuer: issuer, Subject: "subject-1", Email: "changed@example.com", EmailVerified: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.ID != linked.ID {
+			t.Errorf("user = %d, want %d", user.ID, linked.ID)
+		}
+	})
+
+	t.Run("links a verified local email", func(t *testing.T) {
+		user, err := oidcUser(db, cfg, &oidc.Identity{Issuer: issuer, Subject: "subject-2", Email: "local@example.com", EmailVerified: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.ID != local.ID {
+			t.Fatalf("user = %d, want %d", user.ID, local.ID)
+		}
+
+		again, err := oidcUser(db, cfg, &oidc.Identity{Issuer: issuer, Subject: "subject-2"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again.ID != local.ID {
+			t.Errorf("second login user = %d, want %d", again.ID, local.ID)
+		}
+	})
+
+	t.Run("does not link an unverified local email", func(t *testing.T) {
+		user, err := oidcUser(db, cfg, &oidc.Identity{Issuer: issuer, Subject: "subject-3", Email: "unverified@example.com", EmailVerified: true, PreferredUsername: "unverified"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.ID == unverified.ID {
+			t.Fatal("linked the provider account to an unverified address")
+		}
+		if user.Username != "unverified-2" {
+			t.Errorf("username = %q, want unverified-2", user.Username)
+		}
+	})
+
+	t.Run("does not link an email the provider did not verify", func(t *testing.T) {
+		other := models.User{Username: "other", Email: "other@example.com", EmailVerifiedAt: &verified}
+		if err := db.Create(&other).Error; err != nil {
+			t.Fatal(err)
+		}
+		user, err := oidcUser(db, cfg, &oidc.Identity{Issuer: issuer, Subject: "subject-4", Email: "other@example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.ID == other.ID {
+			t.Error("linked the provider account to an address it did not verify")
+		}
+	})
+
+	t.Run("rejects an ambiguous email", func(t *testing.T) {
+		for _, name := range []string{"twin-1", "twin-2"} {
+			twin := models.User{Username: name, Email: "twin@example.com", EmailVerifiedAt: &verified}
+			if err := db.Create(&twin).Error; err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err := oidcUser(db, cfg, &oidc.Identity{Issuer: issuer, Subject: "subject-5", Email: "twin@example.com", EmailVerified: true})
+		if !errors.Is(err, errAmbiguousEmail) {
+			t.Errorf("err = %v, want errAmbiguousEmail", err)
+		}
+	})
+}
+
+func strPtr(s string) *string {
+	return &s
+}
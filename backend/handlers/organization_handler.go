@@ -0,0 +1,302 @@
+package handlers
+
+import (
+	"deforestation/authz"
+	"deforestation/models"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+type CreateOrganizationInput struct {
+	Name string `json:"name" binding:"required"`
+}
+
+type AddMemberInput struct {
+	Username string `json:"username" binding:"required"`
+	Role     string `json:"role" binding:"required"`
+}
+
+type UpdateMemberInput struct {
+	Role string `json:"role" binding:"required"`
+}
+
+// organizationView is an organization along with the role of the current
+// user in it
+type organizationView struct {
+	models.Organization
+	Role string `json:"role"`
+}
+
+type memberView struct {
+	UserID   uint   `json:"user_id"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+// CreateOrganization creates an organization owned by the current user
+func CreateOrganization(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var input CreateOrganizationInput
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		organization := models.Organization{Name: input.Name}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&organization).Error; err != nil {
+				return err
+			}
+			membership := models.Membership{
+				OrganizationID: organization.ID,
+				UserID:         c.GetUint("userID"),
+				Role:           models.RoleOwner,
+			}
+			return tx.Create(&membership).Error
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{"data": organizationView{Organization: organization, Role: models.RoleOwner}})
+	}
+}
+
+// GetOrganizations returns the organizations the current user is a member of
+func GetOrganizations(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		subject := subjectOf(db, c)
+
+		var organizations []models.Organization
+		if err := authz.Organizations(db, subject).Order("name").Find(&organizations).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		views := make([]organizationView, 0, len(organizations))
+		for _, organization := range organizations {
+			views = append(views, organizationView{Organization: organization, Role: subject.Role(organization.ID)})
+		}
+
+		c.JSON(http.StatusOK, gin.H{"data": views})
+	}
+}
+
+// GetOrganization returns an organization and its members
+func GetOrganization(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		organization, ok := loadOrganization(db, c, authz.ActionRead)
+		if !ok {
+			return
+		}
+
+		members := []memberView{}
+		if err := db.Table("memberships").
+			Select("memberships.user_id, users.username, memberships.role").
+			Joins("JOIN users ON users.id = memberships.user_id AND users.deleted_at IS NULL").
+			Where("memberships.organization_id = ? AND memberships.deleted_at IS NULL", organization.ID).
+			Order("users.username").Scan(&members).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"data": gin.H{
+			"organization": organizationView{Organization: organization, Role: subjectOf(db, c).Role(organization.ID)},
+			"members":      members,
+		}})
+	}
+}
+
+// DeleteOrganization deletes an organization. Its areas are not deleted but
+// become private areas of the owner deleting it, whoever created them: their
+// creators may have left the organization long ago.
+func DeleteOrganization(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		organization, ok := loadOrganization(db, c, authz.ActionDelete)
+		if !ok {
+			return
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&models.Area{}).Where("organization_id = ?", organization.ID).
+				Updates(map[string]interface{}{
+					"organization_id": nil,
+					"user_id":         c.GetUint("userID"),
+				}).Error; err != nil {
+				return err
+			}
+			if err := tx.Unscoped().Where("organization_id = ?", organization.ID).
+				Delete(&models.Membership{}).Error; err != nil {
+				return err
+			}
+			return tx.Delete(&organization).Error
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Organization deleted successfully"})
+	}
+}
+
+// AddMember adds an existing user to an organization
+func AddMember(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		organization, ok := loadOrganization(db, c, authz.ActionUpdate)
+		if !ok {
+			return
+		}
+
+		var input AddMemberInput
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !authz.ValidRole(input.Role) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
+			return
+		}
+
+		var user models.User
+		if err := db.Where("username = ?", input.Username).First(&user).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		var count int
+		if err := db.Model(&models.Membership{}).
+			Where("organization_id = ? AND user_id = ?", organization.ID, user.ID).
+			Count(&count).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if count > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "User is already a member"})
+			return
+		}
+
+		membership := models.Membership{OrganizationID: organization.ID, UserID: user.ID, Role: input.Role}
+		if err := db.Create(&membership).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{"data": memberView{UserID: user.ID, Username: user.Username, Role: membership.Role}})
+	}
+}
+
+// UpdateMember changes the role of a member
+func UpdateMember(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		organization, ok := loadOrganization(db, c, authz.ActionUpdate)
+		if !ok {
+			return
+		}
+
+		var input UpdateMemberInput
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !authz.ValidRole(input.Role) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
+			return
+		}
+
+		membership, ok := loadMembership(db, c, organization.ID)
+		if !ok {
+			return
+		}
+		if membership.Role == models.RoleOwner && input.Role != models.RoleOwner && !keepsOwner(db, c, membership) {
+			return
+		}
+
+		if err := db.Model(&membership).Update("role", input.Role).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"data": membership})
+	}
+}
+
+// RemoveMember removes a user from an organization. Owners may remove
+// anyone, other members may only leave.
+func RemoveMember(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		action := authz.ActionUpdate
+		if c.Param("user_id") == strconv.FormatUint(uint64(c.GetUint("userID")), 10) {
+			action = authz.ActionRead
+		}
+
+		organization, ok := loadOrganization(db, c, action)
+		if !ok {
+			return
+		}
+
+		membership, ok := loadMembership(db, c, organization.ID)
+		if !ok {
+			return
+		}
+		if membership.Role == models.RoleOwner && !keepsOwner(db, c, membership) {
+			return
+		}
+
+		if err := db.Unscoped().Delete(&membership).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Member removed successfully"})
+	}
+}
+
+func loadOrganization(db *gorm.DB, c *gin.Context, action authz.Action) (models.Organization, bool) {
+	var organization models.Organization
+	ok := load(db, c, action, &organization, "organization")
+	return organization, ok
+}
+
+func loadMembership(db *gorm.DB, c *gin.Context, organizationID uint) (models.Membership, bool) {
+	var membership models.Membership
+
+	userID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return membership, false
+	}
+
+	if err := db.Where("organization_id = ? AND user_id = ?", organizationID, userID).First(&membership).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Member not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return membership, false
+	}
+
+	return membership, true
+}
+
+// keepsOwner checks that an organization keeps at least one owner when
+// membership stops being one
+func keepsOwner(db *gorm.DB, c *gin.Context, membership models.Membership) bool {
+	var owners int
+	if err := db.Model(&models.Membership{}).
+		Where("organization_id = ? AND role = ?", membership.OrganizationID, models.RoleOwner).
+		Count(&owners).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+
+	if owners <= 1 {
+		c.JSON(http.StatusConflict, gin.H{"error": "An organization needs at least one owner"})
+		return false
+	}
+	return true
+}
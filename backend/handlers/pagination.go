@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// listQuery holds the pagination, filtering and sorting parameters shared by
+// list endpoints: limit, cursor, from, to, sort and fields
+type listQuery struct {
+	limit      int
+	sortKey    string
+	sortColumn string
+	desc       bool
+	from       *time.Time
+	to         *time.Time
+	toDay      bool
+	fields     []string
+	dateColumn string
+	cursor     *pageCursor
+}
+
+// pageCursor is the position after the last item of a page. It is handed to
+// clients base64 encoded.
+type pageCursor struct {
+	Sort  string          `json:"s"`
+	Value json.RawMessage `json:"v"`
+	ID    uint            `json:"id"`
+}
+
+// listEnvelope is the response body of list endpoints
+type listEnvelope struct {
+	Data interface{} `json:"data"`
+	Meta listMeta    `json:"meta"`
+}
+
+type listMeta struct {
+	Limit      int    `json:"limit"`
+	Total      int    `json:"total"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// parseListQuery reads the list parameters. sortColumns maps the accepted
+// sort keys to columns; dateColumn is the column filtered by from and to.
+func parseListQuery(c *gin.Context, sortColumns map[string]string, defaultSort, dateColumn string) (*listQuery, error) {
+	q := &listQuery{limit: defaultPageSize, dateColumn: dateColumn}
+
+	if s := c.Query("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit <= 0 || limit > maxPageSize {
+			return nil, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+		q.limit = limit
+	}
+
+	sort := c.DefaultQuery("sort", defaultSort)
+	q.sortKey = sort
+	q.desc = strings.HasPrefix(sort, "-")
+	column, ok := sortColumns[strings.TrimPrefix(sort, "-")]
+	if !ok {
+		return nil, fmt.Errorf("invalid sort %q", sort)
+	}
+	q.sortColumn = column
+
+	if s := c.Query("from"); s != "" {
+		from, _, err := parseDateParam(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid from date %q", s)
+		}
+		q.from = &from
+	}
+	if s := c.Query("to"); s != "" {
+		to, day, err := parseDateParam(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid to date %q", s)
+		}
+		q.to, q.toDay = &to, day
+	}
+
+	if s := c.Query("fields"); s != "" {
+		for _, field := range strings.Split(s, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				q.fields = append(q.fields, field)
+			}
+		}
+	}
+
+	if s := c.Query("cursor"); s != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cursor")
+		}
+		var cursor pageCursor
+		if err := json.Unmarshal(raw, &cursor); err != nil || cursor.Sort != q.sortKey {
+			return nil, fmt.Errorf("invalid cursor")
+		}
+		q.cursor = &cursor
+	}
+
+	return q, nil
+}
+
+// parseDateParam accepts YYYY-MM-DD or RFC 3339 timestamps. day reports
+// whether a plain date was given.
+func parseDateParam(s string) (t time.Time, day bool, err error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, true, nil
+	}
+	t, err = time.Parse(time.RFC3339, s)
+	return t, false, err
+}
+
+// filter applies the date range to the query. Both bounds are inclusive; a
+// plain to date includes the whole day.
+func (q *listQuery) filter(db *gorm.DB) *gorm.DB {
+	if q.from != nil {
+		db = db.Where(q.dateColumn+" >= ?", *q.from)
+	}
+	if q.to != nil {
+		if q.toDay {
+			db = db.Where(q.dateColumn+" < ?", q.to.AddDate(0, 0, 1))
+		} else {
+			db = db.Where(q.dateColumn+" <= ?", *q.to)
+		}
+	}
+	return db
+}
+
+// page applies the cursor, ordering and limit to an already filtered query.
+// One extra row is fetched to detect whether another page follows.
+func (q *listQuery) page(db *gorm.DB) (*gorm.DB, error) {
+	op, direction := ">", "asc"
+	if q.desc {
+		op, direction = "<", "desc"
+	}
+
+	if q.cursor != nil {
+		var value interface{}
+		if q.sortColumn == q.dateColumn {
+			var t time.Time
+			if err := json.Unmarshal(q.cursor.Value, &t); err != nil {
+				return nil, fmt.Errorf("invalid cursor")
+			}
+			value = t
+		} else {
+			var f float64
+			if err := json.Unmarshal(q.cursor.Value, &f); err != nil {
+				return nil, fmt.Errorf("invalid cursor")
+			}
+			value = f
+		}
+		db = db.Where(fmt.Sprintf("(%[1]s %[2]s ?) OR (%[1]s = ? AND id %[2]s ?)", q.sortColumn, op),
+			value, value, q.cursor.ID)
+	}
+
+	return db.Order(fmt.Sprintf("%s %s, id %s", q.sortColumn, direction, direction)).Limit(q.limit + 1), nil
+}
+
+// nextCursor encodes the position of the last item of a page
+func (q *listQuery) nextCursor(value interface{}, id uint) string {
+	raw, _ := json.Marshal(value)
+	encoded, _ := json.Marshal(pageCursor{Sort: q.sortKey, Value: raw, ID: id})
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// respond writes the page envelope, keeping only the selected fields of each
+// item. Field names are matched case insensitively and ignoring underscores,
+// so both "DeforestedArea" and "deforested_area" select the same field.
+func (q *listQuery) respond(c *gin.Context, items interface{}, total int, next string) {
+	data := items
+	if len(q.fields) > 0 {
+		selected, err := selectFields(items, q.fields)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		data = selected
+	}
+
+	c.JSON(http.StatusOK, listEnvelope{
+		Data: data,
+		Meta: listMeta{Limit: q.limit, Total: total, NextCursor: next},
+	})
+}
+
+func selectFields(items interface{}, fields []string) ([]map[string]interface{}, error) {
+	raw, err := json.Marshal(items)
+	if err != nil {
+		return nil, err
+	}
+	var all []map[string]interface{}
+	if err := json.Unmarshal(raw, &all); err != nil {
+		return nil, err
+	}
+
+	wanted := map[string]bool{}
+	for _, field := range fields {
+		wanted[normalizeField(field)] = true
+	}
+
+	selected := make([]map[string]interface{}, len(all))
+	for i, item := range all {
+		selected[i] = map[string]interface{}{}
+		for key, value := range item {
+			if wanted[normalizeField(key)] {
+				selected[i][key] = value
+			}
+		}
+	}
+	return selected, nil
+}
+
+func normalizeField(s string) string {
+	return strings.ToLower(strings.ReplaceAll(s, "_", ""))
+}
@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var testSortColumns = map[string]string{
+	"date":       "date",
+	"deforested": "deforested_area",
+}
+
+func listContext(query string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/histories?"+query, nil)
+	return c
+}
+
+func TestParseListQuery(t *testing.T) {
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	instant := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		query  string
+		want   listQuery
+		errors bool
+	}{
+		{"", listQuery{limit: defaultPageSize, sortKey: "-date", sortColumn: "date", desc: true}, false},
+		{"limit=10&sort=deforested", listQuery{limit: 10, sortKey: "deforested", sortColumn: "deforested_area"}, false},
+		{"limit=500&sort=-deforested", listQuery{limit: 500, sortKey: "-deforested", sortColumn: "deforested_area", desc: true}, false},
+		{"from=2024-03-01&to=2024-03-01", listQuery{limit: defaultPageSize, sortKey: "-date", sortColumn: "date", desc: true, from: &day, to: &day, toDay: true}, false},
+		{"to=2024-03-01T12:30:00Z", listQuery{limit: defaultPageSize, sortKey: "-date", sortColumn: "date", desc: true, to: &instant}, false},
+		{"fields=ID,+deforested_area,,date", listQuery{limit: defaultPageSize, sortKey: "-date", sortColumn: "date", desc: true, fields: []string{"ID", "deforested_area", "date"}}, false},
+		{"fields=,", listQuery{limit: defaultPageSize, sortKey: "-date", sortColumn: "date", desc: true}, false},
+		{"limit=0", listQuery{}, true},
+		{"limit=501", listQuery{}, true},
+		{"limit=ten", listQuery{}, true},
+		{"sort=name", listQuery{}, true},
+		{"sort=--date", listQuery{}, true},
+		{"from=yesterday", listQuery{}, true},
+		{"to=2024-13-01", listQuery{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got, err := parseListQuery(listContext(tt.query), testSortColumns, "-date", "date")
+			if tt.errors {
+				if err == nil {
+					t.Errorf("parseListQuery = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseListQuery: %v", err)
+			}
+			tt.want.dateColumn = "date"
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("parseListQuery = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListCursor(t *testing.T) {
+	last := time.Date(2024, 3, 1, 12, 30, 0, 123456000, time.UTC)
+
+	dated, err := parseListQuery(listContext("sort=date"), testSortColumns, "-date", "date")
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := dated.nextCursor(last, 42)
+
+	t.Run("round trip", func(t *testing.T) {
+		q, err := parseListQuery(listContext("sort=date&cursor="+next), testSortColumns, "-date", "date")
+		if err != nil {
+			t.Fatalf("parseListQuery: %v", err)
+		}
+		var value time.Time
+		if err := json.Unmarshal(q.cursor.Value, &value); err != nil {
+			t.Fatal(err)
+		}
+		if q.cursor.ID != 42 || !value.Equal(last) || q.cursor.Sort != "date" {
+			t.Errorf("cursor = %+v, value %v", q.cursor, value)
+		}
+	})
+
+	t.Run("numeric value", func(t *testing.T) {
+		q, err := parseListQuery(listContext("sort=-deforested"), testSortColumns, "-date", "date")
+		if err != nil {
+			t.Fatal(err)
+		}
+		q, err = parseListQuery(listContext("sort=-deforested&cursor="+q.nextCursor(12.5, 7)), testSortColumns, "-date", "date")
+		if err != nil {
+			t.Fatalf("parseListQuery: %v", err)
+		}
+		var value float64
+		if err := json.Unmarshal(q.cursor.Value, &value); err != nil || value != 12.5 || q.cursor.ID != 7 {
+			t.Errorf("cursor = %+v, value %v, %v", q.cursor, value, err)
+		}
+	})
+
+	invalid := map[string]string{
+		"other sort":     "sort=-date&cursor=" + next,
+		"default sort":   "cursor=" + next,
+		"not base64":     "sort=date&cursor=%24%24",
+		"padded base64":  "sort=date&cursor=" + base64.URLEncoding.EncodeToString([]byte(`{"s":"date","v":1,"id":1}`)),
+		"not json":       "sort=date&cursor=" + base64.RawURLEncoding.EncodeToString([]byte("date|1")),
+		"wrong id type":  "sort=date&cursor=" + base64.RawURLEncoding.EncodeToString([]byte(`{"s":"date","v":1,"id":"x"}`)),
+		"truncated json": "sort=date&cursor=" + next[:len(next)/2],
+	}
+	for name, query := range invalid {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseListQuery(listContext(query), testSortColumns, "-date", "date"); err == nil {
+				t.Error("parseListQuery accepted the cursor")
+			}
+		})
+	}
+}
+
+func TestSelectFields(t *testing.T) {
+	type item struct {
+		ID             uint
+		DeforestedArea float64 `json:"deforested_area"`
+		ImagePath      string  `json:"image_path"`
+		Date           string
+	}
+	items := []item{
+		{ID: 1, DeforestedArea: 2.5, ImagePath: "a.png", Date: "2024-03-01"},
+		{ID: 2, DeforestedArea: 3, ImagePath: "b.png", Date: "2024-03-08"},
+	}
+
+	tests := []struct {
+		name   string
+		fields []string
+		want   []map[string]interface{}
+	}{
+		{"exact names", []string{"ID", "deforested_area"}, []map[string]interface{}{
+			{"ID": 1.0, "deforested_area": 2.5},
+			{"ID": 2.0, "deforested_area": 3.0},
+		}},
+		{"case and underscores ignored", []string{"id", "DeforestedArea", "IMAGE_PATH"}, []map[string]interface{}{
+			{"ID": 1.0, "deforested_area": 2.5, "image_path": "a.png"},
+			{"ID": 2.0, "deforested_area": 3.0, "image_path": "b.png"},
+		}},
+		{"unknown fields", []string{"password"}, []map[string]interface{}{{}, {}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := selectFields(items, tt.fields)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("selectFields = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if got, err := selectFields([]item{}, []string{"ID"}); err != nil || len(got) != 0 {
+		t.Errorf("selectFields of no items = %v, %v", got, err)
+	}
+}
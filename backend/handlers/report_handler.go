@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"deforestation/reports"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// GetDigest returns the weekly digest of the current user as JSON, or as
+// HTML when format=html is given or the client prefers text/html
+func GetDigest(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		weekStart, err := reports.ParseWeek(c.Query("week"), time.Now())
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		digest, err := reports.BuildDigest(db, c.GetUint("userID"), weekStart)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		format := c.Query("format")
+		if format == "" && strings.Contains(c.GetHeader("Accept"), "text/html") {
+			format = "html"
+		}
+
+		if format == "html" {
+			html, err := digest.HTML()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(html))
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"data": digest})
+	}
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"context"
+	"deforestation/authz"
+	"deforestation/database"
+	"deforestation/storage"
+	"deforestation/utils"
+	"image"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+)
+
+const maxTileZoom = 20
+
+// GetHistoryTile serves the XYZ tile z/x/y of a history capture so it can be
+// overlaid on a web map. layer=masked selects the forest mask instead of the
+// original capture.
+func GetHistoryTile(c *gin.Context) {
+	db := database.GetDB()
+
+	z, errZ := strconv.Atoi(c.Param("z"))
+	x, errX := strconv.Atoi(c.Param("x"))
+	y, errY := strconv.Atoi(strings.TrimSuffix(c.Param("y"), ".png"))
+	if errZ != nil || errX != nil || errY != nil || z < 0 || z > maxTileZoom ||
+		x < 0 || y < 0 || x >= 1<<z || y >= 1<<z {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tile coordinates"})
+		return
+	}
+
+	history, area, ok := loadHistory(db, c, authz.ActionRead)
+	if !ok {
+		return
+	}
+
+	key := history.ImagePath
+	switch c.DefaultQuery("layer", "original") {
+	case "original":
+	case "masked":
+		key = history.MaskedImagePath
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid layer"})
+		return
+	}
+
+	capture, err := captures.load(c.Request.Context(), storage.GetStore(), key)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+
+	tile, ok := utils.RenderTile(capture, area, z, x, y)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tile is outside of the capture"})
+		return
+	}
+
+	// Captures never change once stored
+	c.Header("Cache-Control", "private, max-age=604800, immutable")
+	c.Header("Content-Type", "image/png")
+	if err := imaging.Encode(c.Writer, tile, imaging.PNG); err != nil {
+		c.Error(err)
+	}
+}
+
+// captureCache keeps the most recently used decoded captures in memory, as
+// map clients request many tiles of the same capture in a burst. The cache
+// holds at most maxPixels pixels; captures larger than that are not cached.
+type captureCache struct {
+	mu        sync.Mutex
+	entries   map[string]*cachedCapture
+	pixels    int
+	maxPixels int
+}
+
+type cachedCapture struct {
+	img     image.Image
+	modTime time.Time
+	used    time.Time
+}
+
+// Decoded captures take four bytes per pixel, so the cache holds about 256 MiB
+var captures = newCaptureCache(64 << 20)
+
+func newCaptureCache(maxPixels int) *captureCache {
+	return &captureCache{entries: map[string]*cachedCapture{}, maxPixels: maxPixels}
+}
+
+func pixels(img image.Image) int {
+	return img.Bounds().Dx() * img.Bounds().Dy()
+}
+
+func (cc *captureCache) load(ctx context.Context, store storage.BlobStore, key string) (image.Image, error) {
+	info, err := store.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	cc.mu.Lock()
+	entry, ok := cc.entries[key]
+	if ok && entry.modTime.Equal(info.ModTime) {
+		entry.used = time.Now()
+		cc.mu.Unlock()
+		return entry.img, nil
+	}
+	cc.mu.Unlock()
+
+	img, err := storage.DecodeImage(ctx, store, key)
+	if err != nil {
+		return nil, err
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.remove(key)
+	size := pixels(img)
+	if size > cc.maxPixels {
+		return img, nil
+	}
+	for cc.pixels+size > cc.maxPixels {
+		var oldest string
+		for key, e := range cc.entries {
+			if oldest == "" || e.used.Before(cc.entries[oldest].used) {
+				oldest = key
+			}
+		}
+		cc.remove(oldest)
+	}
+	cc.entries[key] = &cachedCapture{img: img, modTime: info.ModTime, used: time.Now()}
+	cc.pixels += size
+	return img, nil
+}
+
+func (cc *captureCache) remove(key string) {
+	if entry, ok := cc.entries[key]; ok {
+		cc.pixels -= pixels(entry.img)
+		delete(cc.entries, key)
+	}
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"deforestation/storage"
+	"image"
+	"image/png"
+	"os"
+	"testing"
+	"time"
+)
+
+func putPNG(t *testing.T, store storage.BlobStore, key string, w, h int) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, w, h))); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(context.Background(), key, &buf, int64(buf.Len()), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCaptureCacheBound(t *testing.T) {
+	store := storage.NewFileStore(t.TempDir())
+	putPNG(t, store, "a.png", 10, 10)
+	putPNG(t, store, "b.png", 10, 10)
+	putPNG(t, store, "c.png", 20, 10)
+	putPNG(t, store, "huge.png", 20, 20)
+
+	cache := newCaptureCache(300)
+	ctx := context.Background()
+	load := func(key string) image.Image {
+		t.Helper()
+		img, err := cache.load(ctx, store, key)
+		if err != nil {
+			t.Fatalf("load(%q): %v", key, err)
+		}
+		return img
+	}
+	cached := func() map[string]bool {
+		keys := map[string]bool{}
+		for key := range cache.entries {
+			keys[key] = true
+		}
+		return keys
+	}
+
+	a := load("a.png")
+	load("b.png")
+	if load("a.png") != a {
+		t.Error("second load of a.png decoded the capture again")
+	}
+
+	// c.png needs 200 pixels, so the least recently used b.png goes
+	load("c.png")
+	if got := cached(); len(got) != 2 || !got["a.png"] || !got["c.png"] {
+		t.Errorf("cached %v, want a.png and c.png", got)
+	}
+	if cache.pixels != 300 {
+		t.Errorf("cache holds %d pixels, want 300", cache.pixels)
+	}
+
+	// Captures over the budget are served without evicting anything
+	if img := load("huge.png"); img.Bounds().Dx() != 20 {
+		t.Errorf("huge.png decoded at %v", img.Bounds())
+	}
+	if got := cached(); len(got) != 2 || got["huge.png"] {
+		t.Errorf("cached %v after loading a capture over the budget", got)
+	}
+
+	// A replaced capture is decoded again and keeps the accounting straight
+	putPNG(t, store, "a.png", 5, 5)
+	path, _ := store.Path("a.png")
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if img := load("a.png"); img.Bounds().Dx() != 5 {
+		t.Errorf("replaced a.png decoded at %v", img.Bounds())
+	}
+	if cache.pixels != 225 {
+		t.Errorf("cache holds %d pixels, want 225", cache.pixels)
+	}
+
+	if _, err := cache.load(ctx, store, "missing.png"); err == nil {
+		t.Error("load of a missing capture succeeded")
+	}
+}
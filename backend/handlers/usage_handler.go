@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"deforestation/authz"
+	"deforestation/models"
+	"deforestation/quota"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// accountUsage is the consumption of a user's private areas, or of an
+// organization, against its limits
+type accountUsage struct {
+	OrganizationID *uint        `json:"organization_id"`
+	Name           string       `json:"name"`
+	Limits         quota.Limits `json:"limits"`
+	Usage          quota.Usage  `json:"usage"`
+}
+
+// GetUsage returns the usage of the current user's private areas followed
+// by the usage of each organization the user is a member of
+func GetUsage(db *gorm.DB) gin.HandlerFunc {
+	defaults := quota.DefaultsFromEnv()
+
+	return func(c *gin.Context) {
+		subject := subjectOf(db, c)
+
+		var user models.User
+		if err := db.First(&user, subject.UserID).Error; err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid user"})
+			return
+		}
+
+		var organizations []models.Organization
+		if err := authz.Organizations(db, subject).Order("name").Find(&organizations).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		accounts := []accountUsage{{Name: user.Username}}
+		for i := range organizations {
+			accounts = append(accounts, accountUsage{
+				OrganizationID: &organizations[i].ID,
+				Name:           organizations[i].Name,
+			})
+		}
+
+		now := time.Now()
+		for i := range accounts {
+			account := quota.Account{UserID: user.ID, OrganizationID: accounts[i].OrganizationID}
+
+			var err error
+			if accounts[i].Limits, err = quota.LimitsOf(db, defaults, account); err == nil {
+				accounts[i].Usage, err = quota.UsageOf(db, account, now)
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{"data": accounts})
+	}
+}
@@ -1,10 +1,19 @@
 package handlers
 
 import (
+	"deforestation/audit"
 	"deforestation/auth"
+	"deforestation/dto"
+	"deforestation/lockout"
 	"deforestation/models"
+	"deforestation/passwordreset"
+	"deforestation/ratelimit"
+	"deforestation/sessions"
+	"errors"
 	"log"
 	"net/http"
+	"net/mail"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
@@ -20,9 +29,38 @@ type NewUser struct {
 	Username        string `json:"username"`
 	Password        string `json:"password"`
 	ConfirmPassword string `json:"confirm_password"`
+	Email           string `json:"email"`
+}
+
+type RefreshInput struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+type UpdateEmailInput struct {
+	Email           string `json:"email"`
+	CurrentPassword string `json:"current_password" binding:"required"`
+}
+
+type ChangePasswordInput struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	Password        string `json:"password" binding:"required"`
+	ConfirmPassword string `json:"confirm_password"`
+}
+
+type PasswordResetRequestInput struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+type PasswordResetInput struct {
+	Token           string `json:"token" binding:"required"`
+	Password        string `json:"password" binding:"required"`
+	ConfirmPassword string `json:"confirm_password"`
 }
 
 func Signup(db *gorm.DB) gin.HandlerFunc {
+	policy := auth.PasswordPolicyFromEnv()
+
 	return func(c *gin.Context) {
 		var user NewUser
 		if err := c.BindJSON(&user); err != nil {
@@ -30,32 +68,54 @@ func Signup(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
-		if user.Password != user.ConfirmPassword {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Passwords don't match!"})
-			return
+		if user.Email != "" {
+			if _, err := mail.ParseAddress(user.Email); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email address"})
+				return
+			}
 		}
 
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		hashedPassword, ok := newPasswordHash(c, policy, user.Password, user.ConfirmPassword, user.Username)
+		if !ok {
 			return
 		}
 
 		newUser := models.User{
 			Username: user.Username,
-			Password: string(hashedPassword),
+			Password: hashedPassword,
+			Email:    user.Email,
 		}
 
 		if err := db.Create(&newUser).Error; err != nil {
+			auditRequest(db, c, models.AuditLog{
+				Username:     user.Username,
+				Action:       audit.ActionSignup,
+				ResourceType: audit.ResourceUser,
+				Outcome:      models.AuditFailed,
+				Detail:       "user already exists",
+			})
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "User already exists"})
 			return
 		}
+		auditRequest(db, c, models.AuditLog{
+			ActorID:      &newUser.ID,
+			Username:     newUser.Username,
+			Action:       audit.ActionSignup,
+			ResourceType: audit.ResourceUser,
+			ResourceID:   &newUser.ID,
+			Outcome:      models.AuditSucceeded,
+		})
 
 		c.JSON(http.StatusCreated, gin.H{"message": "User created successfully"})
 	}
 }
 
+// Login exchanges a username and password for session tokens. Accounts and
+// clients with too many recent failures are locked out for a while, whether
+// or not the account exists.
 func Login(db *gorm.DB) gin.HandlerFunc {
+	policy := lockout.PolicyFromEnv()
+
 	return func(c *gin.Context) {
 		var user User
 		if err := c.BindJSON(&user); err != nil {
@@ -63,25 +123,100 @@ func Login(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
+		wait, err := policy.Check(db, user.Username, c.ClientIP(), time.Now())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
+		if wait > 0 {
+			auditRequest(db, c, models.AuditLog{
+				Username:     user.Username,
+				Action:       audit.ActionLogin,
+				ResourceType: audit.ResourceUser,
+				Outcome:      models.AuditDenied,
+				Detail:       "locked out",
+			})
+			c.Header("Retry-After", ratelimit.RetryAfter(wait))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many failed login attempts, try again later"})
+			return
+		}
+
 		var existingUser models.User
 		if err := db.Where("username = ?", user.Username).First(&existingUser).Error; err != nil {
+			recordLogin(db, c, user.Username, nil, models.AuditFailed, "unknown user")
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or password"})
 			return
 		}
 
-		err := bcrypt.CompareHashAndPassword([]byte(existingUser.Password), []byte(user.Password))
+		err = bcrypt.CompareHashAndPassword([]byte(existingUser.Password), []byte(user.Password))
 		if err != nil {
+			recordLogin(db, c, user.Username, &existingUser.ID, models.AuditFailed, "wrong password")
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or password"})
 			return
 		}
+		recordLogin(db, c, user.Username, &existingUser.ID, models.AuditSucceeded, "")
 
-		token, err := auth.GenerateJWT(user.Username)
+		tokens, err := sessions.Create(db, existingUser, c.Request.UserAgent(), c.ClientIP())
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"token": token})
+		c.JSON(http.StatusOK, tokens)
+	}
+}
+
+// recordLogin feeds a password login to the lockout counters and the audit
+// log. userID is nil when the account does not exist.
+func recordLogin(db *gorm.DB, c *gin.Context, username string, userID *uint, outcome, detail string) {
+	if err := lockout.Record(db, username, c.ClientIP(), outcome == models.AuditSucceeded); err != nil {
+		log.Printf("Error recording login attempt: %v", err)
+	}
+
+	auditRequest(db, c, models.AuditLog{
+		ActorID:      userID,
+		Username:     username,
+		Action:       audit.ActionLogin,
+		ResourceType: audit.ResourceUser,
+		ResourceID:   userID,
+		Outcome:      outcome,
+		Detail:       detail,
+	})
+}
+
+// Refresh exchanges a refresh token for a new access token and a new
+// refresh token. Presenting a refresh token twice revokes its session.
+func Refresh(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var input RefreshInput
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		tokens, err := sessions.Refresh(db, input.RefreshToken)
+		if errors.Is(err, sessions.ErrInvalidToken) || errors.Is(err, sessions.ErrTokenReused) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
+
+		c.JSON(http.StatusOK, tokens)
+	}
+}
+
+// Logout revokes the current session, invalidating its access and refresh
+// tokens
+func Logout(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := sessions.Revoke(db, c.GetUint("sessionID")); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
 	}
 }
 
@@ -99,3 +234,217 @@ func Check(db *gorm.DB) gin.HandlerFunc {
 		c.JSON(http.StatusOK, gin.H{"error": "Token OK"})
 	}
 }
+
+// GetMe returns the profile of the current user
+func GetMe(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var user models.User
+		if err := db.First(&user, c.GetUint("userID")).Error; err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid user"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"data": dto.NewUser(user)})
+	}
+}
+
+// UpdateEmail sets the address notifications and password reset links are
+// mailed to. An empty address disables email notifications. As the address
+// can be used to take over the account, the current password is required
+// and reset links sent to the old address stop working. The new address
+// is no longer verified, so it can't be used to link a single sign-on
+// account.
+func UpdateEmail(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var input UpdateEmailInput
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		if input.Email != "" {
+			if _, err := mail.ParseAddress(input.Email); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email address"})
+				return
+			}
+		}
+
+		var user models.User
+		if err := db.First(&user, c.GetUint("userID")).Error; err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid user"})
+			return
+		}
+
+		if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(input.CurrentPassword)); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Current password is incorrect"})
+			return
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&user).Updates(map[string]interface{}{
+				"email":             input.Email,
+				"email_verified_at": nil,
+			}).Error; err != nil {
+				return err
+			}
+			return passwordreset.RevokeAll(tx, user.ID)
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Email updated successfully"})
+	}
+}
+
+// ChangePassword sets a new password after checking the current one. The
+// other sessions of the user are revoked, the current one stays signed in.
+func ChangePassword(db *gorm.DB) gin.HandlerFunc {
+	policy := auth.PasswordPolicyFromEnv()
+
+	return func(c *gin.Context) {
+		var input ChangePasswordInput
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		var user models.User
+		if err := db.First(&user, c.GetUint("userID")).Error; err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid user"})
+			return
+		}
+
+		if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(input.CurrentPassword)); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Current password is incorrect"})
+			return
+		}
+
+		hashedPassword, ok := newPasswordHash(c, policy, input.Password, input.ConfirmPassword, user.Username)
+		if !ok {
+			return
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&user).Update("password", hashedPassword).Error; err != nil {
+				return err
+			}
+			return sessions.RevokeOthers(tx, user.ID, c.GetUint("sessionID"))
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Password changed successfully"})
+	}
+}
+
+// RequestPasswordReset sends a reset link to the user with the given
+// username or email address. The answer is the same whether or not such a
+// user exists, so it cannot be used to probe for accounts.
+func RequestPasswordReset(db *gorm.DB, notifier passwordreset.Notifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var input PasswordResetRequestInput
+		if err := c.ShouldBindJSON(&input); err != nil || (input.Username == "") == (input.Email == "") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Provide either a username or an email address"})
+			return
+		}
+
+		query := db.Where("username = ?", input.Username)
+		if input.Email != "" {
+			query = db.Where("LOWER(email) = LOWER(?)", input.Email)
+		}
+
+		var users []models.User
+		if err := query.Find(&users).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
+		for _, user := range users {
+			// Single sign-on accounts get no local password
+			if user.OIDCSubject != nil {
+				continue
+			}
+			if err := passwordreset.Request(db, notifier, user); err != nil {
+				log.Printf("Error sending password reset for user %d: %v", user.ID, err)
+			}
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{"message": "If the account exists, a reset link has been sent"})
+	}
+}
+
+// ResetPassword sets a new password with a reset token and signs the user
+// out everywhere
+func ResetPassword(db *gorm.DB) gin.HandlerFunc {
+	policy := auth.PasswordPolicyFromEnv()
+
+	return func(c *gin.Context) {
+		var input PasswordResetInput
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+
+		user, err := passwordreset.Lookup(db, input.Token)
+		if errors.Is(err, passwordreset.ErrInvalidToken) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset token"})
+			return
+		} else if errors.Is(err, passwordreset.ErrSSOAccount) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Password reset is not available for single sign-on accounts"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
+
+		hashedPassword, ok := newPasswordHash(c, policy, input.Password, input.ConfirmPassword, user.Username)
+		if !ok {
+			return
+		}
+
+		err = passwordreset.Reset(db, input.Token, hashedPassword)
+		if errors.Is(err, passwordreset.ErrInvalidToken) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset token"})
+			return
+		} else if errors.Is(err, passwordreset.ErrSSOAccount) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Password reset is not available for single sign-on accounts"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Password reset successfully"})
+	}
+}
+
+// newPasswordHash checks a new password against its confirmation and the
+// password policy, and hashes it
+func newPasswordHash(c *gin.Context, policy auth.PasswordPolicy, password, confirmPassword, username string) (string, bool) {
+	if password != confirmPassword {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Passwords don't match!"})
+		return "", false
+	}
+
+	if err := policy.Validate(password, username); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return "", false
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return "", false
+	}
+	return string(hashedPassword), true
+}
+
+// GetJWKS publishes the public keys access tokens are signed with, so other
+// services can verify them without sharing a secret
+func GetJWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, gin.H{"keys": auth.JWKS()})
+}
@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"deforestation/authz"
+	"deforestation/models"
+	"deforestation/notifications"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+type CreateWebhookInput struct {
+	URL    string   `json:"url" binding:"required"`
+	Events []string `json:"events" binding:"required"`
+	Secret string   `json:"secret" binding:"max=128"`
+}
+
+// CreateWebhook registers a webhook for the current user. The signing secret
+// is only returned in this response.
+func CreateWebhook(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var input CreateWebhookInput
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		target, err := url.Parse(input.URL)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook URL"})
+			return
+		}
+
+		if len(input.Events) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "At least one event is required"})
+			return
+		}
+		for _, event := range input.Events {
+			if !notifications.ValidWebhookEvent(event) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown event: " + event})
+				return
+			}
+		}
+
+		secret := input.Secret
+		if secret == "" {
+			b := make([]byte, 32)
+			if _, err := rand.Read(b); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+				return
+			}
+			secret = hex.EncodeToString(b)
+		}
+
+		hook := models.Webhook{
+			UserID: c.GetUint("userID"),
+			URL:    input.URL,
+			Secret: secret,
+			Events: strings.Join(input.Events, ","),
+			Active: true,
+		}
+
+		if err := db.Create(&hook).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{"data": hook, "secret": secret})
+	}
+}
+
+// GetWebhooks returns the webhooks of the current user
+func GetWebhooks(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var hooks []models.Webhook
+		if err := db.Where("user_id = ?", c.GetUint("userID")).Find(&hooks).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"data": hooks})
+	}
+}
+
+// DeleteWebhook removes a webhook of the current user
+func DeleteWebhook(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		hook, ok := loadWebhook(db, c, authz.ActionDelete)
+		if !ok {
+			return
+		}
+
+		if err := db.Delete(&hook).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Webhook deleted successfully"})
+	}
+}
+
+// GetWebhookDeliveries returns the delivery log of a webhook, newest first
+func GetWebhookDeliveries(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		hook, ok := loadWebhook(db, c, authz.ActionRead)
+		if !ok {
+			return
+		}
+
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+		if err != nil || limit <= 0 || limit > 500 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+
+		var deliveries []models.WebhookDelivery
+		if err := db.Where("webhook_id = ?", hook.ID).Order("created_at desc").Limit(limit).
+			Find(&deliveries).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"data": deliveries})
+	}
+}
+
+// TestWebhook sends a single webhook.ping event to the webhook and reports
+// the outcome
+func TestWebhook(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		hook, ok := loadWebhook(db, c, authz.ActionUpdate)
+		if !ok {
+			return
+		}
+
+		notifier := notifications.NewWebhookNotifier(db)
+		notifier.MaxAttempts = 1
+
+		event := notifications.Event{
+			Type:   notifications.EventWebhookPing,
+			UserID: hook.UserID,
+			Data:   gin.H{"webhook_id": hook.ID},
+		}
+		if err := notifier.Deliver(hook, notifications.Prepare(event)); err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Webhook delivered successfully"})
+	}
+}
+
+func loadWebhook(db *gorm.DB, c *gin.Context, action authz.Action) (models.Webhook, bool) {
+	var hook models.Webhook
+	ok := load(db, c, action, &hook, "webhook")
+	return hook, ok
+}
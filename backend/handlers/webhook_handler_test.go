@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCreateWebhookSecretLength(t *testing.T) {
+	// The URL is refused after binding, so the handler stops before the
+	// database and the error tells which check failed
+	tests := []struct {
+		secret string
+		error  string
+	}{
+		{"", "Invalid webhook URL"},
+		{strings.Repeat("s", 128), "Invalid webhook URL"},
+		{strings.Repeat("s", 129), "Field validation for 'Secret' failed on the 'max' tag"},
+	}
+	for _, tt := range tests {
+		body, _ := json.Marshal(map[string]interface{}{
+			"url":    "ftp://example.com/hook",
+			"events": []string{"analysis.completed"},
+			"secret": tt.secret,
+		})
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("POST", "/webhooks", strings.NewReader(string(body)))
+		c.Request.Header.Set("Content-Type", "application/json")
+
+		CreateWebhook(nil)(c)
+
+		var response struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		if w.Code != http.StatusBadRequest || !strings.Contains(response.Error, tt.error) {
+			t.Errorf("secret of %d characters: %d %q, want 400 %q", len(tt.secret), w.Code, response.Error, tt.error)
+		}
+	}
+}
@@ -1,8 +1,13 @@
 package jobs
 
 import (
+	"deforestation/models"
+	"errors"
 	"log"
+	"math/rand"
+	"time"
 
+	"github.com/jinzhu/gorm"
 	"github.com/robfig/cron/v3"
 )
 
@@ -15,9 +20,24 @@ func init() {
 	jobCron.Start()
 }
 
-func StartWeeklyJob(areaID uint, getImage func(uint) error) {
+// Deferred is implemented by errors of work that could not be done yet,
+// such as a capture that does not fit in the day's tile quota. The work is
+// retried after RetryAfter instead of counting as failed.
+type Deferred interface {
+	error
+	RetryAfter() time.Duration
+}
+
+// deferJitter spreads the retries of deferred runs, which would otherwise
+// all start the moment the tile quota resets
+const deferJitter = 30 * time.Minute
+
+// StartWeeklyJob runs getImage for the area every week. Deferred runs are
+// retried later, and the retry is kept in the area's job schedule so it
+// survives a restart.
+func StartWeeklyJob(db *gorm.DB, areaID uint, getImage func(uint) error) {
 	job := func() {
-		getImage(areaID)
+		runDeferrable(db, areaID, getImage)
 	}
 
 	schedule := "0 0 * * 0" // Every Sunday at midnight
@@ -27,6 +47,82 @@ func StartWeeklyJob(areaID uint, getImage func(uint) error) {
 	}
 }
 
+// ResumeWeeklyJobs starts the weekly jobs of the scheduled areas, and the
+// deferred runs that were pending when the backend stopped
+func ResumeWeeklyJobs(db *gorm.DB, getImage func(uint) error) error {
+	var schedules []models.JobSchedule
+	if err := db.Joins("JOIN areas ON areas.id = job_schedules.area_id AND areas.deleted_at IS NULL").
+		Find(&schedules).Error; err != nil {
+		return err
+	}
+
+	for _, schedule := range schedules {
+		StartWeeklyJob(db, schedule.AreaID, getImage)
+		if schedule.NextRunAt != nil {
+			retryAt(db, schedule.AreaID, getImage, time.Until(*schedule.NextRunAt))
+		}
+	}
+	return nil
+}
+
+// runDeferrable runs getImage for the area, and runs it again later for as
+// long as it returns a Deferred error
+func runDeferrable(db *gorm.DB, areaID uint, getImage func(uint) error) {
+	err := getImage(areaID)
+
+	var deferred Deferred
+	if !errors.As(err, &deferred) {
+		if err := db.Model(&models.JobSchedule{}).Where("area_id = ? AND next_run_at IS NOT NULL", areaID).
+			Update("next_run_at", gorm.Expr("NULL")).Error; err != nil {
+			log.Printf("Error clearing deferred run of area %d: %v", areaID, err)
+		}
+		return
+	}
+
+	wait := deferred.RetryAfter() + time.Duration(rand.Int63n(int64(deferJitter)))
+	if err := db.Model(&models.JobSchedule{}).Where("area_id = ?", areaID).
+		Update("next_run_at", time.Now().Add(wait)).Error; err != nil {
+		log.Printf("Error saving deferred run of area %d: %v", areaID, err)
+	}
+	log.Printf("Job of area %d deferred by %s: %v", areaID, wait.Round(time.Second), err)
+	retryAt(db, areaID, getImage, wait)
+}
+
+func retryAt(db *gorm.DB, areaID uint, getImage func(uint) error, wait time.Duration) {
+	time.AfterFunc(wait, func() {
+		runDeferrable(db, areaID, getImage)
+	})
+}
+
+// StartWeeklyDigestJob runs send every Monday morning, after the weekly
+// captures of Sunday night
+func StartWeeklyDigestJob(send func()) {
+	schedule := "0 6 * * 1" // Every Monday at 06:00
+	_, err := jobCron.AddFunc(schedule, send)
+	if err != nil {
+		log.Fatalf("Error scheduling digest job: %v", err)
+	}
+}
+
+// StartStorageGCJob runs collect every night, outside of the capture and
+// digest windows
+func StartStorageGCJob(collect func()) {
+	schedule := "0 3 * * *" // Every day at 03:00
+	_, err := jobCron.AddFunc(schedule, collect)
+	if err != nil {
+		log.Fatalf("Error scheduling storage GC job: %v", err)
+	}
+}
+
+// StartCleanupJob runs cleanup every night, after the storage GC
+func StartCleanupJob(cleanup func()) {
+	schedule := "0 4 * * *" // Every day at 04:00
+	_, err := jobCron.AddFunc(schedule, cleanup)
+	if err != nil {
+		log.Fatalf("Error scheduling cleanup job: %v", err)
+	}
+}
+
 func StopAllJobs() {
 	jobCron.Stop()
 }
@@ -0,0 +1,89 @@
+package jobs
+
+import (
+	"deforestation/models"
+	"deforestation/testdb"
+	"errors"
+	"testing"
+	"time"
+)
+
+type deferredError time.Duration
+
+func (e deferredError) Error() string             { return "deferred" }
+func (e deferredError) RetryAfter() time.Duration { return time.Duration(e) }
+
+func TestRunDeferrablePersistsRetry(t *testing.T) {
+	db := testdb.Open(t)
+	schedule := models.JobSchedule{AreaID: 1}
+	if err := db.Create(&schedule).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	retry := 10 * time.Hour
+	start := time.Now()
+	runDeferrable(db, 1, func(uint) error { return deferredError(retry) })
+
+	if err := db.First(&schedule, schedule.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if schedule.NextRunAt == nil {
+		t.Fatal("deferred run was not saved")
+	}
+	if earliest, latest := start.Add(retry), time.Now().Add(retry+deferJitter); schedule.NextRunAt.Before(earliest) || schedule.NextRunAt.After(latest) {
+		t.Errorf("next run at %v, want between %v and %v", schedule.NextRunAt, earliest, latest)
+	}
+
+	// Runs that finish, failed or not, clear the pending retry
+	runDeferrable(db, 1, func(uint) error { return errors.New("capture failed") })
+	if err := db.First(&schedule, schedule.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if schedule.NextRunAt != nil {
+		t.Errorf("next run at %v after a finished run, want none", schedule.NextRunAt)
+	}
+}
+
+func TestResumeWeeklyJobs(t *testing.T) {
+	db := testdb.Open(t)
+
+	area := models.Area{AreaName: "pending"}
+	deleted := models.Area{AreaName: "deleted"}
+	for _, a := range []*models.Area{&area, &deleted} {
+		if err := db.Create(a).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete(&deleted).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	past := time.Now().Add(-time.Hour)
+	for _, id := range []uint{area.ID, deleted.ID} {
+		if err := db.Create(&models.JobSchedule{AreaID: id, NextRunAt: &past}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ran := make(chan uint, 2)
+	if err := ResumeWeeklyJobs(db, func(areaID uint) error {
+		ran <- areaID
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case id := <-ran:
+		if id != area.ID {
+			t.Errorf("resumed the run of area %d, want %d", id, area.ID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("overdue run was not resumed")
+	}
+	select {
+	case id := <-ran:
+		t.Errorf("also resumed the run of area %d", id)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
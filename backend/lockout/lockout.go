@@ -0,0 +1,102 @@
+// Package lockout temporarily blocks password logins to an account, or from
+// a client IP, after repeated failures
+package lockout
+
+import (
+	"deforestation/models"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Policy locks an account after MaxAccountFailures failed logins, and a
+// client IP after MaxIPFailures, within Window. A lock lasts Duration after
+// the last failure. A successful login resets the account count.
+type Policy struct {
+	MaxAccountFailures int
+	MaxIPFailures      int
+	Window             time.Duration
+	Duration           time.Duration
+}
+
+// PolicyFromEnv reads LOCKOUT_ACCOUNT_FAILURES (default 5),
+// LOCKOUT_IP_FAILURES (default 20), LOCKOUT_WINDOW_MINUTES (default 15)
+// and LOCKOUT_DURATION_MINUTES (default 15)
+func PolicyFromEnv() Policy {
+	return Policy{
+		MaxAccountFailures: envInt("LOCKOUT_ACCOUNT_FAILURES", 5),
+		MaxIPFailures:      envInt("LOCKOUT_IP_FAILURES", 20),
+		Window:             time.Duration(envInt("LOCKOUT_WINDOW_MINUTES", 15)) * time.Minute,
+		Duration:           time.Duration(envInt("LOCKOUT_DURATION_MINUTES", 15)) * time.Minute,
+	}
+}
+
+func envInt(name string, fallback int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil && v > 0 {
+		return v
+	}
+	return fallback
+}
+
+// Check returns how long logins to username from ip remain blocked, zero
+// when they are allowed
+func (p Policy) Check(db *gorm.DB, username, ip string, now time.Time) (time.Duration, error) {
+	since := now.Add(-p.Window)
+
+	// Failures before the last successful login no longer count
+	var last struct{ At *time.Time }
+	if err := db.Model(&models.LoginAttempt{}).Select("MAX(created_at) AS at").
+		Where("username = ? AND success = ? AND created_at > ?", username, true, since).
+		Scan(&last).Error; err != nil {
+		return 0, err
+	}
+	accountSince := since
+	if last.At != nil {
+		accountSince = *last.At
+	}
+
+	account, err := p.locked(db, now, p.MaxAccountFailures, "username = ?", username, accountSince)
+	if err != nil || account > 0 {
+		return account, err
+	}
+	return p.locked(db, now, p.MaxIPFailures, "ip = ?", ip, since)
+}
+
+func (p Policy) locked(db *gorm.DB, now time.Time, max int, condition string, value string, since time.Time) (time.Duration, error) {
+	var failures struct {
+		Count int
+		Last  *time.Time
+	}
+	if err := db.Model(&models.LoginAttempt{}).Select("COUNT(*) AS count, MAX(created_at) AS last").
+		Where(condition+" AND success = ? AND created_at > ?", value, false, since).
+		Scan(&failures).Error; err != nil {
+		return 0, err
+	}
+
+	if failures.Count < max || failures.Last == nil {
+		return 0, nil
+	}
+	if until := failures.Last.Add(p.Duration); until.After(now) {
+		return until.Sub(now), nil
+	}
+	return 0, nil
+}
+
+// Record stores the outcome of a login
+func Record(db *gorm.DB, username, ip string, success bool) error {
+	return db.Create(&models.LoginAttempt{Username: truncate(username, 128), IP: ip, Success: success}).Error
+}
+
+// Prune deletes the attempts older than any lockout window
+func Prune(db *gorm.DB, before time.Time) error {
+	return db.Unscoped().Where("created_at < ?", before).Delete(&models.LoginAttempt{}).Error
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
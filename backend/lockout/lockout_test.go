@@ -0,0 +1,72 @@
+package lockout
+
+import (
+	"deforestation/models"
+	"deforestation/testdb"
+	"testing"
+	"time"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	policy := Policy{MaxAccountFailures: 3, MaxIPFailures: 5, Window: 15 * time.Minute, Duration: 10 * time.Minute}
+	now := time.Now().Truncate(time.Second)
+
+	type attempt struct {
+		username string
+		ip       string
+		success  bool
+		ago      time.Duration
+	}
+	failures := func(username, ip string, ago ...time.Duration) []attempt {
+		var attempts []attempt
+		for _, a := range ago {
+			attempts = append(attempts, attempt{username, ip, false, a})
+		}
+		return attempts
+	}
+
+	tests := []struct {
+		name     string
+		attempts []attempt
+		username string
+		ip       string
+		want     time.Duration
+	}{
+		{"no attempts", nil, "ana", "10.0.0.1", 0},
+		{"below the account limit", failures("ana", "10.0.0.1", time.Minute, 2*time.Minute), "ana", "10.0.0.1", 0},
+		{"account locked", failures("ana", "10.0.0.1", time.Minute, 2*time.Minute, 3*time.Minute), "ana", "10.0.0.1", 9 * time.Minute},
+		{"account locked from another ip", failures("ana", "10.0.0.2", time.Minute, 2*time.Minute, 3*time.Minute), "ana", "10.0.0.1", 9 * time.Minute},
+		{"lock expired", failures("ana", "10.0.0.1", 11*time.Minute, 12*time.Minute, 13*time.Minute), "ana", "10.0.0.1", 0},
+		{"failures outside the window", failures("ana", "10.0.0.1", time.Minute, 2*time.Minute, 16*time.Minute), "ana", "10.0.0.1", 0},
+		{"success resets the account", append(
+			failures("ana", "10.0.0.1", 2*time.Minute, 4*time.Minute, 5*time.Minute),
+			attempt{"ana", "10.0.0.1", true, 3 * time.Minute}), "ana", "10.0.0.1", 0},
+		{"other accounts are not locked", failures("bob", "10.0.0.1", time.Minute, 2*time.Minute, 3*time.Minute), "ana", "10.0.0.2", 0},
+		{"ip locked", append(
+			failures("a", "10.0.0.1", 2*time.Minute, 3*time.Minute),
+			failures("b", "10.0.0.1", 4*time.Minute, 5*time.Minute, 6*time.Minute)...), "c", "10.0.0.1", 8 * time.Minute},
+		{"success does not reset the ip", append(
+			failures("a", "10.0.0.1", 2*time.Minute, 3*time.Minute, 4*time.Minute, 5*time.Minute, 6*time.Minute),
+			attempt{"c", "10.0.0.1", true, time.Minute}), "c", "10.0.0.1", 8 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testdb.Open(t)
+			for _, a := range tt.attempts {
+				row := models.LoginAttempt{Username: a.username, IP: a.ip, Success: a.success}
+				row.CreatedAt = now.Add(-a.ago)
+				if err := db.Create(&row).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := policy.Check(db, tt.username, tt.ip, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Check = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,11 +1,26 @@
 package main
 
 import (
+	"context"
+	"deforestation/auth"
 	db "deforestation/database"
 	"deforestation/handlers"
+	"deforestation/jobs"
+	"deforestation/lockout"
 	"deforestation/middleware"
 	"deforestation/migrations"
+	"deforestation/notifications"
+	"deforestation/oidc"
+	"deforestation/passwordreset"
+	"deforestation/ratelimit"
+	"deforestation/renditions"
+	"deforestation/reports"
+	"deforestation/retention"
+	"deforestation/storage"
+	"deforestation/utils"
 	"fmt"
+	"log"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -19,35 +34,163 @@ func main() {
 	// Run migrations
 	migrations.Migrate(db.GetDB())
 
+	// Load the token signing keys
+	if err := auth.Init(); err != nil {
+		log.Fatalf("Error loading JWT signing keys: %v", err)
+	}
+
+	// Initialize the image store
+	if err := storage.Init(); err != nil {
+		log.Fatalf("Error initializing image storage: %v", err)
+	}
+
+	// Register notification channels
+	if notifications.AllowPrivateTargetsFromEnv() {
+		log.Println("WEBHOOK_ALLOW_PRIVATE_TARGETS is set: webhooks may reach loopback and private addresses")
+	}
+	notifications.Register(notifications.NewWebhookNotifier(db.GetDB()))
+	if smtpConfig := notifications.SMTPConfigFromEnv(); smtpConfig.Enabled() {
+		// Mails link to signed image URLs, which a random key breaks on restart
+		if !auth.ImageURLSecretConfigured() {
+			log.Fatal("IMAGE_URL_SECRET must be set when email notifications are enabled")
+		}
+		notifications.Register(notifications.NewEmailNotifier(db.GetDB(), storage.GetStore(), smtpConfig))
+	}
+
+	// Restart the weekly captures, with the runs deferred before a restart
+	if err := jobs.ResumeWeeklyJobs(db.GetDB(), utils.RunScheduledCapture); err != nil {
+		log.Fatalf("Error resuming weekly jobs: %v", err)
+	}
+
+	jobs.StartWeeklyDigestJob(func() {
+		reports.SendWeeklyDigests(db.GetDB(), time.Now())
+	})
+
+	// The image handler, area deletion and the garbage collection share one
+	// rendition cache, so that renditions are not deleted while being served
+	retentionPolicy := retention.PolicyFromEnv()
+	renditionCache := renditions.NewService(renditions.CacheDirFromEnv())
+	renditionCacheMax := renditions.MaxCacheBytesFromEnv()
+	jobs.StartStorageGCJob(func() {
+		report, err := retention.Run(context.Background(), db.GetDB(), storage.GetStore(), renditionCache, retentionPolicy, time.Now())
+		if err != nil {
+			log.Printf("Error collecting stored images: %v", err)
+		}
+		log.Printf("Storage GC: expired %d captures, deleted %d objects, reclaimed %d bytes (%d errors)",
+			report.ExpiredCaptures, report.DeletedObjects, report.ReclaimedBytes, report.Errors)
+
+		reclaimed, err := renditionCache.Trim(renditionCacheMax)
+		if err != nil {
+			log.Printf("Error trimming the rendition cache: %v", err)
+		}
+		log.Printf("Rendition cache: reclaimed %d bytes", reclaimed)
+	})
+
+	// Login attempts are only needed for the lockout window
+	jobs.StartCleanupJob(func() {
+		if err := lockout.Prune(db.GetDB(), time.Now().Add(-24*time.Hour)); err != nil {
+			log.Printf("Error pruning login attempts: %v", err)
+		}
+		if err := passwordreset.Prune(db.GetDB(), time.Now().Add(-24*time.Hour)); err != nil {
+			log.Printf("Error pruning password reset tokens: %v", err)
+		}
+	})
+
 	r := gin.Default()
 
+	// The client IP keys rate limits and lockouts, so X-Forwarded-For is
+	// only trusted from known proxies
+	if err := r.SetTrustedProxies(middleware.TrustedProxiesFromEnv()); err != nil {
+		log.Fatalf("Error setting trusted proxies: %v", err)
+	}
+
 	// CORS middleware setup
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"*"}, // Allow all origins
 		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "X-API-Key"},
 		AllowCredentials: true,
 	}))
 
-	r.POST("/signup", handlers.Signup(db.GetDB()))
-	r.POST("/login", handlers.Login(db.GetDB()))
+	// Credential endpoints are rate limited per client IP
+	loginLimit := middleware.RateLimit(ratelimit.PerMinuteFromEnv("LOGIN_RATE_LIMIT", 10))
+	signupLimit := middleware.RateLimit(ratelimit.PerMinuteFromEnv("SIGNUP_RATE_LIMIT", 5))
+
+	r.POST("/signup", signupLimit, handlers.Signup(db.GetDB()))
+	r.POST("/login", loginLimit, handlers.Login(db.GetDB()))
+	r.POST("/auth/refresh", loginLimit, handlers.Refresh(db.GetDB()))
+	r.POST("/auth/password-reset", signupLimit, handlers.RequestPasswordReset(db.GetDB(), passwordreset.NotifierFromEnv()))
+	r.POST("/auth/password-reset/confirm", loginLimit, handlers.ResetPassword(db.GetDB()))
+
+	// Single sign-on through an OpenID Connect provider
+	if oidcConfig := oidc.ConfigFromEnv(); oidcConfig.Enabled() {
+		provider := oidc.NewProvider(oidcConfig)
+		r.GET("/auth/oidc/login", loginLimit, handlers.OIDCLogin(db.GetDB(), provider))
+		r.GET("/auth/oidc/callback", handlers.OIDCCallback(db.GetDB(), provider))
+	}
+	r.GET("/.well-known/jwks.json", handlers.GetJWKS)
 
 	protected := r.Group("/")
 	protected.Use(middleware.AuthMiddleware())
 
 	protected.GET("/auth/check", handlers.Check(db.GetDB()))
+	protected.POST("/logout", middleware.RequireSession(), handlers.Logout(db.GetDB()))
+	protected.GET("/me", handlers.GetMe(db.GetDB()))
+	protected.PUT("/me/email", middleware.RequireSession(), handlers.UpdateEmail(db.GetDB()))
+	protected.PUT("/me/password", middleware.RequireSession(), handlers.ChangePassword(db.GetDB()))
 
 	protected.POST("/areas", handlers.CreateArea(db.GetDB()))
 	protected.GET("/areas", handlers.GetAllAreas(db.GetDB()))
 	protected.GET("/areas/:id", handlers.GetArea(db.GetDB()))
-	protected.DELETE("/areas/:id", handlers.DeleteArea(db.GetDB()))
+	protected.DELETE("/areas/:id", handlers.DeleteArea(db.GetDB(), renditionCache))
+	protected.GET("/areas/:id/report.pdf", handlers.GetAreaReport(db.GetDB()))
+	protected.GET("/areas/:id/export", handlers.ExportAreaHistories(db.GetDB()))
+	protected.GET("/areas/:id/timeseries", handlers.GetAreaTimeSeries(db.GetDB()))
+	protected.POST("/areas/:id/analyze", handlers.AnalyzeArea(db.GetDB()))
+	protected.PUT("/areas/:id/organization", handlers.MoveArea(db.GetDB()))
 
-	protected.GET("/images/:path", handlers.GetImageByPath(db.GetDB()))
+	protected.GET("/organizations", handlers.GetOrganizations(db.GetDB()))
+	protected.POST("/organizations", handlers.CreateOrganization(db.GetDB()))
+	protected.GET("/organizations/:id", handlers.GetOrganization(db.GetDB()))
+	protected.DELETE("/organizations/:id", handlers.DeleteOrganization(db.GetDB()))
+	protected.POST("/organizations/:id/members", handlers.AddMember(db.GetDB()))
+	protected.PUT("/organizations/:id/members/:user_id", handlers.UpdateMember(db.GetDB()))
+	protected.DELETE("/organizations/:id/members/:user_id", handlers.RemoveMember(db.GetDB()))
+
+	protected.GET("/audit", handlers.GetAuditLog(db.GetDB()))
+	protected.GET("/usage", handlers.GetUsage(db.GetDB()))
+
+	// Images may be fetched with a signed URL instead of a token
+	r.GET("/images/:path", middleware.ImageAuthMiddleware(), handlers.GetImageByPath(db.GetDB(), renditionCache))
 
 	protected.GET("/histories", handlers.GetAllHistories)
+	protected.GET("/histories/export", handlers.ExportHistories(db.GetDB()))
 	protected.GET("/histories/:id", handlers.GetHistoryByID)
+	protected.GET("/histories/:id/image-url", handlers.GetImageURL(db.GetDB()))
+	protected.GET("/histories/:id/tiles/:z/:x/:y", handlers.GetHistoryTile)
 	protected.GET("/histories/area/:id", handlers.GetHistoriesByAreaID)
 
+	protected.GET("/alerts", handlers.GetAlerts(db.GetDB()))
+	protected.GET("/alerts/rules", handlers.GetAlertRules(db.GetDB()))
+	protected.POST("/alerts/rules", handlers.CreateAlertRule(db.GetDB()))
+	protected.DELETE("/alerts/rules/:id", handlers.DeleteAlertRule(db.GetDB()))
+	protected.GET("/alerts/:id", handlers.GetAlert(db.GetDB()))
+	protected.POST("/alerts/:id/acknowledge", handlers.AcknowledgeAlert(db.GetDB()))
+	protected.POST("/alerts/:id/resolve", handlers.ResolveAlert(db.GetDB()))
+
+	protected.GET("/reports/digest", handlers.GetDigest(db.GetDB()))
+
+	// API keys can only be managed from a login session
+	protected.GET("/api-keys", middleware.RequireSession(), handlers.GetAPIKeys(db.GetDB()))
+	protected.POST("/api-keys", middleware.RequireSession(), handlers.CreateAPIKey(db.GetDB()))
+	protected.DELETE("/api-keys/:id", middleware.RequireSession(), handlers.RevokeAPIKey(db.GetDB()))
+
+	protected.GET("/webhooks", handlers.GetWebhooks(db.GetDB()))
+	protected.POST("/webhooks", handlers.CreateWebhook(db.GetDB()))
+	protected.DELETE("/webhooks/:id", handlers.DeleteWebhook(db.GetDB()))
+	protected.GET("/webhooks/:id/deliveries", handlers.GetWebhookDeliveries(db.GetDB()))
+	protected.POST("/webhooks/:id/test", handlers.TestWebhook(db.GetDB()))
+
 	if err := r.Run(); err != nil {
 		fmt.Printf("Gin server encountered an error: %v\n", err)
 	}
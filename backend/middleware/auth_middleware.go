@@ -1,9 +1,12 @@
 package middleware
 
 import (
+	"deforestation/apikeys"
 	"deforestation/auth"
 	"deforestation/database"
 	"deforestation/models"
+	"deforestation/sessions"
+	"errors"
 	"net/http"
 	"strings"
 
@@ -15,13 +18,22 @@ func AuthMiddleware() gin.HandlerFunc {
 		db := database.GetDB()
 
 		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
+		apiKey := c.GetHeader("X-API-Key")
+		if authHeader == "" && apiKey == "" {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
 			c.Abort()
 			return
 		}
 
 		tokenStr := strings.TrimPrefix(authHeader, "Bearer ")
+		if apiKey == "" && apikeys.IsKey(tokenStr) {
+			apiKey = tokenStr
+		}
+		if apiKey != "" {
+			authenticateAPIKey(c, apiKey)
+			return
+		}
+
 		claims, err := auth.ParseJWT(tokenStr)
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
@@ -32,10 +44,68 @@ func AuthMiddleware() gin.HandlerFunc {
 		var user models.User
 		if err := db.Where("username = ?", claims.Username).First(&user).Error; err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid USer"})
+			c.Abort()
+			return
+		}
+
+		// Tokens of revoked or expired sessions are rejected right away
+		// instead of when they expire
+		active, err := sessions.Active(db, claims.SessionID, user.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			c.Abort()
+			return
+		}
+		if !active {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Session expired"})
+			c.Abort()
 			return
 		}
 
 		c.Set("userID", user.ID)
+		c.Set("sessionID", claims.SessionID)
+		c.Next()
+	}
+}
+
+// authenticateAPIKey authenticates a machine client. Keys without the write
+// scope may only read.
+func authenticateAPIKey(c *gin.Context, raw string) {
+	key, err := apikeys.Authenticate(database.GetDB(), raw)
+	if errors.Is(err, apikeys.ErrInvalidKey) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+		c.Abort()
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		c.Abort()
+		return
+	}
+
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		if !apikeys.HasScope(key, models.ScopeWrite) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "API key lacks the write scope"})
+			c.Abort()
+			return
+		}
+	}
+
+	c.Set("userID", key.UserID)
+	c.Set("apiKeyID", key.ID)
+	c.Next()
+}
+
+// RequireSession restricts a route to users who logged in, for actions API
+// keys must not perform such as managing API keys
+func RequireSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetUint("sessionID") == 0 {
+			c.JSON(http.StatusForbidden, gin.H{"error": "This action requires a login session"})
+			c.Abort()
+			return
+		}
 		c.Next()
 	}
 }
@@ -0,0 +1,32 @@
+package middleware
+
+import (
+	"deforestation/auth"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ImageAuthMiddleware lets requests carrying a valid signed image URL
+// through without a token and marks them with "signedImage". Requests
+// without a signature fall back to AuthMiddleware.
+func ImageAuthMiddleware() gin.HandlerFunc {
+	authenticate := AuthMiddleware()
+
+	return func(c *gin.Context) {
+		signature := c.Query("signature")
+		if signature == "" {
+			authenticate(c)
+			return
+		}
+
+		if !auth.VerifyImageSignature(c.Param("path"), c.Query("expires"), signature) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Invalid or expired signature"})
+			c.Abort()
+			return
+		}
+
+		c.Set("signedImage", true)
+		c.Next()
+	}
+}
@@ -0,0 +1,22 @@
+package middleware
+
+import (
+	"deforestation/ratelimit"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimit limits requests per client IP, answering 429 with a
+// Retry-After header once the client's bucket is empty
+func RateLimit(limiter *ratelimit.Limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if ok, wait := limiter.Allow(c.ClientIP()); !ok {
+			c.Header("Retry-After", ratelimit.RetryAfter(wait))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests, try again later"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"deforestation/ratelimit"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRateLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	if err := r.SetTrustedProxies(nil); err != nil {
+		t.Fatal(err)
+	}
+	r.GET("/login", RateLimit(ratelimit.New(1, 2)), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	request := func(forwardedFor string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/login", nil)
+		req.RemoteAddr = "203.0.113.7:4000"
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := request(""); w.Code != http.StatusOK {
+			t.Fatalf("request %d status = %d", i+1, w.Code)
+		}
+	}
+
+	w := request("")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want 1", got)
+	}
+
+	// Without trusted proxies a forged header does not get a fresh bucket
+	if w := request("198.51.100.1"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("status with X-Forwarded-For = %d, want 429", w.Code)
+	}
+}
+
+func TestTrustedProxiesFromEnv(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "")
+	if got := TrustedProxiesFromEnv(); got != nil {
+		t.Errorf("TrustedProxiesFromEnv() = %q, want nil", got)
+	}
+
+	t.Setenv("TRUSTED_PROXIES", " 10.0.0.0/8, ,192.168.1.5 ")
+	got := TrustedProxiesFromEnv()
+	if len(got) != 2 || got[0] != "10.0.0.0/8" || got[1] != "192.168.1.5" {
+		t.Errorf("TrustedProxiesFromEnv() = %q", got)
+	}
+}
@@ -0,0 +1,20 @@
+package middleware
+
+import (
+	"os"
+	"strings"
+)
+
+// TrustedProxiesFromEnv reads TRUSTED_PROXIES, a comma separated list of
+// the addresses or CIDR ranges of the reverse proxies in front of the
+// backend. Forwarded client IP headers are only honored from those, so by
+// default the client IP is the address of the connection.
+func TrustedProxiesFromEnv() []string {
+	var proxies []string
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	return proxies
+}
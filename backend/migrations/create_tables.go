@@ -7,5 +7,29 @@ import (
 )
 
 func Migrate(db *gorm.DB) {
-	db.AutoMigrate(&models.Area{}, &models.History{}, &models.User{})
+	db.AutoMigrate(
+		&models.Area{},
+		&models.History{},
+		&models.User{},
+		&models.AlertRule{},
+		&models.Alert{},
+		&models.Webhook{},
+		&models.WebhookDelivery{},
+		&models.AnalysisRun{},
+		&models.Organization{},
+		&models.Membership{},
+		&models.Session{},
+		&models.RefreshToken{},
+		&models.APIKey{},
+		&models.OIDCLogin{},
+		&models.LoginAttempt{},
+		&models.PasswordResetToken{},
+		&models.AuditLog{},
+		&models.Quota{},
+		&models.TileUsage{},
+	)
+
+	CreateJobSchedules(db)
+	NormalizeImageKeys(db)
+	ProtectAuditLog(db)
 }
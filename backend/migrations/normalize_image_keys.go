@@ -0,0 +1,46 @@
+package migrations
+
+import (
+	"deforestation/storage"
+	"log"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jinzhu/gorm"
+)
+
+// legacyImageDir is the prefix of image paths stored before histories kept
+// object keys
+const legacyImageDir = "/app/images/"
+
+// NormalizeImageKeys turns absolute image paths of existing histories into
+// object keys relative to the image store. Only paths below the legacy or
+// the configured image directory are touched, so running it again once
+// every path is a key changes nothing.
+func NormalizeImageKeys(db *gorm.DB) {
+	prefixes := []string{legacyImageDir}
+	if dir := filepath.ToSlash(filepath.Clean(storage.ImageDir())) + "/"; dir != legacyImageDir && strings.HasPrefix(dir, "/") {
+		prefixes = append(prefixes, dir)
+	}
+
+	for _, prefix := range prefixes {
+		for _, column := range []string{"image_path", "masked_image_path"} {
+			result := db.Exec("UPDATE histories SET "+column+" = substr("+column+", ?) WHERE "+column+` LIKE ? ESCAPE '\'`,
+				utf8.RuneCountInString(prefix)+1, likePrefix(prefix))
+			if result.Error != nil {
+				log.Printf("Error normalizing %s of histories below %s: %v", column, prefix, result.Error)
+				continue
+			}
+			if result.RowsAffected > 0 {
+				log.Printf("Normalized %s of %d histories below %s", column, result.RowsAffected, prefix)
+			}
+		}
+	}
+}
+
+// likePrefix returns a LIKE pattern matching the strings starting with
+// prefix, which may contain wildcard characters
+func likePrefix(prefix string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix) + "%"
+}
@@ -0,0 +1,49 @@
+package migrations_test
+
+import (
+	"deforestation/migrations"
+	"deforestation/models"
+	"deforestation/testdb"
+	"testing"
+)
+
+func TestNormalizeImageKeys(t *testing.T) {
+	t.Setenv("IMAGE_DIR", "/srv/image_data")
+	db := testdb.Open(t)
+
+	histories := []models.History{
+		{ImagePath: "/app/images/area_1_20240101000000.png", MaskedImagePath: "/app/images/area_1_20240101000000_masked.png"},
+		{ImagePath: "/srv/image_data/area_2_20240101000000.png", MaskedImagePath: "area_2_20240101000000_masked.png"},
+		{ImagePath: "/srv/imageXdata/area_3.png"},
+		{ImagePath: "area_4_20240101000000.png"},
+	}
+	for i := range histories {
+		histories[i].AreaID = uint(i + 1)
+		if err := db.Create(&histories[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []models.History{
+		{ImagePath: "area_1_20240101000000.png", MaskedImagePath: "area_1_20240101000000_masked.png"},
+		{ImagePath: "area_2_20240101000000.png", MaskedImagePath: "area_2_20240101000000_masked.png"},
+		{ImagePath: "/srv/imageXdata/area_3.png"},
+		{ImagePath: "area_4_20240101000000.png"},
+	}
+
+	// Migrations run on every start, a second run must not change anything
+	for run := 1; run <= 2; run++ {
+		migrations.NormalizeImageKeys(db)
+
+		for i, history := range histories {
+			var got models.History
+			if err := db.First(&got, history.ID).Error; err != nil {
+				t.Fatal(err)
+			}
+			if got.ImagePath != want[i].ImagePath || got.MaskedImagePath != want[i].MaskedImagePath {
+				t.Errorf("run %d: history %d paths = %q, %q, want %q, %q", run, i+1,
+					got.ImagePath, got.MaskedImagePath, want[i].ImagePath, want[i].MaskedImagePath)
+			}
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package migrations
+
+import (
+	"log"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ProtectAuditLog makes the audit log append only at the database level, so
+// entries cannot be changed or removed even through a bug in the backend.
+// The backend does not start without this protection.
+func ProtectAuditLog(db *gorm.DB) {
+	statements := []string{
+		`CREATE OR REPLACE FUNCTION audit_logs_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'audit_logs is append only';
+END;
+$$ LANGUAGE plpgsql`,
+		`DROP TRIGGER IF EXISTS audit_logs_append_only ON audit_logs`,
+		`CREATE TRIGGER audit_logs_append_only BEFORE UPDATE OR DELETE ON audit_logs
+	FOR EACH ROW EXECUTE PROCEDURE audit_logs_append_only()`,
+	}
+	for _, statement := range statements {
+		if err := db.Exec(statement).Error; err != nil {
+			log.Fatalf("Error protecting audit log: %v", err)
+		}
+	}
+}
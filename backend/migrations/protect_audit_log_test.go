@@ -0,0 +1,47 @@
+package migrations_test
+
+import (
+	"deforestation/migrations"
+	"deforestation/models"
+	"deforestation/testdb"
+	"testing"
+)
+
+func TestProtectAuditLog(t *testing.T) {
+	db := testdb.Open(t)
+
+	entry := models.AuditLog{Action: "user.login", Outcome: models.AuditSucceeded, Detail: "original"}
+	if err := db.Create(&entry).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// Migrations run on every start, the trigger is replaced without error
+	migrations.ProtectAuditLog(db)
+
+	tests := []struct {
+		name      string
+		statement string
+	}{
+		{"update", "UPDATE audit_logs SET detail = 'changed' WHERE id = ?"},
+		{"delete", "DELETE FROM audit_logs WHERE id = ?"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := db.Exec(tt.statement, entry.ID).Error; err == nil {
+				t.Fatal("the audit log accepted the statement")
+			}
+
+			var got models.AuditLog
+			if err := db.First(&got, entry.ID).Error; err != nil {
+				t.Fatal(err)
+			}
+			if got.Detail != "original" {
+				t.Errorf("detail = %q, want original", got.Detail)
+			}
+		})
+	}
+
+	if err := db.Create(&models.AuditLog{Action: "user.login", Outcome: models.AuditFailed}).Error; err != nil {
+		t.Errorf("appending an entry: %v", err)
+	}
+}
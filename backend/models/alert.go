@@ -0,0 +1,47 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Alert rule kinds
+const (
+	AlertKindAbsolute     = "absolute"
+	AlertKindWeekOverWeek = "week_over_week"
+	AlertKindCumulative   = "cumulative"
+)
+
+// Alert states
+const (
+	AlertStateOpen         = "open"
+	AlertStateAcknowledged = "acknowledged"
+	AlertStateResolved     = "resolved"
+)
+
+// AlertRule describes a threshold on DeforestedArea. A rule without an
+// AreaID applies to every area owned by the user.
+type AlertRule struct {
+	gorm.Model
+	UserID    uint    `gorm:"not null;index"`
+	AreaID    *uint   `gorm:"index"`
+	Kind      string  `gorm:"type:varchar(32);not null"`
+	Threshold float64 `gorm:"not null"`
+	Enabled   bool
+}
+
+type Alert struct {
+	gorm.Model
+	RuleID         uint    `gorm:"not null;index"`
+	UserID         uint    `gorm:"not null;index"`
+	AreaID         uint    `gorm:"not null;index"`
+	HistoryID      uint    `gorm:"not null"`
+	Kind           string  `gorm:"type:varchar(32);not null"`
+	Threshold      float64 `gorm:"not null"`
+	Value          float64 `gorm:"not null"`
+	State          string  `gorm:"type:varchar(16);not null;default:'open';index"`
+	Message        string  `gorm:"type:varchar(256)"`
+	AcknowledgedAt *time.Time
+	ResolvedAt     *time.Time
+}
@@ -0,0 +1,27 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Analysis run statuses
+const (
+	AnalysisRunRunning   = "running"
+	AnalysisRunSucceeded = "succeeded"
+	AnalysisRunFailed    = "failed"
+)
+
+// AnalysisRun records every attempt to capture and analyse an area,
+// including the ones that did not produce a history entry. Runs are stored
+// as running when they start, so they count against the quota right away.
+type AnalysisRun struct {
+	gorm.Model
+	AreaID     uint   `gorm:"not null;index"`
+	Status     string `gorm:"type:varchar(16);not null"`
+	Error      string `gorm:"type:text"`
+	HistoryID  *uint
+	StartedAt  time.Time
+	FinishedAt time.Time
+}
@@ -0,0 +1,28 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// API key scopes
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+)
+
+// APIKey authenticates a machine client on behalf of a user. Prefix is the
+// public part of the key used to look it up, only the SHA-256 hash of the
+// whole key is stored. Scopes holds a comma separated list of scopes.
+type APIKey struct {
+	gorm.Model
+	UserID     uint   `gorm:"not null;index"`
+	Name       string `gorm:"type:varchar(128);not null"`
+	Prefix     string `gorm:"type:varchar(16);not null;unique_index"`
+	KeyHash    string `gorm:"type:char(64);not null" json:"-"`
+	Scopes     string `gorm:"type:varchar(64);not null"`
+	LastUsedAt *time.Time
+	ExpiresAt  *time.Time
+	RevokedAt  *time.Time
+}
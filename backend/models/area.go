@@ -1,6 +1,10 @@
 package models
 
-import "github.com/jinzhu/gorm"
+import (
+	"math"
+
+	"github.com/jinzhu/gorm"
+)
 
 type Area struct {
 	gorm.Model
@@ -11,4 +15,22 @@ type Area struct {
 	BottomLeftLon  float64 `gorm:"not null"`
 	DeforestedArea float64 `gorm:"default:0.0"`
 	UserID         uint    `gorm:"not null"`
+	// OrganizationID shares the area with the members of an organization
+	OrganizationID *uint `gorm:"index"`
+}
+
+// SurfaceKm2 approximates the surface covered by the area's bounding box
+func (a Area) SurfaceKm2() float64 {
+	const earthRadiusKm = 6371.0
+	toRadians := func(deg float64) float64 { return deg * math.Pi / 180 }
+
+	latDistance := toRadians(a.TopRightLat - a.BottomLeftLat)
+	lonDistance := toRadians(a.TopRightLon - a.BottomLeftLon)
+	avgLat := toRadians((a.TopRightLat + a.BottomLeftLat) / 2)
+
+	h := math.Sin(latDistance/2) * math.Sin(latDistance/2)
+	latDistanceKm := earthRadiusKm * 2 * math.Atan2(math.Sqrt(h), math.Sqrt(1-h))
+	lonDistanceKm := earthRadiusKm * math.Abs(lonDistance) * math.Cos(avgLat)
+
+	return latDistanceKm * lonDistanceKm
 }
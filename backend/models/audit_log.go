@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// Audit log outcomes
+const (
+	AuditSucceeded = "succeeded"
+	AuditFailed    = "failed"
+	AuditDenied    = "denied"
+	AuditDeferred  = "deferred"
+)
+
+// AuditLog records a security relevant or data changing event. Entries are
+// only ever inserted, so the model has no update or soft delete columns.
+// ActorID is NULL for events of the scheduler and for logins to unknown
+// accounts, Username keeps the name that was given.
+type AuditLog struct {
+	ID             uint      `gorm:"primary_key"`
+	CreatedAt      time.Time `gorm:"not null;index"`
+	ActorID        *uint     `gorm:"index"`
+	Username       string    `gorm:"type:varchar(128)"`
+	Action         string    `gorm:"type:varchar(64);not null;index"`
+	ResourceType   string    `gorm:"type:varchar(32)"`
+	ResourceID     *uint
+	OrganizationID *uint  `gorm:"index"`
+	IP             string `gorm:"type:varchar(64)"`
+	Outcome        string `gorm:"type:varchar(16);not null"`
+	Detail         string `gorm:"type:varchar(512)"`
+}
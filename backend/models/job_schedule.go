@@ -1,6 +1,11 @@
 package models
 
+import "time"
+
 type JobSchedule struct {
 	ID     uint `gorm:"primary_key"`
 	AreaID uint `gorm:"not null"`
+	// NextRunAt is when a deferred run of the weekly job is retried, NULL
+	// when none is pending
+	NextRunAt *time.Time
 }
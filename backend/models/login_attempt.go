@@ -0,0 +1,12 @@
+package models
+
+import "github.com/jinzhu/gorm"
+
+// LoginAttempt records a password login, successful or not, for account and
+// client lockout
+type LoginAttempt struct {
+	gorm.Model
+	Username string `gorm:"type:varchar(128);not null;index"`
+	IP       string `gorm:"type:varchar(64);not null;index"`
+	Success  bool
+}
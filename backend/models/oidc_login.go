@@ -0,0 +1,17 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// OIDCLogin keeps the secrets of a single sign-on attempt until the identity
+// provider redirects back. It is deleted once used.
+type OIDCLogin struct {
+	gorm.Model
+	State     string    `gorm:"type:varchar(64);not null;unique_index"`
+	Nonce     string    `gorm:"type:varchar(64);not null"`
+	Verifier  string    `gorm:"type:varchar(64);not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+}
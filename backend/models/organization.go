@@ -0,0 +1,24 @@
+package models
+
+import "github.com/jinzhu/gorm"
+
+// Organization roles, from most to least privileged
+const (
+	RoleOwner  = "owner"
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+)
+
+// Organization groups users that monitor areas together
+type Organization struct {
+	gorm.Model
+	Name string `gorm:"type:varchar(128);not null"`
+}
+
+// Membership gives a user a role within an organization
+type Membership struct {
+	gorm.Model
+	OrganizationID uint   `gorm:"not null;unique_index:idx_membership_org_user"`
+	UserID         uint   `gorm:"not null;unique_index:idx_membership_org_user"`
+	Role           string `gorm:"type:varchar(16);not null"`
+}
@@ -0,0 +1,17 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// PasswordResetToken lets a user who forgot their password set a new one.
+// Tokens work once and expire quickly, only their SHA-256 hash is stored.
+type PasswordResetToken struct {
+	gorm.Model
+	UserID    uint      `gorm:"not null;index"`
+	TokenHash string    `gorm:"type:char(64);not null;unique_index"`
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt    *time.Time
+}
@@ -0,0 +1,15 @@
+package models
+
+import "github.com/jinzhu/gorm"
+
+// Quota overrides the default limits of a user, for their private areas,
+// or of an organization. Exactly one of UserID and OrganizationID is set;
+// NULL limits keep the default.
+type Quota struct {
+	gorm.Model
+	UserID              *uint `gorm:"unique_index"`
+	OrganizationID      *uint `gorm:"unique_index"`
+	MaxAreas            *int
+	MaxAreaKm2          *float64
+	MaxAnalysesPerMonth *int
+}
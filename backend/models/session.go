@@ -0,0 +1,29 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Session is one login of a user. Access tokens carry its ID, so revoking
+// the session invalidates them along with its refresh tokens.
+type Session struct {
+	gorm.Model
+	UserID     uint      `gorm:"not null;index"`
+	ExpiresAt  time.Time `gorm:"not null"`
+	RevokedAt  *time.Time
+	LastUsedAt time.Time
+	UserAgent  string `gorm:"type:varchar(256)"`
+	IP         string `gorm:"type:varchar(64)"`
+}
+
+// RefreshToken is a single use token exchanged for a new access token and
+// a new refresh token. Only its SHA-256 hash is stored.
+type RefreshToken struct {
+	gorm.Model
+	SessionID uint      `gorm:"not null;index"`
+	TokenHash string    `gorm:"type:char(64);not null;unique_index"`
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt    *time.Time
+}
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// TileUsage counts the requests made to the satellite tile API on one UTC
+// day, against its daily quota
+type TileUsage struct {
+	ID        uint      `gorm:"primary_key"`
+	Day       time.Time `gorm:"type:date;not null;unique_index"`
+	Requests  int       `gorm:"not null"`
+	UpdatedAt time.Time
+}
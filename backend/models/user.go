@@ -1,9 +1,22 @@
 package models
 
-import "github.com/jinzhu/gorm"
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
 
 type User struct {
 	gorm.Model
 	Username string `gorm:"unique;not null" json:"username"`
-	Password string `gorm:"not null" json:"password"`
+	Password string `gorm:"not null" json:"-"`
+	Email    string `gorm:"type:varchar(256)" json:"email"`
+	// EmailVerifiedAt is set when Email is known to belong to the user, as
+	// for addresses verified by the identity provider. Only such addresses
+	// link single sign-on accounts to local users.
+	EmailVerifiedAt *time.Time `json:"-"`
+	// OIDCIssuer and OIDCSubject link the user to an identity provider
+	// account. Both are NULL for local users.
+	OIDCIssuer  *string `gorm:"type:varchar(256);unique_index:idx_users_oidc" json:"-"`
+	OIDCSubject *string `gorm:"type:varchar(256);unique_index:idx_users_oidc" json:"-"`
 }
@@ -0,0 +1,27 @@
+package models
+
+import "github.com/jinzhu/gorm"
+
+// Webhook is a user registered HTTP endpoint receiving signed event payloads.
+// Events holds a comma separated list of subscribed event types.
+type Webhook struct {
+	gorm.Model
+	UserID uint   `gorm:"not null;index"`
+	URL    string `gorm:"type:varchar(512);not null"`
+	Secret string `gorm:"type:varchar(128);not null" json:"-"`
+	Events string `gorm:"type:varchar(256);not null"`
+	Active bool
+}
+
+// WebhookDelivery records a single delivery attempt of an event to a webhook
+type WebhookDelivery struct {
+	gorm.Model
+	WebhookID  uint   `gorm:"not null;index"`
+	EventID    string `gorm:"type:varchar(64);not null;index"`
+	Event      string `gorm:"type:varchar(64);not null"`
+	Attempt    int    `gorm:"not null"`
+	StatusCode int
+	Success    bool
+	Error      string `gorm:"type:text"`
+	Payload    string `gorm:"type:text"`
+}
@@ -0,0 +1,190 @@
+package notifications
+
+import (
+	"bytes"
+	"context"
+	"deforestation/auth"
+	"deforestation/authz"
+	"deforestation/models"
+	"deforestation/storage"
+	"fmt"
+	"html/template"
+	"image/jpeg"
+
+	"github.com/disintegration/imaging"
+	"github.com/jinzhu/gorm"
+)
+
+const thumbnailWidth = 320
+
+// EmailContent is implemented by event payloads that render their own mail
+// body, such as the weekly digest. The notifier appends before/after
+// thumbnails for every area listed by EmailAreaIDs.
+type EmailContent interface {
+	EmailSubject() string
+	EmailHTML() (string, error)
+	EmailAreaIDs() []uint
+}
+
+// EmailNotifier mails alerts and digests to the address of the event's user
+type EmailNotifier struct {
+	DB     *gorm.DB
+	Store  storage.BlobStore
+	Config SMTPConfig
+}
+
+func NewEmailNotifier(db *gorm.DB, store storage.BlobStore, cfg SMTPConfig) *EmailNotifier {
+	return &EmailNotifier{DB: db, Store: store, Config: cfg}
+}
+
+func (n *EmailNotifier) Notify(event Event) error {
+	var subject, body string
+	var areaIDs []uint
+
+	switch data := event.Data.(type) {
+	case AlertPayload:
+		var buf bytes.Buffer
+		if err := alertTemplate.Execute(&buf, data); err != nil {
+			return err
+		}
+		subject = "Deforestation alert: " + data.AreaName
+		body = buf.String()
+		areaIDs = []uint{data.AreaID}
+	case EmailContent:
+		html, err := data.EmailHTML()
+		if err != nil {
+			return err
+		}
+		subject = data.EmailSubject()
+		body = html
+		areaIDs = data.EmailAreaIDs()
+	default:
+		return nil
+	}
+
+	if ok, err := deliverable(n.DB, event); !ok || err != nil {
+		return err
+	}
+
+	var user models.User
+	if err := n.DB.First(&user, event.UserID).Error; err != nil {
+		return err
+	}
+	if user.Email == "" {
+		return nil
+	}
+
+	mail := Mail{To: []string{user.Email}, Subject: subject, HTML: body}
+	for _, areaID := range areaIDs {
+		// Never show captures of areas the user no longer has access to
+		readable, err := authz.CanRead(n.DB, user.ID, areaID)
+		if err != nil {
+			return err
+		}
+		if !readable {
+			continue
+		}
+		section, images, err := n.areaSection(areaID)
+		if err != nil {
+			return err
+		}
+		mail.HTML += section
+		mail.Images = append(mail.Images, images...)
+	}
+
+	return n.Config.Send(mail)
+}
+
+type thumbnailView struct {
+	Label     string
+	Date      string
+	ContentID string
+	ImageURL  string
+}
+
+type areaView struct {
+	AreaName   string
+	Link       string
+	Thumbnails []thumbnailView
+}
+
+// areaSection renders the before/after thumbnails of the latest two captures
+// of an area along with a link back to the area in the web app
+func (n *EmailNotifier) areaSection(areaID uint) (string, []InlineImage, error) {
+	var area models.Area
+	if err := n.DB.First(&area, areaID).Error; err != nil {
+		return "", nil, err
+	}
+
+	var histories []models.History
+	if err := n.DB.Where("area_id = ?", areaID).Order("date desc").Limit(2).Find(&histories).Error; err != nil {
+		return "", nil, err
+	}
+
+	view := areaView{
+		AreaName: area.AreaName,
+		Link:     fmt.Sprintf("%s/areas/%d", n.Config.BaseURL, area.ID),
+	}
+
+	var images []InlineImage
+	labels := []string{"After", "Before"}
+	for i := len(histories) - 1; i >= 0; i-- {
+		history := histories[i]
+		data, err := n.thumbnail(history.ImagePath)
+		if err != nil {
+			// A missing capture should not prevent the mail from going out
+			continue
+		}
+		cid := fmt.Sprintf("history-%d@deforestation", history.ID)
+		images = append(images, InlineImage{ContentID: cid, ContentType: "image/jpeg", Data: data})
+		view.Thumbnails = append(view.Thumbnails, thumbnailView{
+			Label:     labels[i],
+			Date:      history.Date.Format("2006-01-02"),
+			ContentID: cid,
+			ImageURL:  n.imageURL(history.ImagePath),
+		})
+	}
+
+	var buf bytes.Buffer
+	if err := areaTemplate.Execute(&buf, view); err != nil {
+		return "", nil, err
+	}
+	return buf.String(), images, nil
+}
+
+// imageURL returns a signed link to the full size image, or an empty string
+// when the public address of the API is unknown. Like every signed URL it
+// expires after auth.MaxImageURLTTL, the area link keeps working after that.
+func (n *EmailNotifier) imageURL(key string) string {
+	if n.Config.APIURL == "" {
+		return ""
+	}
+	url, _ := auth.SignImageURL(key, auth.MaxImageURLTTL)
+	return n.Config.APIURL + url
+}
+
+func (n *EmailNotifier) thumbnail(key string) ([]byte, error) {
+	img, err := storage.DecodeImage(context.Background(), n.Store, key)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, imaging.Resize(img, thumbnailWidth, 0, imaging.Lanczos), &jpeg.Options{Quality: 80}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+var alertTemplate = template.Must(template.New("alert").Parse(`
+<h2>Deforestation alert for {{.AreaName}}</h2>
+<p>{{.Message}}</p>
+<p>Measured value: <strong>{{printf "%.2f" .Value}}%</strong> (threshold {{printf "%.2f" .Threshold}}%)</p>
+`))
+
+var areaTemplate = template.Must(template.New("area").Parse(`
+<h3><a href="{{.Link}}">{{.AreaName}}</a></h3>
+{{if .Thumbnails}}<table><tr>
+{{range .Thumbnails}}<td><p>{{.Label}} ({{.Date}})</p>{{if .ImageURL}}<a href="{{.ImageURL}}">{{end}}<img src="cid:{{.ContentID}}" width="320" alt="{{.Label}}">{{if .ImageURL}}</a>{{end}}</td>
+{{end}}</tr></table>{{else}}<p>No captures available yet.</p>{{end}}
+`))
@@ -0,0 +1,117 @@
+package notifications
+
+import (
+	"crypto/rand"
+	"deforestation/authz"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Event types published by the backend
+const (
+	EventAnalysisCompleted = "analysis.completed"
+	EventAnalysisFailed    = "analysis.failed"
+	EventAlertFired        = "alert.fired"
+	EventDigestWeekly      = "digest.weekly"
+	EventWebhookPing       = "webhook.ping"
+)
+
+// Event is a notification addressed to one user. Events about an area are
+// only delivered while that user may still read the area.
+type Event struct {
+	ID         string      `json:"id"`
+	Type       string      `json:"type"`
+	UserID     uint        `json:"-"`
+	AreaID     uint        `json:"area_id,omitempty"`
+	OccurredAt time.Time   `json:"occurred_at"`
+	Data       interface{} `json:"data"`
+}
+
+// AnalysisPayload is the data of analysis.completed and analysis.failed events
+type AnalysisPayload struct {
+	AreaID          uint       `json:"area_id"`
+	AreaName        string     `json:"area_name"`
+	HistoryID       uint       `json:"history_id,omitempty"`
+	Date            *time.Time `json:"date,omitempty"`
+	DeforestedArea  float64    `json:"deforested_area"`
+	ImagePath       string     `json:"image_path,omitempty"`
+	MaskedImagePath string     `json:"masked_image_path,omitempty"`
+	Error           string     `json:"error,omitempty"`
+}
+
+// AlertPayload is the data of alert.fired events
+type AlertPayload struct {
+	AlertID   uint    `json:"alert_id"`
+	RuleID    uint    `json:"rule_id"`
+	AreaID    uint    `json:"area_id"`
+	AreaName  string  `json:"area_name"`
+	HistoryID uint    `json:"history_id"`
+	Kind      string  `json:"kind"`
+	Threshold float64 `json:"threshold"`
+	Value     float64 `json:"value"`
+	Message   string  `json:"message"`
+}
+
+// Notifier delivers events through a notification channel
+type Notifier interface {
+	Notify(event Event) error
+}
+
+var (
+	mu        sync.RWMutex
+	notifiers []Notifier
+)
+
+// Register adds a notification channel that receives every published event
+func Register(n Notifier) {
+	mu.Lock()
+	defer mu.Unlock()
+	notifiers = append(notifiers, n)
+}
+
+// Publish hands the event to every registered channel in the background
+func Publish(event Event) {
+	event = Prepare(event)
+
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, n := range notifiers {
+		go func(n Notifier) {
+			if err := n.Notify(event); err != nil {
+				log.Printf("Error delivering %s event %s: %v", event.Type, event.ID, err)
+			}
+		}(n)
+	}
+}
+
+// Prepare assigns an ID and timestamp to events that do not have one yet
+func Prepare(event Event) Event {
+	if event.ID == "" {
+		event.ID = newEventID()
+	}
+	if event.OccurredAt.IsZero() {
+		event.OccurredAt = time.Now().UTC()
+	}
+	return event
+}
+
+// deliverable reports whether the user the event is addressed to may still
+// read its area
+func deliverable(db *gorm.DB, event Event) (bool, error) {
+	if event.AreaID == 0 {
+		return true, nil
+	}
+	return authz.CanRead(db, event.UserID, event.AreaID)
+}
+
+func newEventID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return time.Now().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(b)
+}
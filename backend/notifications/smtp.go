@@ -0,0 +1,148 @@
+package notifications
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+// SMTPConfig holds the settings of the outgoing mail server
+type SMTPConfig struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+	// BaseURL is the address of the web app, used to link back to areas
+	BaseURL string
+	// APIURL is the public address of the API. When set, thumbnails link to
+	// the full size capture through a signed image URL.
+	APIURL string
+}
+
+// SMTPConfigFromEnv reads the SMTP_*, APP_BASE_URL and API_BASE_URL
+// environment variables
+func SMTPConfigFromEnv() SMTPConfig {
+	cfg := SMTPConfig{
+		Host:     os.Getenv("SMTP_HOST"),
+		Port:     os.Getenv("SMTP_PORT"),
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     os.Getenv("SMTP_FROM"),
+		BaseURL:  strings.TrimRight(os.Getenv("APP_BASE_URL"), "/"),
+		APIURL:   strings.TrimRight(os.Getenv("API_BASE_URL"), "/"),
+	}
+	if cfg.Port == "" {
+		cfg.Port = "25"
+	}
+	if cfg.From == "" {
+		cfg.From = "deforestation-tracker@localhost"
+	}
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = "http://localhost:5173"
+	}
+	return cfg
+}
+
+// Enabled reports whether an SMTP server is configured
+func (c SMTPConfig) Enabled() bool {
+	return c.Host != ""
+}
+
+// InlineImage is an image embedded in an HTML mail and referenced with
+// src="cid:<ContentID>"
+type InlineImage struct {
+	ContentID   string
+	ContentType string
+	Data        []byte
+}
+
+// Mail is an HTML message with optional inline images
+type Mail struct {
+	To      []string
+	Subject string
+	HTML    string
+	Images  []InlineImage
+}
+
+// Send delivers the mail through the configured SMTP server
+func (c SMTPConfig) Send(m Mail) error {
+	msg, err := c.compose(m)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if c.Username != "" {
+		auth = smtp.PlainAuth("", c.Username, c.Password, c.Host)
+	}
+
+	return smtp.SendMail(c.Host+":"+c.Port, auth, c.From, m.To, msg)
+}
+
+func (c SMTPConfig) compose(m Mail) ([]byte, error) {
+	var buf bytes.Buffer
+	body := multipart.NewWriter(&buf)
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", "text/html; charset=UTF-8")
+	header.Set("Content-Transfer-Encoding", "base64")
+	part, err := body.CreatePart(header)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeBase64(part, []byte(m.HTML)); err != nil {
+		return nil, err
+	}
+
+	for _, img := range m.Images {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", img.ContentType)
+		header.Set("Content-Transfer-Encoding", "base64")
+		header.Set("Content-ID", "<"+img.ContentID+">")
+		header.Set("Content-Disposition", "inline; filename=\""+img.ContentID+"\"")
+		part, err := body.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeBase64(part, img.Data); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", c.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(m.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("UTF-8", m.Subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/related;\r\n\tboundary=%q\r\n\r\n", body.Boundary())
+	msg.Write(buf.Bytes())
+
+	return msg.Bytes(), nil
+}
+
+// writeBase64 writes data base64 encoded in lines of 76 characters
+func writeBase64(w io.Writer, data []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		if _, err := w.Write([]byte(encoded[:76] + "\r\n")); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err := w.Write([]byte(encoded + "\r\n"))
+	return err
+}
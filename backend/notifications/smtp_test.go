@@ -0,0 +1,184 @@
+package notifications
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpMessage is a message received by the SMTP stand-in
+type smtpMessage struct {
+	from string
+	to   []string
+	data []byte
+}
+
+// serveSMTP accepts one SMTP session on a local port, without extensions,
+// and returns the port and the received message
+func serveSMTP(t *testing.T) (string, <-chan smtpMessage) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	received := make(chan smtpMessage, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+		r := textproto.NewReader(bufio.NewReader(conn))
+		reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+
+		var msg smtpMessage
+		reply("220 localhost ESMTP")
+		for {
+			line, err := r.ReadLine()
+			if err != nil {
+				return
+			}
+			command := strings.ToUpper(line)
+			switch {
+			case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+				reply("250 localhost")
+			case strings.HasPrefix(command, "MAIL FROM:"):
+				msg.from = strings.Trim(line[len("MAIL FROM:"):], "<>")
+				reply("250 OK")
+			case strings.HasPrefix(command, "RCPT TO:"):
+				msg.to = append(msg.to, strings.Trim(line[len("RCPT TO:"):], "<>"))
+				reply("250 OK")
+			case command == "DATA":
+				reply("354 End data with <CR><LF>.<CR><LF>")
+				if msg.data, err = r.ReadDotBytes(); err != nil {
+					return
+				}
+				reply("250 OK")
+			case command == "QUIT":
+				reply("221 Bye")
+				received <- msg
+				return
+			default:
+				reply("502 Command not implemented")
+			}
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port, received
+}
+
+func TestSMTPSend(t *testing.T) {
+	port, received := serveSMTP(t)
+	cfg := SMTPConfig{Host: "127.0.0.1", Port: port, From: "tracker@example.com"}
+
+	html := "<p>Área norte lost " + strings.Repeat("forest ", 40) + "</p><img src=\"cid:after-7\">"
+	png := bytes.Repeat([]byte{0x89, 'P', 'N', 'G', 0, 1, 2, 0xff}, 50)
+	err := cfg.Send(Mail{
+		To:      []string{"ana@example.com", "bo@example.com"},
+		Subject: "Deforestation alert: Área norte",
+		HTML:    html,
+		Images:  []InlineImage{{ContentID: "after-7", ContentType: "image/png", Data: png}},
+	})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	var msg smtpMessage
+	select {
+	case msg = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the SMTP server received no message")
+	}
+
+	if msg.from != "tracker@example.com" || strings.Join(msg.to, ",") != "ana@example.com,bo@example.com" {
+		t.Errorf("envelope from %q to %q", msg.from, msg.to)
+	}
+	for _, line := range strings.Split(string(msg.data), "\n") {
+		if len(strings.TrimSuffix(line, "\r")) > 78 {
+			t.Errorf("line longer than 78 characters: %q", line)
+		}
+	}
+
+	parsed, err := mail.ReadMessage(bytes.NewReader(msg.data))
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	header := parsed.Header
+	if header.Get("From") != "tracker@example.com" || header.Get("To") != "ana@example.com, bo@example.com" {
+		t.Errorf("From %q, To %q", header.Get("From"), header.Get("To"))
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(header.Get("Subject"))
+	if err != nil || subject != "Deforestation alert: Área norte" {
+		t.Errorf("Subject = %q (%q), %v", subject, header.Get("Subject"), err)
+	}
+	if _, err := header.Date(); err != nil {
+		t.Errorf("Date: %v", err)
+	}
+	if header.Get("MIME-Version") != "1.0" {
+		t.Errorf("MIME-Version = %q", header.Get("MIME-Version"))
+	}
+
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/related" {
+		t.Fatalf("Content-Type = %q, %v", header.Get("Content-Type"), err)
+	}
+
+	parts := multipart.NewReader(parsed.Body, params["boundary"])
+	decode := func(part *multipart.Part) []byte {
+		t.Helper()
+		if part.Header.Get("Content-Transfer-Encoding") != "base64" {
+			t.Fatalf("part %q is not base64 encoded", part.Header.Get("Content-Type"))
+		}
+		data, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, part))
+		if err != nil {
+			t.Fatalf("decoding part %q: %v", part.Header.Get("Content-Type"), err)
+		}
+		return data
+	}
+
+	body, err := parts.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := body.Header.Get("Content-Type"); got != "text/html; charset=UTF-8" {
+		t.Errorf("body Content-Type = %q", got)
+	}
+	if got := decode(body); string(got) != html {
+		t.Errorf("body = %q", got)
+	}
+
+	image, err := parts.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := image.Header.Get("Content-Type"); got != "image/png" {
+		t.Errorf("image Content-Type = %q", got)
+	}
+	if got := image.Header.Get("Content-ID"); got != "<after-7>" {
+		t.Errorf("Content-ID = %q", got)
+	}
+	if disposition, _, err := mime.ParseMediaType(image.Header.Get("Content-Disposition")); err != nil || disposition != "inline" {
+		t.Errorf("Content-Disposition = %q", image.Header.Get("Content-Disposition"))
+	}
+	if got := decode(image); !bytes.Equal(got, png) {
+		t.Errorf("image data differs, %d bytes", len(got))
+	}
+
+	if _, err := parts.NextPart(); err != io.EOF {
+		t.Errorf("unexpected third part: %v", err)
+	}
+}
@@ -0,0 +1,250 @@
+package notifications
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"deforestation/models"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Headers sent with every webhook delivery
+const (
+	SignatureHeader = "X-Deforestation-Signature"
+	TimestampHeader = "X-Deforestation-Timestamp"
+	EventHeader     = "X-Deforestation-Event"
+	DeliveryHeader  = "X-Deforestation-Delivery"
+)
+
+// WebhookEvents lists the event types a webhook can subscribe to
+var WebhookEvents = []string{EventAnalysisCompleted, EventAnalysisFailed, EventAlertFired, EventDigestWeekly}
+
+// WebhookNotifier posts events to the webhooks registered by the event's user
+type WebhookNotifier struct {
+	DB          *gorm.DB
+	Client      *http.Client
+	MaxAttempts int
+	Backoff     time.Duration
+}
+
+func NewWebhookNotifier(db *gorm.DB) *WebhookNotifier {
+	return &WebhookNotifier{
+		DB:          db,
+		Client:      webhookClient(10*time.Second, AllowPrivateTargetsFromEnv()),
+		MaxAttempts: 5,
+		Backoff:     2 * time.Second,
+	}
+}
+
+// ErrNonPublicAddress is returned for webhook deliveries to an address
+// inside the backend's network
+var ErrNonPublicAddress = errors.New("webhook address is not public")
+
+// nonPublicRanges are special purpose ranges not covered by the net.IP
+// predicates, such as carrier-grade NAT
+var nonPublicRanges = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+}
+
+// AllowPrivateTargetsFromEnv reads WEBHOOK_ALLOW_PRIVATE_TARGETS, which lets
+// webhooks reach loopback and private addresses. It is meant for setups
+// whose receivers run next to the backend, and is off unless set to true.
+func AllowPrivateTargetsFromEnv() bool {
+	return os.Getenv("WEBHOOK_ALLOW_PRIVATE_TARGETS") == "true"
+}
+
+// webhookClient returns an HTTP client that only connects to public
+// addresses unless allowPrivate is set. The check runs on the resolved
+// address of every connection, redirects included, so a webhook host
+// resolving to an internal address cannot be used to reach services next to
+// the backend. Proxies from the environment are not used, they would
+// connect in the client's place.
+func webhookClient(timeout time.Duration, allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second, Control: publicOnly}
+	if allowPrivate {
+		dialer.Control = nil
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
+
+func publicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !publicAddr(addr) {
+		return fmt.Errorf("%w: %s", ErrNonPublicAddress, host)
+	}
+	return nil
+}
+
+func publicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() {
+		return false
+	}
+	for _, prefix := range nonPublicRanges {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+func (n *WebhookNotifier) Notify(event Event) error {
+	if ok, err := deliverable(n.DB, event); !ok || err != nil {
+		return err
+	}
+
+	var hooks []models.Webhook
+	if err := n.DB.Where("user_id = ? AND active = ?", event.UserID, true).Find(&hooks).Error; err != nil {
+		return err
+	}
+
+	var failed []string
+	for _, hook := range hooks {
+		if !Subscribed(hook, event.Type) {
+			continue
+		}
+		if err := n.Deliver(hook, event); err != nil {
+			failed = append(failed, fmt.Sprintf("webhook %d: %v", hook.ID, err))
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// Deliver posts the event to a single webhook, retrying with exponential
+// backoff on network errors, 429 and 5xx responses. Every attempt is logged
+// as a WebhookDelivery.
+func (n *WebhookNotifier) Deliver(hook models.Webhook, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= n.MaxAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(n.Backoff * time.Duration(1<<(attempt-2)))
+		}
+
+		status, err := n.post(hook, event, body)
+		delivery := models.WebhookDelivery{
+			WebhookID:  hook.ID,
+			EventID:    event.ID,
+			Event:      event.Type,
+			Attempt:    attempt,
+			StatusCode: status,
+			Success:    err == nil,
+			Payload:    string(body),
+		}
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+		n.DB.Create(&delivery)
+
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+
+		if status != 0 && status != http.StatusTooManyRequests && status < 500 {
+			break
+		}
+	}
+
+	return lastErr
+}
+
+func (n *WebhookNotifier) post(hook models.Webhook, event Event, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, event.Type)
+	req.Header.Set(DeliveryHeader, event.ID)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, "sha256="+Sign(hook.Secret, timestamp, body))
+
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("endpoint returned status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// Sign computes the hex encoded HMAC-SHA256 of "<timestamp>.<body>". Receivers
+// recompute it with their secret to verify the payload.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Subscribed reports whether the webhook filters include the event type.
+// Ping events are always delivered.
+func Subscribed(hook models.Webhook, eventType string) bool {
+	if eventType == EventWebhookPing {
+		return true
+	}
+	for _, e := range strings.Split(hook.Events, ",") {
+		if strings.TrimSpace(e) == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidWebhookEvent reports whether a webhook can subscribe to the event type
+func ValidWebhookEvent(eventType string) bool {
+	for _, e := range WebhookEvents {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,198 @@
+package notifications
+
+import (
+	"deforestation/models"
+	"deforestation/testdb"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"127.8.8.8", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fc00::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"100.64.0.1", false},
+		{"224.0.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"64:ff9b::a00:1", false},
+	}
+	for _, tt := range tests {
+		if got := publicAddr(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("publicAddr(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestWebhookClientRefusesInternalAddresses(t *testing.T) {
+	t.Setenv("WEBHOOK_ALLOW_PRIVATE_TARGETS", "")
+	reached := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+	defer server.Close()
+
+	notifier := NewWebhookNotifier(nil)
+	status, err := notifier.post(models.Webhook{URL: server.URL}, Prepare(Event{Type: EventWebhookPing}), []byte("{}"))
+	if !errors.Is(err, ErrNonPublicAddress) {
+		t.Errorf("post to %s = %d, %v, want ErrNonPublicAddress", server.URL, status, err)
+	}
+	if reached {
+		t.Error("the request reached the loopback server")
+	}
+}
+
+func TestWebhookClientAllowsPrivateTargetsWhenEnabled(t *testing.T) {
+	t.Setenv("WEBHOOK_ALLOW_PRIVATE_TARGETS", "true")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	notifier := NewWebhookNotifier(nil)
+	status, err := notifier.post(models.Webhook{URL: server.URL}, Prepare(Event{Type: EventWebhookPing}), []byte("{}"))
+	if err != nil || status != http.StatusOK {
+		t.Errorf("post to %s = %d, %v, want 200", server.URL, status, err)
+	}
+}
+
+// webhookReceiver answers with the queued status codes, then 200
+type webhookReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	body, _ := io.ReadAll(req.Body)
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, body)
+
+	status := http.StatusOK
+	if len(r.statuses) > 0 {
+		status, r.statuses = r.statuses[0], r.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func TestDeliver(t *testing.T) {
+	db := testdb.Open(t)
+
+	tests := []struct {
+		name      string
+		statuses  []int
+		attempts  int
+		delivered bool
+	}{
+		{"first attempt", nil, 1, true},
+		{"retries server errors", []int{500, 503}, 3, true},
+		{"retries rate limiting", []int{429}, 2, true},
+		{"gives up after the last attempt", []int{500, 500, 500}, 3, false},
+		{"does not retry client errors", []int{410}, 1, false},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receiver := &webhookReceiver{statuses: tt.statuses}
+			server := httptest.NewServer(receiver)
+			defer server.Close()
+
+			notifier := &WebhookNotifier{DB: db, Client: server.Client(), MaxAttempts: 3, Backoff: time.Millisecond}
+			hook := models.Webhook{URL: server.URL + "/hook", Secret: "s3cret", Events: EventAnalysisCompleted, Active: true}
+			hook.ID = uint(i + 1)
+			event := Prepare(Event{Type: EventAnalysisCompleted, AreaID: 7, Data: AnalysisPayload{AreaID: 7, AreaName: "North"}})
+
+			err := notifier.Deliver(hook, event)
+			if (err == nil) != tt.delivered {
+				t.Fatalf("Deliver = %v, want delivered %v", err, tt.delivered)
+			}
+			if len(receiver.requests) != tt.attempts {
+				t.Fatalf("%d requests, want %d", len(receiver.requests), tt.attempts)
+			}
+
+			for n, req := range receiver.requests {
+				timestamp := req.Header.Get(TimestampHeader)
+				if _, err := strconv.ParseInt(timestamp, 10, 64); err != nil {
+					t.Errorf("attempt %d timestamp = %q", n+1, timestamp)
+				}
+				if got, want := req.Header.Get(SignatureHeader), "sha256="+Sign("s3cret", timestamp, receiver.bodies[n]); got != want {
+					t.Errorf("attempt %d signature = %q, want %q", n+1, got, want)
+				}
+				if req.Header.Get(EventHeader) != EventAnalysisCompleted || req.Header.Get(DeliveryHeader) != event.ID {
+					t.Errorf("attempt %d event headers = %q, %q", n+1, req.Header.Get(EventHeader), req.Header.Get(DeliveryHeader))
+				}
+				if string(receiver.bodies[n]) != string(receiver.bodies[0]) {
+					t.Errorf("attempt %d body differs from the first", n+1)
+				}
+			}
+
+			var deliveries []models.WebhookDelivery
+			if err := db.Where("webhook_id = ?", hook.ID).Order("attempt").Find(&deliveries).Error; err != nil {
+				t.Fatal(err)
+			}
+			if len(deliveries) != tt.attempts {
+				t.Fatalf("%d deliveries logged, want %d", len(deliveries), tt.attempts)
+			}
+			for n, delivery := range deliveries {
+				last := n == len(deliveries)-1
+				wantStatus := http.StatusOK
+				if n < len(tt.statuses) {
+					wantStatus = tt.statuses[n]
+				}
+				if delivery.Attempt != n+1 || delivery.EventID != event.ID || delivery.StatusCode != wantStatus ||
+					delivery.Success != (last && tt.delivered) || delivery.Payload != string(receiver.bodies[n]) {
+					t.Errorf("delivery %d = %+v", n+1, delivery)
+				}
+				if !delivery.Success && delivery.Error == "" {
+					t.Errorf("failed delivery %d has no error", n+1)
+				}
+			}
+		})
+	}
+}
+
+func TestDeliverBacksOff(t *testing.T) {
+	db := testdb.Open(t)
+	receiver := &webhookReceiver{statuses: []int{500, 500}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	notifier := &WebhookNotifier{DB: db, Client: server.Client(), MaxAttempts: 3, Backoff: 20 * time.Millisecond}
+	start := time.Now()
+	if err := notifier.Deliver(models.Webhook{URL: server.URL}, Prepare(Event{Type: EventWebhookPing})); err != nil {
+		t.Fatal(err)
+	}
+	// 20ms before the second attempt, 40ms before the third
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("three attempts took %v, want at least 60ms of backoff", elapsed)
+	}
+}
+
+func TestSign(t *testing.T) {
+	// echo -n '1700000000.{"id":"1"}' | openssl dgst -sha256 -hmac secret
+	want := "086f6aff7bd084c98679825129c5a64dbad88c760016d6d2c0fb123f27951d54"
+	if got := Sign("secret", "1700000000", []byte(`{"id":"1"}`)); got != want {
+		t.Errorf("Sign = %q, want %q", got, want)
+	}
+}
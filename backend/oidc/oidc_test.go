@@ -0,0 +1,294 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const testClientID = "deforestation"
+
+// mockIssuer is a minimal identity provider serving discovery, its keys
+// and a token endpoint that answers with a prepared ID token
+type mockIssuer struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	keys        map[string]*rsa.PrivateKey
+	idToken     string
+	tokenForm   url.Values
+	jwksFetches int
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+	m := &mockIssuer{keys: map[string]*rsa.PrivateKey{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(metadata{
+			Issuer:                m.URL,
+			AuthorizationEndpoint: m.URL + "/authorize",
+			TokenEndpoint:         m.URL + "/token",
+			JWKSURI:               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.jwksFetches++
+
+		var doc struct {
+			Keys []jsonWebKey `json:"keys"`
+		}
+		for kid, key := range m.keys {
+			doc.Keys = append(doc.Keys, jsonWebKey{
+				Kty: "RSA",
+				Kid: kid,
+				Use: "sig",
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(doc)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.tokenForm = r.PostForm
+		json.NewEncoder(w).Encode(map[string]string{"id_token": m.idToken})
+	})
+
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// addKey publishes a new RSA key under kid and returns it
+func (m *mockIssuer) addKey(t *testing.T, kid string) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys[kid] = key
+	return key
+}
+
+func (m *mockIssuer) fetches() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.jwksFetches
+}
+
+func (m *mockIssuer) provider() *Provider {
+	return NewProvider(Config{
+		Issuer:      m.URL,
+		ClientID:    testClientID,
+		RedirectURL: "http://localhost/auth/oidc/callback",
+		Scopes:      []string{"openid", "email"},
+	})
+}
+
+// claims returns valid ID token claims for the nonce
+func (m *mockIssuer) claims(nonce string) jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":            m.URL,
+		"sub":            "subject-1",
+		"aud":            testClientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"nonce":          nonce,
+		"email":          "ana@example.com",
+		"email_verified": true,
+	}
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestExchange(t *testing.T) {
+	issuer := newMockIssuer(t)
+	key := issuer.addKey(t, "key-1")
+	provider := issuer.provider()
+
+	req, err := NewAuthRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authURL, err := provider.AuthCodeURL(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := sha256.Sum256([]byte(req.Verifier))
+	if got := parsed.Query().Get("code_challenge"); got != base64.RawURLEncoding.EncodeToString(challenge[:]) {
+		t.Errorf("code_challenge = %q, does not match the verifier", got)
+	}
+	if got := parsed.Query().Get("nonce"); got != req.Nonce {
+		t.Errorf("nonce = %q, want %q", got, req.Nonce)
+	}
+
+	issuer.idToken = sign(t, jwt.SigningMethodRS256, key, "key-1", issuer.claims(req.Nonce))
+
+	identity, err := provider.Exchange(context.Background(), "code-1", req)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	want := Identity{Issuer: issuer.URL, Subject: "subject-1", Email: "ana@example.com", EmailVerified: true}
+	if *identity != want {
+		t.Errorf("identity = %+v, want %+v", *identity, want)
+	}
+
+	if got := issuer.tokenForm.Get("code"); got != "code-1" {
+		t.Errorf("token request code = %q", got)
+	}
+	if got := issuer.tokenForm.Get("code_verifier"); got != req.Verifier {
+		t.Errorf("token request code_verifier = %q, want %q", got, req.Verifier)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	issuer := newMockIssuer(t)
+	key := issuer.addKey(t, "key-1")
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	with := func(name string, value interface{}) jwt.MapClaims {
+		claims := issuer.claims("nonce-1")
+		claims[name] = value
+		return claims
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		nonce string
+	}{
+		{"wrong issuer", sign(t, jwt.SigningMethodRS256, key, "key-1", with("iss", "https://evil.example.com")), "nonce-1"},
+		{"wrong audience", sign(t, jwt.SigningMethodRS256, key, "key-1", with("aud", "another-client")), "nonce-1"},
+		{"other authorized party", sign(t, jwt.SigningMethodRS256, key, "key-1", with("azp", "another-client")), "nonce-1"},
+		{"nonce mismatch", sign(t, jwt.SigningMethodRS256, key, "key-1", issuer.claims("nonce-2")), "nonce-1"},
+		{"missing nonce", sign(t, jwt.SigningMethodRS256, key, "key-1", issuer.claims("")), ""},
+		{"expired", sign(t, jwt.SigningMethodRS256, key, "key-1", with("exp", time.Now().Add(-2*clockSkew).Unix())), "nonce-1"},
+		{"issued in the future", sign(t, jwt.SigningMethodRS256, key, "key-1", with("iat", time.Now().Add(2*clockSkew).Unix())), "nonce-1"},
+		{"no subject", sign(t, jwt.SigningMethodRS256, key, "key-1", with("sub", "")), "nonce-1"},
+		{"alg does not match the key", sign(t, jwt.SigningMethodES256, ecKey, "key-1", issuer.claims("nonce-1")), "nonce-1"},
+		{"alg none", sign(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "key-1", issuer.claims("nonce-1")), "nonce-1"},
+		{"signed by another key", sign(t, jwt.SigningMethodRS256, issuer.addKey(t, "key-3"), "key-1", issuer.claims("nonce-1")), "nonce-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := issuer.provider().Verify(context.Background(), tt.token, tt.nonce); err == nil {
+				t.Error("Verify accepted the token")
+			}
+		})
+	}
+
+	// A valid token with the same keys passes, so the cases above fail for
+	// the reason they name
+	valid := sign(t, jwt.SigningMethodRS256, key, "key-1", issuer.claims("nonce-1"))
+	if _, err := issuer.provider().Verify(context.Background(), valid, "nonce-1"); err != nil {
+		t.Errorf("Verify rejected a valid token: %v", err)
+	}
+}
+
+func TestVerifyAudienceList(t *testing.T) {
+	issuer := newMockIssuer(t)
+	key := issuer.addKey(t, "key-1")
+
+	claims := issuer.claims("nonce-1")
+	claims["aud"] = []string{"another-client", testClientID}
+	claims["azp"] = testClientID
+	token := sign(t, jwt.SigningMethodRS256, key, "key-1", claims)
+
+	if _, err := issuer.provider().Verify(context.Background(), token, "nonce-1"); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+}
+
+func TestVerifyRefreshesKeysForUnknownKid(t *testing.T) {
+	issuer := newMockIssuer(t)
+	oldKey := issuer.addKey(t, "key-1")
+	provider := issuer.provider()
+	ctx := context.Background()
+
+	if _, err := provider.Verify(ctx, sign(t, jwt.SigningMethodRS256, oldKey, "key-1", issuer.claims("n")), "n"); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if got := issuer.fetches(); got != 1 {
+		t.Fatalf("key set fetched %d times, want 1", got)
+	}
+
+	// The provider rotates its key. A token naming the new kid right after
+	// the last fetch does not trigger another one.
+	newKey := issuer.addKey(t, "key-2")
+	rotated := sign(t, jwt.SigningMethodRS256, newKey, "key-2", issuer.claims("n"))
+	if _, err := provider.Verify(ctx, rotated, "n"); err == nil || !strings.Contains(err.Error(), "unknown signing key") {
+		t.Fatalf("Verify = %v, want an unknown key error", err)
+	}
+	if got := issuer.fetches(); got != 1 {
+		t.Fatalf("key set fetched %d times within minKeyRefresh, want 1", got)
+	}
+
+	provider.mu.Lock()
+	provider.keysFetched = time.Now().Add(-minKeyRefresh)
+	provider.mu.Unlock()
+
+	identity, err := provider.Verify(ctx, rotated, "n")
+	if err != nil {
+		t.Fatalf("Verify after the refresh interval: %v", err)
+	}
+	if identity.Subject != "subject-1" {
+		t.Errorf("subject = %q", identity.Subject)
+	}
+	if got := issuer.fetches(); got != 2 {
+		t.Errorf("key set fetched %d times, want 2", got)
+	}
+
+	// Known keys are served from the cache
+	if _, err := provider.Verify(ctx, sign(t, jwt.SigningMethodRS256, oldKey, "key-1", issuer.claims("n")), "n"); err != nil {
+		t.Errorf("Verify with the old key: %v", err)
+	}
+	if got := issuer.fetches(); got != 2 {
+		t.Errorf("key set fetched %d times, want 2", got)
+	}
+}
@@ -0,0 +1,77 @@
+package passwordreset
+
+import (
+	"bytes"
+	"deforestation/models"
+	"deforestation/notifications"
+	"html/template"
+	"log"
+	"net/url"
+	"time"
+)
+
+// Notifier delivers reset tokens to the users who asked for them
+type Notifier interface {
+	SendPasswordReset(user models.User, token string, expiresAt time.Time) error
+}
+
+// LogNotifier writes reset links to the server log. It is meant for
+// development setups without a mail server.
+type LogNotifier struct {
+	BaseURL string
+}
+
+func (n LogNotifier) SendPasswordReset(user models.User, token string, expiresAt time.Time) error {
+	log.Printf("Password reset for %s: %s (expires %s)", user.Username, resetLink(n.BaseURL, token), expiresAt.Format(time.RFC3339))
+	return nil
+}
+
+// EmailNotifier mails reset links to the address of the user
+type EmailNotifier struct {
+	Config notifications.SMTPConfig
+}
+
+func (n EmailNotifier) SendPasswordReset(user models.User, token string, expiresAt time.Time) error {
+	if user.Email == "" {
+		log.Printf("Password reset for %s not sent, no email address", user.Username)
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := resetTemplate.Execute(&buf, map[string]interface{}{
+		"Username":  user.Username,
+		"Link":      resetLink(n.Config.BaseURL, token),
+		"ExpiresIn": time.Until(expiresAt).Round(time.Minute).String(),
+	}); err != nil {
+		return err
+	}
+
+	return n.Config.Send(notifications.Mail{
+		To:      []string{user.Email},
+		Subject: "Reset your Deforestation Tracker password",
+		HTML:    buf.String(),
+	})
+}
+
+// NotifierFromEnv mails reset links when an SMTP server is configured and
+// logs them otherwise
+func NotifierFromEnv() Notifier {
+	cfg := notifications.SMTPConfigFromEnv()
+	if cfg.Enabled() {
+		return EmailNotifier{Config: cfg}
+	}
+	return LogNotifier{BaseURL: cfg.BaseURL}
+}
+
+// resetLink points to the page of the web app where the new password is
+// entered
+func resetLink(baseURL, token string) string {
+	return baseURL + "/reset-password?token=" + url.QueryEscape(token)
+}
+
+var resetTemplate = template.Must(template.New("reset").Parse(`
+<p>Hello {{.Username}},</p>
+<p>Someone asked to reset the password of your account. If it was you, choose a new password here:</p>
+<p><a href="{{.Link}}">{{.Link}}</a></p>
+<p>The link works once and expires in {{.ExpiresIn}}. If you did not ask for it, you can ignore this mail.</p>
+`))
@@ -0,0 +1,151 @@
+// Package passwordreset issues single use tokens that let users who forgot
+// their password choose a new one
+package passwordreset
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"deforestation/models"
+	"deforestation/sessions"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+var (
+	// ErrInvalidToken is returned for unknown, expired or already used
+	// tokens
+	ErrInvalidToken = errors.New("invalid password reset token")
+	// ErrSSOAccount is returned for users who sign in through an identity
+	// provider. A local password would keep them in after being disabled
+	// there.
+	ErrSSOAccount = errors.New("password reset is not available for single sign-on accounts")
+)
+
+// TokenTTL is how long a reset token may be used, PASSWORD_RESET_TTL or one
+// hour
+var TokenTTL = ttlFromEnv()
+
+func ttlFromEnv() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("PASSWORD_RESET_TTL")); err == nil && d > 0 {
+		return d
+	}
+	return time.Hour
+}
+
+// Request issues a reset token for user and hands it to notifier. Tokens
+// issued earlier stop working.
+func Request(db *gorm.DB, notifier Notifier, user models.User) error {
+	if user.OIDCSubject != nil {
+		return ErrSSOAccount
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	now := time.Now()
+	record := models.PasswordResetToken{
+		UserID:    user.ID,
+		TokenHash: hashToken(token),
+		ExpiresAt: now.Add(TokenTTL),
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := expire(tx, user.ID, now); err != nil {
+			return err
+		}
+		return tx.Create(&record).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	return notifier.SendPasswordReset(user, token, record.ExpiresAt)
+}
+
+// Lookup returns the user a token was issued to, without using it up
+func Lookup(db *gorm.DB, token string) (models.User, error) {
+	var user models.User
+	record, err := find(db, token, time.Now())
+	if err != nil {
+		return user, err
+	}
+	if err := db.First(&user, record.UserID).Error; err != nil {
+		return user, ErrInvalidToken
+	}
+	if user.OIDCSubject != nil {
+		return user, ErrSSOAccount
+	}
+	return user, nil
+}
+
+// Reset uses up token and sets the password hash of its user. Every session
+// of the user is revoked, as whoever knew the old password may hold one.
+func Reset(db *gorm.DB, token, passwordHash string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		record, err := find(tx.Set("gorm:query_option", "FOR UPDATE"), token, now)
+		if err != nil {
+			return err
+		}
+
+		var user models.User
+		if err := tx.First(&user, record.UserID).Error; err != nil {
+			return ErrInvalidToken
+		}
+		if user.OIDCSubject != nil {
+			return ErrSSOAccount
+		}
+
+		if err := tx.Model(&models.User{}).Where("id = ?", record.UserID).
+			Update("password", passwordHash).Error; err != nil {
+			return err
+		}
+		if err := expire(tx, record.UserID, now); err != nil {
+			return err
+		}
+		return sessions.RevokeAll(tx, record.UserID)
+	})
+}
+
+// RevokeAll invalidates the outstanding tokens of a user, for instance when
+// the address they were sent to changes
+func RevokeAll(db *gorm.DB, userID uint) error {
+	return expire(db, userID, time.Now())
+}
+
+// Prune deletes the tokens that expired before the given time
+func Prune(db *gorm.DB, before time.Time) error {
+	return db.Unscoped().Where("expires_at < ?", before).Delete(&models.PasswordResetToken{}).Error
+}
+
+func find(db *gorm.DB, token string, now time.Time) (models.PasswordResetToken, error) {
+	var record models.PasswordResetToken
+	if err := db.Where("token_hash = ?", hashToken(token)).First(&record).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return record, ErrInvalidToken
+		}
+		return record, err
+	}
+	if record.UsedAt != nil || now.After(record.ExpiresAt) {
+		return record, ErrInvalidToken
+	}
+	return record, nil
+}
+
+// expire uses up the outstanding tokens of a user
+func expire(db *gorm.DB, userID uint, now time.Time) error {
+	return db.Model(&models.PasswordResetToken{}).Where("user_id = ? AND used_at IS NULL", userID).
+		Update("used_at", now).Error
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
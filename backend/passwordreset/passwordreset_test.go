@@ -0,0 +1,212 @@
+package passwordreset
+
+import (
+	"deforestation/auth"
+	"deforestation/models"
+	"deforestation/sessions"
+	"deforestation/testdb"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// recorder keeps the tokens it is handed instead of sending them
+type recorder struct {
+	tokens    []string
+	expiresAt time.Time
+}
+
+func (r *recorder) SendPasswordReset(user models.User, token string, expiresAt time.Time) error {
+	r.tokens = append(r.tokens, token)
+	r.expiresAt = expiresAt
+	return nil
+}
+
+func createUser(t *testing.T, db *gorm.DB, user models.User) models.User {
+	t.Helper()
+	if user.Password == "" {
+		user.Password = "old-hash"
+	}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestReset(t *testing.T) {
+	db := testdb.Open(t)
+	past := time.Now().Add(-time.Minute)
+
+	tests := []struct {
+		name     string
+		requests int
+		// prepare runs before the reset with the tokens issued so far
+		prepare func(tx *gorm.DB, user models.User) error
+		// token picks which issued token is presented
+		token int
+		want  error
+	}{
+		{"valid", 1, nil, 0, nil},
+		{"expired", 1, func(tx *gorm.DB, user models.User) error {
+			return tx.Model(&models.PasswordResetToken{}).Where("user_id = ?", user.ID).Update("expires_at", past).Error
+		}, 0, ErrInvalidToken},
+		{"superseded", 2, nil, 0, ErrInvalidToken},
+		{"latest of several", 2, nil, 1, nil},
+		{"revoked", 1, func(tx *gorm.DB, user models.User) error {
+			return RevokeAll(tx, user.ID)
+		}, 0, ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := createUser(t, db, models.User{Username: tt.name})
+			notifier := &recorder{}
+			for i := 0; i < tt.requests; i++ {
+				before := time.Now()
+				if err := Request(db, notifier, user); err != nil {
+					t.Fatal(err)
+				}
+				if notifier.expiresAt.Before(before.Add(TokenTTL)) || notifier.expiresAt.After(time.Now().Add(TokenTTL)) {
+					t.Errorf("token expires at %v, want TokenTTL (%v) after the request", notifier.expiresAt, TokenTTL)
+				}
+			}
+			if tt.prepare != nil {
+				if err := tt.prepare(db, user); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			token := notifier.tokens[tt.token]
+			if _, err := Lookup(db, token); !errors.Is(err, tt.want) {
+				t.Errorf("Lookup = %v, want %v", err, tt.want)
+			}
+			if err := Reset(db, token, "new-hash"); !errors.Is(err, tt.want) {
+				t.Fatalf("Reset = %v, want %v", err, tt.want)
+			}
+
+			var stored models.User
+			if err := db.First(&stored, user.ID).Error; err != nil {
+				t.Fatal(err)
+			}
+			want := "old-hash"
+			if tt.want == nil {
+				want = "new-hash"
+			}
+			if stored.Password != want {
+				t.Errorf("password = %q, want %q", stored.Password, want)
+			}
+		})
+	}
+}
+
+func TestResetSingleUse(t *testing.T) {
+	db := testdb.Open(t)
+	user := createUser(t, db, models.User{Username: "ana"})
+	notifier := &recorder{}
+	if err := Request(db, notifier, user); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Reset(db, notifier.tokens[0], "first-hash"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Reset(db, notifier.tokens[0], "second-hash"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("second Reset = %v, want %v", err, ErrInvalidToken)
+	}
+	if _, err := Lookup(db, notifier.tokens[0]); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Lookup after the reset = %v, want %v", err, ErrInvalidToken)
+	}
+
+	var stored models.User
+	if err := db.First(&stored, user.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.Password != "first-hash" {
+		t.Errorf("password = %q, want first-hash", stored.Password)
+	}
+}
+
+func TestResetRevokesSessions(t *testing.T) {
+	db := testdb.Open(t)
+	t.Setenv("JWT_ALG", "HS256")
+	t.Setenv("JWT_SECRET_KEYS", "test:0123456789abcdef0123456789abcdef")
+	t.Setenv("JWT_ACTIVE_KID", "")
+	if err := auth.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	user := createUser(t, db, models.User{Username: "ana"})
+	other := createUser(t, db, models.User{Username: "bob"})
+	for _, u := range []models.User{user, user, other} {
+		if _, err := sessions.Create(db, u, "test", "127.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	notifier := &recorder{}
+	if err := Request(db, notifier, user); err != nil {
+		t.Fatal(err)
+	}
+	if err := Reset(db, notifier.tokens[0], "new-hash"); err != nil {
+		t.Fatal(err)
+	}
+
+	var list []models.Session
+	if err := db.Find(&list).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, session := range list {
+		active, err := sessions.Active(db, session.ID, session.UserID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := session.UserID != user.ID; active != want {
+			t.Errorf("session %d of user %d active = %v, want %v", session.ID, session.UserID, active, want)
+		}
+	}
+}
+
+func TestSSOAccount(t *testing.T) {
+	db := testdb.Open(t)
+	issuer, subject := "https://idp.example.com", "subject-1"
+	user := createUser(t, db, models.User{Username: "ana", OIDCIssuer: &issuer, OIDCSubject: &subject})
+
+	notifier := &recorder{}
+	if err := Request(db, notifier, user); !errors.Is(err, ErrSSOAccount) {
+		t.Fatalf("Request = %v, want %v", err, ErrSSOAccount)
+	}
+	if len(notifier.tokens) != 0 {
+		t.Error("a token was sent to a single sign-on account")
+	}
+
+	// A token issued before the account was linked to the provider
+	local := createUser(t, db, models.User{Username: "bob"})
+	if err := Request(db, notifier, local); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&local).Updates(map[string]interface{}{
+		"oidc_issuer":  issuer,
+		"oidc_subject": "subject-2",
+	}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Lookup(db, notifier.tokens[0]); !errors.Is(err, ErrSSOAccount) {
+		t.Errorf("Lookup = %v, want %v", err, ErrSSOAccount)
+	}
+	if err := Reset(db, notifier.tokens[0], "new-hash"); !errors.Is(err, ErrSSOAccount) {
+		t.Errorf("Reset = %v, want %v", err, ErrSSOAccount)
+	}
+}
+
+func TestHashToken(t *testing.T) {
+	tests := map[string]string{
+		"":    "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		"abc": "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+	}
+	for token, want := range tests {
+		if got := hashToken(token); got != want {
+			t.Errorf("hashToken(%q) = %s, want %s", token, got, want)
+		}
+	}
+}
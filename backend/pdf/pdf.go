@@ -0,0 +1,207 @@
+// Package pdf writes simple PDF documents: text in the standard Helvetica
+// fonts, lines, rectangles and JPEG images. Coordinates are in points with
+// the origin at the top left corner of the page.
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// A4 page size in points
+const (
+	PageWidth  = 595.28
+	PageHeight = 841.89
+)
+
+// Document is a PDF document under construction
+type Document struct {
+	pages  []*Page
+	images []*Image
+}
+
+// Page is a single page of a document
+type Page struct {
+	doc     *Document
+	content bytes.Buffer
+	images  []*Image
+}
+
+// Image is a JPEG image that can be placed on any page of its document
+type Image struct {
+	id     int
+	data   []byte
+	width  int
+	height int
+}
+
+func New() *Document {
+	return &Document{}
+}
+
+// AddPage appends a new blank A4 page
+func (d *Document) AddPage() *Page {
+	p := &Page{doc: d}
+	d.pages = append(d.pages, p)
+	return p
+}
+
+// AddJPEG registers RGB JPEG data of the given pixel size with the document
+func (d *Document) AddJPEG(data []byte, width, height int) *Image {
+	img := &Image{id: len(d.images), data: data, width: width, height: height}
+	d.images = append(d.images, img)
+	return img
+}
+
+// Text draws s with its baseline starting at (x, y)
+func (p *Page) Text(x, y, size float64, bold bool, s string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(&p.content, "BT /%s %.2f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, PageHeight-y, escape(s))
+}
+
+// TextWidth estimates the width of s in the regular font
+func TextWidth(s string, size float64) float64 {
+	return float64(len([]rune(s))) * size * 0.5
+}
+
+// SetStrokeColor sets the line color, components range from 0 to 1
+func (p *Page) SetStrokeColor(r, g, b float64) {
+	fmt.Fprintf(&p.content, "%.3f %.3f %.3f RG\n", r, g, b)
+}
+
+// SetFillColor sets the fill and text color, components range from 0 to 1
+func (p *Page) SetFillColor(r, g, b float64) {
+	fmt.Fprintf(&p.content, "%.3f %.3f %.3f rg\n", r, g, b)
+}
+
+// Line strokes a straight line from (x1, y1) to (x2, y2)
+func (p *Page) Line(x1, y1, x2, y2, width float64) {
+	fmt.Fprintf(&p.content, "%.2f w %.2f %.2f m %.2f %.2f l S\n", width, x1, PageHeight-y1, x2, PageHeight-y2)
+}
+
+// Polyline strokes a line through the given points
+func (p *Page) Polyline(xs, ys []float64, width float64) {
+	if len(xs) < 2 {
+		return
+	}
+	fmt.Fprintf(&p.content, "%.2f w %.2f %.2f m", width, xs[0], PageHeight-ys[0])
+	for i := 1; i < len(xs); i++ {
+		fmt.Fprintf(&p.content, " %.2f %.2f l", xs[i], PageHeight-ys[i])
+	}
+	p.content.WriteString(" S\n")
+}
+
+// Rect draws a rectangle whose top left corner is at (x, y)
+func (p *Page) Rect(x, y, w, h float64, fill bool) {
+	op := "S"
+	if fill {
+		op = "f"
+	}
+	fmt.Fprintf(&p.content, "%.2f %.2f %.2f %.2f re %s\n", x, PageHeight-y-h, w, h, op)
+}
+
+// Image draws img scaled to w x h with its top left corner at (x, y)
+func (p *Page) Image(img *Image, x, y, w, h float64) {
+	p.images = append(p.images, img)
+	fmt.Fprintf(&p.content, "q %.2f 0 0 %.2f %.2f %.2f cm /Im%d Do Q\n", w, h, x, PageHeight-y-h, img.id)
+}
+
+// WriteTo serializes the document
+func (d *Document) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	var offsets []int
+
+	obj := func(body string) int {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+		return len(offsets)
+	}
+	stream := func(dict string, data []byte) int {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n<< %s /Length %d >>\nstream\n", len(offsets), dict, len(data))
+		buf.Write(data)
+		buf.WriteString("\nendstream\nendobj\n")
+		return len(offsets)
+	}
+
+	buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	// Object numbers 1 and 2 are reserved for the catalog and page tree
+	offsets = append(offsets, 0, 0)
+	regular := obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	bold := obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+
+	imageObjects := make([]int, len(d.images))
+	for i, img := range d.images {
+		imageObjects[i] = stream(fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /DCTDecode",
+			img.width, img.height), img.data)
+	}
+
+	var kids []string
+	for _, p := range d.pages {
+		var compressed bytes.Buffer
+		zw := zlib.NewWriter(&compressed)
+		zw.Write(p.content.Bytes())
+		zw.Close()
+		content := stream("/Filter /FlateDecode", compressed.Bytes())
+
+		var xobjects strings.Builder
+		seen := map[int]bool{}
+		for _, img := range p.images {
+			if !seen[img.id] {
+				seen[img.id] = true
+				fmt.Fprintf(&xobjects, " /Im%d %d 0 R", img.id, imageObjects[img.id])
+			}
+		}
+
+		page := obj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Contents %d 0 R /Resources << /Font << /F1 %d 0 R /F2 %d 0 R >> /XObject <<%s >> >> >>",
+			PageWidth, PageHeight, content, regular, bold, xobjects.String()))
+		kids = append(kids, fmt.Sprintf("%d 0 R", page))
+	}
+
+	offsets[0] = buf.Len()
+	buf.WriteString("1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n")
+	offsets[1] = buf.Len()
+	fmt.Fprintf(&buf, "2 0 obj\n<< /Type /Pages /Kids [%s] /Count %d >>\nendobj\n", strings.Join(kids, " "), len(kids))
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
+}
+
+// escape encodes s as WinAnsi and escapes it for use in a string literal
+func escape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '\\', '(', ')':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+			continue
+		}
+		if r < 0x80 {
+			b.WriteRune(r)
+			continue
+		}
+		if c, ok := charmap.Windows1252.EncodeRune(r); ok {
+			fmt.Fprintf(&b, "\\%03o", c)
+		} else {
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
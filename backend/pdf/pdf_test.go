@@ -0,0 +1,118 @@
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func testDocument(t *testing.T) []byte {
+	t.Helper()
+	var jpg bytes.Buffer
+	if err := jpeg.Encode(&jpg, image.NewRGBA(image.Rect(0, 0, 4, 3)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	doc := New()
+	img := doc.AddJPEG(jpg.Bytes(), 4, 3)
+
+	first := doc.AddPage()
+	first.Text(50, 70, 18, true, "Deforestation report: Área (norte)")
+	first.Rect(50, 100, 200, 100, false)
+	first.Polyline([]float64{50, 100, 150}, []float64{200, 150, 180}, 1.5)
+	first.Image(img, 50, 220, 40, 30)
+
+	second := doc.AddPage()
+	second.Image(img, 50, 50, 40, 30)
+	second.Image(img, 100, 50, 40, 30)
+
+	var buf bytes.Buffer
+	if _, err := doc.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestWriteToStructure(t *testing.T) {
+	data := testDocument(t)
+
+	if !bytes.HasPrefix(data, []byte("%PDF-1.4\n")) {
+		t.Fatalf("document starts with %q", data[:min(len(data), 16)])
+	}
+	if !bytes.HasSuffix(data, []byte("%%EOF\n")) {
+		t.Fatalf("document ends with %q", data[max(0, len(data)-16):])
+	}
+
+	// startxref points at the cross-reference table
+	match := regexp.MustCompile(`startxref\n(\d+)\n%%EOF\n$`).FindSubmatch(data)
+	if match == nil {
+		t.Fatal("no startxref")
+	}
+	xref, _ := strconv.Atoi(string(match[1]))
+	if xref >= len(data) || !bytes.HasPrefix(data[xref:], []byte("xref\n")) {
+		t.Fatalf("startxref %d does not point at the xref table", xref)
+	}
+
+	lines := strings.Split(string(data[xref:]), "\n")
+	var first, count int
+	if _, err := fmt.Sscanf(lines[1], "%d %d", &first, &count); err != nil || first != 0 {
+		t.Fatalf("xref subsection %q", lines[1])
+	}
+	if lines[2] != "0000000000 65535 f " {
+		t.Errorf("xref entry 0 = %q", lines[2])
+	}
+
+	// Every entry is 20 bytes long and points at its object
+	for i := 1; i < count; i++ {
+		entry := lines[2+i]
+		if len(entry)+1 != 20 || !strings.HasSuffix(entry, " 00000 n ") {
+			t.Fatalf("xref entry %d = %q", i, entry)
+		}
+		offset, err := strconv.Atoi(entry[:10])
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := fmt.Sprintf("%d 0 obj\n", i)
+		if !bytes.HasPrefix(data[offset:], []byte(want)) {
+			t.Errorf("xref entry %d points at %q, want %q", i, data[offset:min(len(data), offset+len(want))], want)
+		}
+	}
+
+	objects := regexp.MustCompile(`(?m)^\d+ 0 obj$`).FindAll(data, -1)
+	if len(objects) != count-1 {
+		t.Errorf("%d objects, xref lists %d", len(objects), count-1)
+	}
+	if lines[2+count] != "trailer" || !strings.Contains(lines[3+count], fmt.Sprintf("/Size %d ", count)) {
+		t.Errorf("trailer %q %q, want /Size %d", lines[2+count], lines[3+count], count)
+	}
+
+	if !bytes.Contains(data, []byte("/Type /Pages /Kids [")) || !bytes.Contains(data, []byte("/Count 2 >>")) {
+		t.Error("page tree does not list two pages")
+	}
+	// The image is stored once, however often it is drawn
+	if n := bytes.Count(data, []byte("/Subtype /Image")); n != 1 {
+		t.Errorf("image stored %d times", n)
+	}
+}
+
+func TestEscape(t *testing.T) {
+	tests := map[string]string{
+		"plain":         "plain",
+		`a (b) \ c`:     `a \(b\) \\ c`,
+		"Área":          `\301rea`,
+		"12 km²":        `12 km\262`,
+		"–":             `\226`,
+		"森林":            "??",
+		"100% of (all)": `100% of \(all\)`,
+	}
+	for in, want := range tests {
+		if got := escape(in); got != want {
+			t.Errorf("escape(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+// Package quota limits how much a user or an organization may monitor, as
+// every area costs tile downloads each week. Private areas count against
+// their creator, shared areas against their organization.
+package quota
+
+import (
+	"deforestation/models"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Limits caps the usage of an account. Zero means unlimited.
+type Limits struct {
+	MaxAreas            int     `json:"areas"`
+	MaxAreaKm2          float64 `json:"area_km2"`
+	MaxAnalysesPerMonth int     `json:"analyses_per_month"`
+}
+
+// Usage is the current consumption of an account
+type Usage struct {
+	Areas             int     `json:"areas"`
+	AreaKm2           float64 `json:"area_km2"`
+	AnalysesThisMonth int     `json:"analyses_per_month"`
+}
+
+// Account is who an area counts against: a user for private areas, or an
+// organization
+type Account struct {
+	UserID         uint
+	OrganizationID *uint
+}
+
+// AccountOf returns the account an area counts against
+func AccountOf(area models.Area) Account {
+	if area.OrganizationID != nil {
+		return Account{OrganizationID: area.OrganizationID}
+	}
+	return Account{UserID: area.UserID}
+}
+
+// Same reports whether both accounts are the same user or organization
+func (a Account) Same(b Account) bool {
+	if a.OrganizationID == nil || b.OrganizationID == nil {
+		return a.OrganizationID == nil && b.OrganizationID == nil && a.UserID == b.UserID
+	}
+	return *a.OrganizationID == *b.OrganizationID
+}
+
+// ExceededError is returned when an operation would go over a limit
+type ExceededError struct {
+	Limit string
+	Max   float64
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("quota exceeded: %s is limited to %g", e.Limit, e.Max)
+}
+
+// DefaultsFromEnv reads QUOTA_MAX_AREAS (default 10), QUOTA_MAX_AREA_KM2
+// (default 2500) and QUOTA_MAX_ANALYSES_PER_MONTH (default 100). A value of
+// 0 lifts the limit.
+func DefaultsFromEnv() Limits {
+	return Limits{
+		MaxAreas:            envInt("QUOTA_MAX_AREAS", 10),
+		MaxAreaKm2:          envFloat("QUOTA_MAX_AREA_KM2", 2500),
+		MaxAnalysesPerMonth: envInt("QUOTA_MAX_ANALYSES_PER_MONTH", 100),
+	}
+}
+
+// LimitsOf returns the defaults overlaid with the account's override, if any
+func LimitsOf(db *gorm.DB, defaults Limits, account Account) (Limits, error) {
+	limits := defaults
+
+	var override models.Quota
+	err := account.scope(db, "").First(&override).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return limits, nil
+	} else if err != nil {
+		return limits, err
+	}
+
+	if override.MaxAreas != nil {
+		limits.MaxAreas = *override.MaxAreas
+	}
+	if override.MaxAreaKm2 != nil {
+		limits.MaxAreaKm2 = *override.MaxAreaKm2
+	}
+	if override.MaxAnalysesPerMonth != nil {
+		limits.MaxAnalysesPerMonth = *override.MaxAnalysesPerMonth
+	}
+	return limits, nil
+}
+
+// UsageOf counts the areas of an account, their surface, and the analyses
+// run this month. Analyses of deleted areas still count.
+func UsageOf(db *gorm.DB, account Account, now time.Time) (Usage, error) {
+	var usage Usage
+
+	var areas []models.Area
+	if err := account.scope(db, "").
+		Select("top_right_lat, top_right_lon, bottom_left_lat, bottom_left_lon").
+		Find(&areas).Error; err != nil {
+		return usage, err
+	}
+	usage.Areas = len(areas)
+	for _, area := range areas {
+		usage.AreaKm2 += area.SurfaceKm2()
+	}
+
+	if err := account.scope(db.Model(&models.AnalysisRun{}), "areas.").
+		Joins("JOIN areas ON areas.id = analysis_runs.area_id").
+		Where("analysis_runs.started_at >= ?", monthStart(now)).
+		Count(&usage.AnalysesThisMonth).Error; err != nil {
+		return usage, err
+	}
+
+	return usage, nil
+}
+
+// Lock runs fn in a transaction that holds a row lock on the account's
+// quota row, creating the row if needed. Checks and the inserts they allow
+// belong in fn, so that concurrent requests of an account cannot both pass
+// the check before either inserted what the other one counts.
+func Lock(db *gorm.DB, account Account, fn func(tx *gorm.DB) error) error {
+	column, id := "user_id", account.UserID
+	if account.OrganizationID != nil {
+		column, id = "organization_id", *account.OrganizationID
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Exec("INSERT INTO quota ("+column+", created_at, updated_at) VALUES (?, ?, ?) "+
+			"ON CONFLICT ("+column+") DO NOTHING", id, now, now).Error; err != nil {
+			return err
+		}
+
+		var row models.Quota
+		if err := tx.Unscoped().Set("gorm:query_option", "FOR UPDATE").
+			Where(column+" = ?", id).First(&row).Error; err != nil {
+			return err
+		}
+
+		return fn(tx)
+	})
+}
+
+// CheckArea reports whether an account may take on area
+func CheckArea(db *gorm.DB, defaults Limits, account Account, area models.Area, now time.Time) error {
+	limits, usage, err := load(db, defaults, account, now)
+	if err != nil {
+		return err
+	}
+
+	if limits.MaxAreas > 0 && usage.Areas+1 > limits.MaxAreas {
+		return &ExceededError{Limit: "number of areas", Max: float64(limits.MaxAreas)}
+	}
+	if limits.MaxAreaKm2 > 0 && usage.AreaKm2+area.SurfaceKm2() > limits.MaxAreaKm2 {
+		return &ExceededError{Limit: "monitored surface in km²", Max: limits.MaxAreaKm2}
+	}
+	return nil
+}
+
+// CheckAnalysis reports whether an account may run one more analysis this
+// month. Within Lock, the analysis run must be inserted before the lock is
+// released.
+func CheckAnalysis(db *gorm.DB, defaults Limits, account Account, now time.Time) error {
+	limits, usage, err := load(db, defaults, account, now)
+	if err != nil {
+		return err
+	}
+
+	if limits.MaxAnalysesPerMonth > 0 && usage.AnalysesThisMonth+1 > limits.MaxAnalysesPerMonth {
+		return &ExceededError{Limit: "number of analyses per month", Max: float64(limits.MaxAnalysesPerMonth)}
+	}
+	return nil
+}
+
+func load(db *gorm.DB, defaults Limits, account Account, now time.Time) (Limits, Usage, error) {
+	limits, err := LimitsOf(db, defaults, account)
+	if err != nil {
+		return limits, Usage{}, err
+	}
+	usage, err := UsageOf(db, account, now)
+	return limits, usage, err
+}
+
+// scope restricts a query on a table with user_id and organization_id
+// columns, optionally qualified with prefix, to the account
+func (a Account) scope(db *gorm.DB, prefix string) *gorm.DB {
+	if a.OrganizationID != nil {
+		return db.Where(prefix+"organization_id = ?", *a.OrganizationID)
+	}
+	return db.Where(prefix+"user_id = ? AND "+prefix+"organization_id IS NULL", a.UserID)
+}
+
+// monthStart is the first instant of the month of now, in UTC
+func monthStart(now time.Time) time.Time {
+	now = now.UTC()
+	return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func envInt(name string, fallback int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil && v >= 0 {
+		return v
+	}
+	return fallback
+}
+
+func envFloat(name string, fallback float64) float64 {
+	if v, err := strconv.ParseFloat(os.Getenv(name), 64); err == nil && v >= 0 {
+		return v
+	}
+	return fallback
+}
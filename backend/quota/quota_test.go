@@ -0,0 +1,159 @@
+package quota
+
+import (
+	"deforestation/models"
+	"deforestation/testdb"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+func TestMonthStart(t *testing.T) {
+	tests := []struct {
+		name string
+		now  time.Time
+		want time.Time
+	}{
+		{"mid month", time.Date(2024, 5, 17, 13, 45, 0, 0, time.UTC), time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)},
+		{"first instant", time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)},
+		{"last instant", time.Date(2024, 5, 31, 23, 59, 59, 999999999, time.UTC), time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)},
+		{"leap day", time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC), time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"already next month in UTC", time.Date(2024, 5, 31, 22, 0, 0, 0, time.FixedZone("UTC-3", -3*3600)), time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{"still last month in UTC", time.Date(2024, 1, 1, 1, 0, 0, 0, time.FixedZone("UTC+2", 2*3600)), time.Date(2023, 12, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := monthStart(tt.now); !got.Equal(tt.want) || got.Location() != time.UTC {
+				t.Errorf("monthStart = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccountSame(t *testing.T) {
+	org1, org1Again, org2 := uint(1), uint(1), uint(2)
+
+	tests := []struct {
+		name string
+		a, b Account
+		want bool
+	}{
+		{"same user", Account{UserID: 1}, Account{UserID: 1}, true},
+		{"other user", Account{UserID: 1}, Account{UserID: 2}, false},
+		{"same organization", Account{OrganizationID: &org1}, Account{OrganizationID: &org1Again}, true},
+		{"organization regardless of the creator", Account{UserID: 1, OrganizationID: &org1}, Account{UserID: 2, OrganizationID: &org1}, true},
+		{"other organization", Account{OrganizationID: &org1}, Account{OrganizationID: &org2}, false},
+		{"user and organization", Account{UserID: 1}, Account{UserID: 1, OrganizationID: &org1}, false},
+		{"organization and user", Account{OrganizationID: &org1}, Account{UserID: 1}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.a.Same(tt.b); got != tt.want {
+				t.Errorf("Same = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimitsOf(t *testing.T) {
+	db := testdb.Open(t)
+	defaults := Limits{MaxAreas: 10, MaxAreaKm2: 2500, MaxAnalysesPerMonth: 100}
+
+	org, otherOrg := uint(7), uint(8)
+	areas, km2, unlimited := 3, 99.5, 0
+	overrides := []models.Quota{
+		{UserID: uintPtr(1), MaxAreas: &areas},
+		{UserID: uintPtr(2), MaxAreaKm2: &km2, MaxAnalysesPerMonth: &unlimited},
+		{OrganizationID: &org, MaxAreas: &areas, MaxAreaKm2: &km2, MaxAnalysesPerMonth: &unlimited},
+		{OrganizationID: &otherOrg},
+	}
+	for i := range overrides {
+		if err := db.Create(&overrides[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		account Account
+		want    Limits
+	}{
+		{"no override", Account{UserID: 3}, defaults},
+		{"one limit", Account{UserID: 1}, Limits{MaxAreas: 3, MaxAreaKm2: 2500, MaxAnalysesPerMonth: 100}},
+		{"lifted limit", Account{UserID: 2}, Limits{MaxAreas: 10, MaxAreaKm2: 99.5, MaxAnalysesPerMonth: 0}},
+		{"organization", Account{UserID: 1, OrganizationID: &org}, Limits{MaxAreas: 3, MaxAreaKm2: 99.5, MaxAnalysesPerMonth: 0}},
+		{"override without limits", Account{OrganizationID: &otherOrg}, defaults},
+		{"organization without override", Account{OrganizationID: uintPtr(9)}, defaults},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := LimitsOf(db, defaults, tt.account)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("LimitsOf = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Concurrent analyses of an account are counted one after the other, so
+// exactly as many as the limit allows get to start
+func TestLockSerializesChecks(t *testing.T) {
+	db := testdb.Open(t)
+	limits := Limits{MaxAnalysesPerMonth: 3}
+
+	area := models.Area{AreaName: "a", UserID: 1}
+	if err := db.Create(&area).Error; err != nil {
+		t.Fatal(err)
+	}
+	account := AccountOf(area)
+
+	const attempts = 10
+	errs := make(chan error, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- Lock(db, account, func(tx *gorm.DB) error {
+				now := time.Now()
+				if err := CheckAnalysis(tx, limits, account, now); err != nil {
+					return err
+				}
+				return tx.Create(&models.AnalysisRun{AreaID: area.ID, Status: models.AnalysisRunRunning, StartedAt: now}).Error
+			})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	started := 0
+	for err := range errs {
+		var exceeded *ExceededError
+		if err == nil {
+			started++
+		} else if !errors.As(err, &exceeded) {
+			t.Errorf("Lock = %v", err)
+		}
+	}
+	if started != 3 {
+		t.Errorf("%d analyses started, want 3", started)
+	}
+
+	usage, err := UsageOf(db, account, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.AnalysesThisMonth != 3 {
+		t.Errorf("%d analyses recorded, want 3", usage.AnalysesThisMonth)
+	}
+}
+
+func uintPtr(v uint) *uint {
+	return &v
+}
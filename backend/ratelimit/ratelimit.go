@@ -0,0 +1,117 @@
+// Package ratelimit implements in-memory token bucket rate limiting keyed by
+// an arbitrary string such as the client IP
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limiter allows Burst requests at once per key, refilled at Rate requests
+// per second
+type Limiter struct {
+	Rate  float64
+	Burst int
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// sweepInterval is how often idle buckets are forgotten
+const sweepInterval = 10 * time.Minute
+
+// PerMinute returns a limiter allowing n requests per minute with bursts of
+// up to n requests
+func PerMinute(n int) *Limiter {
+	return New(float64(n)/60, n)
+}
+
+// PerMinuteFromEnv returns a per-minute limiter sized by the environment
+// variable name, or fallback when it is unset or invalid
+func PerMinuteFromEnv(name string, fallback int) *Limiter {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil && n > 0 {
+		return PerMinute(n)
+	}
+	return PerMinute(fallback)
+}
+
+func New(rate float64, burst int) *Limiter {
+	return &Limiter{Rate: rate, Burst: burst, buckets: map[string]*bucket{}}
+}
+
+// Allow takes a token from the bucket of key. When the bucket is empty it
+// returns false and how long until the next token is available.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.Burst), last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(l.Burst), b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - b.tokens) / l.Rate * float64(time.Second))
+	return false, wait
+}
+
+// Wait blocks until a token of key is available or ctx is done
+func (l *Limiter) Wait(ctx context.Context, key string) error {
+	for {
+		ok, wait := l.Allow(key)
+		if ok {
+			return nil
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// sweep drops the buckets that have refilled completely, they behave the
+// same as new ones
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	full := time.Duration(float64(l.Burst) / l.Rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// RetryAfter formats a wait as the value of a Retry-After header, in whole
+// seconds rounded up
+func RetryAfter(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(wait.Seconds())))
+}
@@ -0,0 +1,107 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAllow(t *testing.T) {
+	limiter := New(1, 3)
+
+	for i := 0; i < 3; i++ {
+		if ok, wait := limiter.Allow("a"); !ok || wait != 0 {
+			t.Fatalf("request %d = %v, %v, want allowed within the burst", i+1, ok, wait)
+		}
+	}
+
+	ok, wait := limiter.Allow("a")
+	if ok {
+		t.Fatal("request past the burst was allowed")
+	}
+	if wait <= 0 || wait > time.Second {
+		t.Errorf("wait = %v, want up to one second at one request per second", wait)
+	}
+
+	if ok, _ := limiter.Allow("b"); !ok {
+		t.Error("another key shares the bucket of a")
+	}
+}
+
+func TestAllowRefills(t *testing.T) {
+	limiter := PerMinute(60)
+	for i := 0; i < 60; i++ {
+		limiter.Allow("a")
+	}
+	if ok, _ := limiter.Allow("a"); ok {
+		t.Fatal("bucket is not empty")
+	}
+
+	// Pretend two seconds went by
+	limiter.buckets["a"].last = limiter.buckets["a"].last.Add(-2 * time.Second)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.Allow("a"); !ok {
+			t.Fatalf("refilled request %d was denied", i+1)
+		}
+	}
+	if ok, _ := limiter.Allow("a"); ok {
+		t.Error("bucket refilled more than the elapsed time allows")
+	}
+}
+
+func TestAllowCapsAtBurst(t *testing.T) {
+	limiter := New(1, 2)
+	limiter.Allow("a")
+	limiter.buckets["a"].last = limiter.buckets["a"].last.Add(-time.Hour)
+
+	allowed := 0
+	for i := 0; i < 5; i++ {
+		if ok, _ := limiter.Allow("a"); ok {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("allowed %d requests after an idle hour, want the burst of 2", allowed)
+	}
+}
+
+func TestWait(t *testing.T) {
+	limiter := New(50, 1)
+	limiter.Allow("a")
+
+	start := time.Now()
+	if err := limiter.Wait(context.Background(), "a"); err != nil {
+		t.Fatalf("Wait: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("Wait returned after %v, before a token was available", elapsed)
+	}
+
+	// A cancelled context ends the wait for an empty bucket
+	slow := New(0.001, 1)
+	slow.Allow("a")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := slow.Wait(ctx, "a"); err != context.DeadlineExceeded {
+		t.Errorf("Wait = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		wait time.Duration
+		want string
+	}{
+		{0, "0"},
+		{time.Millisecond, "1"},
+		{time.Second, "1"},
+		{1500 * time.Millisecond, "2"},
+		{time.Minute, "60"},
+	}
+	for _, tt := range tests {
+		if got := RetryAfter(tt.wait); got != tt.want {
+			t.Errorf("RetryAfter(%v) = %q, want %q", tt.wait, got, tt.want)
+		}
+	}
+}
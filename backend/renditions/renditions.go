@@ -0,0 +1,323 @@
+// Package renditions produces resized and re-encoded copies of stored images
+// and keeps them in a disk cache.
+package renditions
+
+import (
+	"context"
+	"crypto/sha256"
+	"deforestation/storage"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/disintegration/imaging"
+)
+
+// MaxDimension bounds the requested width and height
+const MaxDimension = 4096
+
+// Supported output formats
+var contentTypes = map[string]string{
+	"jpeg": "image/jpeg",
+	"webp": "image/webp",
+	"png":  "image/png",
+}
+
+// Options describe a rendition. A zero Width or Height preserves the aspect
+// ratio; when both are set the image is fitted inside the box. Renditions are
+// never upscaled.
+type Options struct {
+	Width  int
+	Height int
+	Format string
+}
+
+// Validate checks the dimensions and format
+func (o Options) Validate() error {
+	if o.Width < 0 || o.Height < 0 || o.Width > MaxDimension || o.Height > MaxDimension {
+		return fmt.Errorf("width and height must be between 0 and %d", MaxDimension)
+	}
+	if _, ok := contentTypes[o.Format]; !ok {
+		return fmt.Errorf("unsupported format %q", o.Format)
+	}
+	return nil
+}
+
+// ContentType returns the MIME type of the rendition format
+func (o Options) ContentType() string {
+	return contentTypes[o.Format]
+}
+
+// Rendition is a generated file in the cache
+type Rendition struct {
+	Path string
+	ETag string
+}
+
+// CacheDirFromEnv returns RENDITION_CACHE_DIR, or a directory below the
+// system temporary directory
+func CacheDirFromEnv() string {
+	if dir := os.Getenv("RENDITION_CACHE_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), "deforestation-renditions")
+}
+
+// MaxCacheBytesFromEnv reads the size cap of the cache from
+// RENDITION_CACHE_MAX_MB, 1024 by default
+func MaxCacheBytesFromEnv() int64 {
+	mb, err := strconv.ParseInt(os.Getenv("RENDITION_CACHE_MAX_MB"), 10, 64)
+	if err != nil || mb <= 0 {
+		mb = 1024
+	}
+	return mb << 20
+}
+
+// Service renders images into CacheDir. Renditions of the same source object
+// share a directory so that they can be evicted together. The locks only
+// serialise the users of one Service, so a process shares a single one.
+type Service struct {
+	CacheDir string
+
+	// Renditions with the same key are generated once, by a single goroutine,
+	// and are not deleted while being generated or opened
+	locks [64]sync.Mutex
+}
+
+func NewService(cacheDir string) *Service {
+	return &Service{CacheDir: cacheDir}
+}
+
+// Key identifies the rendition of a source version. It changes whenever the
+// source object is modified.
+func Key(info storage.ObjectInfo, o Options) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d|%d|%d|%s",
+		info.Key, info.ModTime.UnixNano(), info.Size, o.Width, o.Height, o.Format)))
+	return hex.EncodeToString(sum[:])
+}
+
+// Render returns the cached rendition of the stored image described by info,
+// generating it if needed
+func (s *Service) Render(ctx context.Context, store storage.BlobStore, info storage.ObjectInfo, o Options) (*Rendition, error) {
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+
+	key := Key(info, o)
+	lock := s.lockFor(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	return s.render(ctx, store, info, o, key)
+}
+
+// Open is Render for serving: the rendition is opened before Trim or Evict
+// may delete it, and stays readable until closed even when deleted meanwhile
+func (s *Service) Open(ctx context.Context, store storage.BlobStore, info storage.ObjectInfo, o Options) (*os.File, error) {
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+
+	key := Key(info, o)
+	lock := s.lockFor(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	rendition, err := s.render(ctx, store, info, o, key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(rendition.Path)
+}
+
+// render generates the rendition unless it is cached. The caller holds the
+// lock of key.
+func (s *Service) render(ctx context.Context, store storage.BlobStore, info storage.ObjectInfo, o Options, key string) (*Rendition, error) {
+	path := filepath.Join(s.sourceDir(info.Key), key+"."+o.Format)
+	rendition := &Rendition{Path: path, ETag: `"` + key + `"`}
+
+	if _, err := os.Stat(path); err == nil {
+		// The modification time orders renditions for Trim
+		now := time.Now()
+		os.Chtimes(path, now, now)
+		return rendition, nil
+	}
+
+	src, err := storage.DecodeImage(ctx, store, info.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	// Write to a temporary file first so readers never see partial renditions
+	tmp, err := os.CreateTemp(filepath.Dir(path), key+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := encode(tmp, resize(src, o), o.Format); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+
+	return rendition, nil
+}
+
+// Evict removes every cached rendition of the source object. Its renditions
+// may be under any lock, so it waits until no rendition is being generated
+// or opened.
+func (s *Service) Evict(sourceKey string) error {
+	s.lockAll()
+	defer s.unlockAll()
+
+	return os.RemoveAll(s.sourceDir(sourceKey))
+}
+
+// Trim deletes the least recently used renditions until the cache holds at
+// most maxBytes, and returns the number of bytes reclaimed
+func (s *Service) Trim(maxBytes int64) (int64, error) {
+	type file struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var files []file
+	var total int64
+
+	err := filepath.WalkDir(s.CacheDir, func(path string, d os.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		// Skip directories and renditions being written
+		if d.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		info, err := d.Info()
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		files = append(files, file{path, info.Size(), info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+
+	var reclaimed int64
+	dirs := map[string]bool{}
+	for _, f := range files {
+		if total <= maxBytes {
+			break
+		}
+		lock := s.lockFor(filepath.Base(f.path))
+		lock.Lock()
+		err := os.Remove(f.path)
+		lock.Unlock()
+		if err != nil && !os.IsNotExist(err) {
+			return reclaimed, err
+		}
+		dirs[filepath.Dir(f.path)] = true
+		total -= f.size
+		reclaimed += f.size
+	}
+
+	// Drop the directories of sources whose last rendition is gone, unless a
+	// rendition is about to be written into them
+	if len(dirs) > 0 {
+		s.lockAll()
+		for dir := range dirs {
+			os.Remove(dir)
+		}
+		s.unlockAll()
+	}
+
+	return reclaimed, nil
+}
+
+// lockFor returns the lock of a rendition key, or of a file name starting
+// with one
+func (s *Service) lockFor(key string) *sync.Mutex {
+	var n uint64
+	if len(key) >= 2 {
+		n, _ = strconv.ParseUint(key[:2], 16, 8)
+	}
+	return &s.locks[int(n)%len(s.locks)]
+}
+
+// lockAll takes every lock, in order, for changes that may concern
+// renditions under any of them
+func (s *Service) lockAll() {
+	for i := range s.locks {
+		s.locks[i].Lock()
+	}
+}
+
+func (s *Service) unlockAll() {
+	for i := range s.locks {
+		s.locks[i].Unlock()
+	}
+}
+
+func (s *Service) sourceDir(sourceKey string) string {
+	sum := sha256.Sum256([]byte(sourceKey))
+	name := hex.EncodeToString(sum[:16])
+	return filepath.Join(s.CacheDir, name[:2], name)
+}
+
+func resize(src image.Image, o Options) image.Image {
+	bounds := src.Bounds()
+	width, height := o.Width, o.Height
+	if width > bounds.Dx() {
+		width = bounds.Dx()
+	}
+	if height > bounds.Dy() {
+		height = bounds.Dy()
+	}
+
+	switch {
+	case width > 0 && height > 0:
+		return imaging.Fit(src, width, height, imaging.Lanczos)
+	case width > 0 || height > 0:
+		return imaging.Resize(src, width, height, imaging.Lanczos)
+	default:
+		return src
+	}
+}
+
+func encode(w io.Writer, img image.Image, format string) error {
+	switch format {
+	case "webp":
+		return nativewebp.Encode(w, img, nil)
+	case "png":
+		return imaging.Encode(w, img, imaging.PNG)
+	default:
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
+	}
+}
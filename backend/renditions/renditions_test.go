@@ -0,0 +1,253 @@
+package renditions
+
+import (
+	"bytes"
+	"context"
+	"deforestation/storage"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		o    Options
+		ok   bool
+	}{
+		{"format only", Options{Format: "webp"}, true},
+		{"width", Options{Width: 320, Format: "jpeg"}, true},
+		{"box", Options{Width: 320, Height: 200, Format: "png"}, true},
+		{"largest", Options{Width: MaxDimension, Height: MaxDimension, Format: "png"}, true},
+		{"too wide", Options{Width: MaxDimension + 1, Format: "png"}, false},
+		{"too high", Options{Height: MaxDimension + 1, Format: "png"}, false},
+		{"negative width", Options{Width: -1, Format: "png"}, false},
+		{"negative height", Options{Height: -1, Format: "png"}, false},
+		{"no format", Options{Width: 320}, false},
+		{"unknown format", Options{Format: "gif"}, false},
+		{"format is case sensitive", Options{Format: "PNG"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.o.Validate(); (err == nil) != tt.ok {
+				t.Errorf("Validate = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestKey(t *testing.T) {
+	modTime := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	info := storage.ObjectInfo{Key: "area_1.png", Size: 100, ModTime: modTime}
+	o := Options{Width: 320, Format: "webp"}
+	key := Key(info, o)
+
+	if len(key) != 64 {
+		t.Errorf("Key = %q, want a hex SHA-256", key)
+	}
+	if Key(info, o) != key {
+		t.Error("Key is not stable")
+	}
+
+	tests := []struct {
+		name string
+		info storage.ObjectInfo
+		o    Options
+	}{
+		{"other object", storage.ObjectInfo{Key: "area_2.png", Size: 100, ModTime: modTime}, o},
+		{"modified object", storage.ObjectInfo{Key: "area_1.png", Size: 100, ModTime: modTime.Add(time.Nanosecond)}, o},
+		{"resized object", storage.ObjectInfo{Key: "area_1.png", Size: 101, ModTime: modTime}, o},
+		{"other width", info, Options{Width: 321, Format: "webp"}},
+		{"height instead of width", info, Options{Height: 320, Format: "webp"}},
+		{"other format", info, Options{Width: 320, Format: "png"}},
+	}
+	for _, tt := range tests {
+		if Key(tt.info, tt.o) == key {
+			t.Errorf("%s: Key did not change", tt.name)
+		}
+	}
+}
+
+// putImage stores a w×h PNG under key and returns its object info
+func putImage(t *testing.T, store storage.BlobStore, key string, w, h int) storage.ObjectInfo {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = 0x80
+	}
+	img.Set(0, 0, color.Black)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := store.Put(ctx, key, &buf, int64(buf.Len()), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := store.Stat(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestRenderAndEvict(t *testing.T) {
+	store := storage.NewFileStore(t.TempDir())
+	service := NewService(t.TempDir())
+	ctx := context.Background()
+
+	first := putImage(t, store, "area_1_20240101000000.png", 64, 32)
+	second := putImage(t, store, "area_2_20240101000000.png", 64, 32)
+
+	var paths []string
+	for _, o := range []Options{{Width: 16, Format: "png"}, {Height: 8, Format: "jpeg"}} {
+		rendition, err := service.Render(ctx, store, first, o)
+		if err != nil {
+			t.Fatalf("Render(%+v): %v", o, err)
+		}
+		f, err := os.Open(rendition.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, _, err := image.DecodeConfig(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.Width != 16 || config.Height != 8 {
+			t.Errorf("%+v rendered at %dx%d, want 16x8", o, config.Width, config.Height)
+		}
+		paths = append(paths, rendition.Path)
+	}
+	other, err := service.Render(ctx, store, second, Options{Width: 16, Format: "png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := service.Evict(first.Key); err != nil {
+		t.Fatalf("Evict: %v", err)
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s survived the eviction", path)
+		}
+	}
+	if _, err := os.Stat(other.Path); err != nil {
+		t.Errorf("rendition of another object was evicted: %v", err)
+	}
+	if err := service.Evict("never-rendered.png"); err != nil {
+		t.Errorf("Evict of an object without renditions: %v", err)
+	}
+}
+
+func TestTrim(t *testing.T) {
+	service := NewService(t.TempDir())
+
+	// Four renditions of 100 bytes, used an hour apart
+	start := time.Now().Add(-24 * time.Hour)
+	var paths []string
+	for i, name := range []string{"a", "b", "c", "d"} {
+		path := filepath.Join(service.sourceDir(name+".png"), name+"0000.png")
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, make([]byte, 100), 0644); err != nil {
+			t.Fatal(err)
+		}
+		used := start.Add(time.Duration(i) * time.Hour)
+		if err := os.Chtimes(path, used, used); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	// Renditions being written are left alone
+	tmp := filepath.Join(filepath.Dir(paths[0]), "a0000.123.tmp")
+	if err := os.WriteFile(tmp, make([]byte, 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The oldest rendition was just served again
+	now := time.Now()
+	if err := os.Chtimes(paths[0], now, now); err != nil {
+		t.Fatal(err)
+	}
+
+	reclaimed, err := service.Trim(250)
+	if err != nil {
+		t.Fatalf("Trim: %v", err)
+	}
+	if reclaimed != 200 {
+		t.Errorf("reclaimed %d bytes, want 200", reclaimed)
+	}
+	for i, want := range []bool{true, false, false, true} {
+		if _, err := os.Stat(paths[i]); (err == nil) != want {
+			t.Errorf("%s exists = %v, want %v", filepath.Base(paths[i]), err == nil, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Dir(paths[1])); !os.IsNotExist(err) {
+		t.Errorf("directory of an evicted source is left: %v", err)
+	}
+	if _, err := os.Stat(tmp); err != nil {
+		t.Errorf("temporary file removed: %v", err)
+	}
+
+	if reclaimed, err := service.Trim(250); err != nil || reclaimed != 0 {
+		t.Errorf("second Trim = %d, %v, want nothing to do", reclaimed, err)
+	}
+	if reclaimed, err := NewService(filepath.Join(t.TempDir(), "missing")).Trim(0); err != nil || reclaimed != 0 {
+		t.Errorf("Trim of a missing cache = %d, %v", reclaimed, err)
+	}
+}
+
+// Renditions opened for serving stay readable while the cache is trimmed
+// and evicted from other goroutines
+func TestOpenDuringEviction(t *testing.T) {
+	store := storage.NewFileStore(t.TempDir())
+	service := NewService(t.TempDir())
+	ctx := context.Background()
+	info := putImage(t, store, "area_1_20240101000000.png", 64, 32)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	defer func() {
+		close(done)
+		wg.Wait()
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := service.Evict(info.Key); err != nil {
+				t.Errorf("Evict: %v", err)
+			}
+			if _, err := service.Trim(0); err != nil {
+				t.Errorf("Trim: %v", err)
+			}
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		o := Options{Width: 8 + i%4, Format: "png"}
+		f, err := service.Open(ctx, store, info, o)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		config, err := png.DecodeConfig(f)
+		f.Close()
+		if err != nil || config.Width != o.Width {
+			t.Fatalf("opened rendition is %dx%d, %v, want width %d", config.Width, config.Height, err, o.Width)
+		}
+	}
+}
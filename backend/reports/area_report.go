@@ -0,0 +1,241 @@
+package reports
+
+import (
+	"bytes"
+	"context"
+	"deforestation/models"
+	"deforestation/pdf"
+	"deforestation/storage"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	margin       = 50.0
+	contentWidth = pdf.PageWidth - 2*margin
+	chartHeight  = 200.0
+	maxImageBox  = 320.0
+	// Captures are embedded at roughly 150 dpi
+	reportImageWidth = 520
+)
+
+// MaxReportDates bounds the dates whose captures a report shows, as every
+// capture embeds two images
+const MaxReportDates = 6
+
+// AreaReport writes a printable PDF with the area's metadata, a chart of its
+// deforestation over time and the original and masked captures closest to
+// each of the given dates, at most MaxReportDates of them. Without dates the
+// first and latest captures are shown.
+func AreaReport(db *gorm.DB, store storage.BlobStore, area models.Area, dates []time.Time, w io.Writer) error {
+	var histories []models.History
+	if err := db.Where("area_id = ?", area.ID).Order("date asc").Find(&histories).Error; err != nil {
+		return err
+	}
+
+	doc := pdf.New()
+	page := doc.AddPage()
+	y := margin + 20
+
+	page.Text(margin, y, 18, true, "Deforestation report: "+area.AreaName)
+	y += 18
+	page.Text(margin, y, 10, false, "Generated on "+time.Now().UTC().Format("2006-01-02 15:04 MST"))
+	y += 30
+
+	metadata := [][2]string{
+		{"Area ID", fmt.Sprintf("%d", area.ID)},
+		{"Top right corner", fmt.Sprintf("%.6f, %.6f", area.TopRightLat, area.TopRightLon)},
+		{"Bottom left corner", fmt.Sprintf("%.6f, %.6f", area.BottomLeftLat, area.BottomLeftLon)},
+		{"Surface", fmt.Sprintf("%.2f km²", area.SurfaceKm2())},
+		{"Monitored since", area.CreatedAt.Format("2006-01-02")},
+		{"Current deforested area", fmt.Sprintf("%.2f%%", area.DeforestedArea)},
+		{"Captures", fmt.Sprintf("%d", len(histories))},
+	}
+	if len(histories) > 0 {
+		metadata = append(metadata,
+			[2]string{"First capture", histories[0].Date.Format("2006-01-02")},
+			[2]string{"Latest capture", histories[len(histories)-1].Date.Format("2006-01-02")},
+		)
+	}
+	for _, row := range metadata {
+		page.Text(margin, y, 10, true, row[0])
+		page.Text(margin+150, y, 10, false, row[1])
+		y += 15
+	}
+	y += 20
+
+	page.Text(margin, y, 13, true, "Deforested area over time")
+	y += 15
+	drawChart(page, histories, margin, y, contentWidth, chartHeight)
+	y += chartHeight + 40
+
+	if len(dates) > MaxReportDates {
+		dates = dates[:MaxReportDates]
+	}
+	selected := selectHistories(histories, dates)
+	if len(selected) > 0 {
+		page.Text(margin, y, 13, true, "Captures")
+		y += 20
+	}
+
+	imageWidth := (contentWidth - 10) / 2
+	for _, history := range selected {
+		original, originalWidth, originalHeight := embedImage(doc, store, history.ImagePath, imageWidth, maxImageBox)
+		masked, maskedWidth, maskedHeight := embedImage(doc, store, history.MaskedImagePath, imageWidth, maxImageBox)
+		height := math.Max(originalHeight, maskedHeight)
+
+		if y+height+30 > pdf.PageHeight-margin {
+			page = doc.AddPage()
+			y = margin
+		}
+
+		page.Text(margin, y, 10, true, fmt.Sprintf("%s - %.2f%% deforested",
+			history.Date.Format("2006-01-02"), history.DeforestedArea))
+		y += 8
+		drawImage(page, original, margin, y, originalWidth, originalHeight, "Original")
+		drawImage(page, masked, margin+imageWidth+10, y, maskedWidth, maskedHeight, "Forest mask")
+		y += height + 30
+	}
+
+	_, err := doc.WriteTo(w)
+	return err
+}
+
+// selectHistories picks the capture closest to each date, keeping them in
+// chronological order and dropping duplicates
+func selectHistories(histories []models.History, dates []time.Time) []models.History {
+	if len(histories) == 0 {
+		return nil
+	}
+	if len(dates) == 0 {
+		if len(histories) == 1 {
+			return histories
+		}
+		return []models.History{histories[0], histories[len(histories)-1]}
+	}
+
+	picked := map[int]bool{}
+	for _, date := range dates {
+		best := 0
+		for i, h := range histories {
+			if absDuration(h.Date.Sub(date)) < absDuration(histories[best].Date.Sub(date)) {
+				best = i
+			}
+		}
+		picked[best] = true
+	}
+
+	var indexes []int
+	for i := range picked {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	selected := make([]models.History, len(indexes))
+	for i, idx := range indexes {
+		selected[i] = histories[idx]
+	}
+	return selected
+}
+
+func drawChart(page *pdf.Page, histories []models.History, x, y, w, h float64) {
+	page.SetStrokeColor(0.6, 0.6, 0.6)
+	page.Rect(x, y, w, h, false)
+
+	if len(histories) == 0 {
+		page.Text(x+10, y+h/2, 10, false, "No captures yet")
+		return
+	}
+
+	minValue, maxValue := histories[0].DeforestedArea, histories[0].DeforestedArea
+	for _, history := range histories {
+		minValue = math.Min(minValue, history.DeforestedArea)
+		maxValue = math.Max(maxValue, history.DeforestedArea)
+	}
+	if maxValue-minValue < 1 {
+		minValue, maxValue = minValue-0.5, maxValue+0.5
+	}
+
+	first, last := histories[0].Date, histories[len(histories)-1].Date
+	span := last.Sub(first).Seconds()
+
+	// Horizontal grid lines with value labels
+	for i := 0; i <= 4; i++ {
+		value := minValue + (maxValue-minValue)*float64(i)/4
+		lineY := y + h - h*float64(i)/4
+		page.SetStrokeColor(0.85, 0.85, 0.85)
+		page.Line(x, lineY, x+w, lineY, 0.5)
+		page.Text(x-40, lineY+3, 8, false, fmt.Sprintf("%.1f%%", value))
+	}
+
+	xs := make([]float64, len(histories))
+	ys := make([]float64, len(histories))
+	for i, history := range histories {
+		position := 0.5
+		if span > 0 {
+			position = history.Date.Sub(first).Seconds() / span
+		}
+		xs[i] = x + position*w
+		ys[i] = y + h - (history.DeforestedArea-minValue)/(maxValue-minValue)*h
+	}
+
+	page.SetStrokeColor(0.75, 0.1, 0.1)
+	page.Polyline(xs, ys, 1.5)
+	page.SetFillColor(0.75, 0.1, 0.1)
+	for i := range xs {
+		page.Rect(xs[i]-1.5, ys[i]-1.5, 3, 3, true)
+	}
+
+	page.SetFillColor(0, 0, 0)
+	page.Text(x, y+h+12, 8, false, first.Format("2006-01-02"))
+	lastLabel := last.Format("2006-01-02")
+	page.Text(x+w-pdf.TextWidth(lastLabel, 8), y+h+12, 8, false, lastLabel)
+}
+
+// embedImage adds the stored image to the document and returns it with the
+// size it should be drawn at to fit in a maxWidth x maxHeight box. A nil
+// image is returned when it cannot be read.
+func embedImage(doc *pdf.Document, store storage.BlobStore, key string, maxWidth, maxHeight float64) (*pdf.Image, float64, float64) {
+	src, err := storage.DecodeImage(context.Background(), store, key)
+	if err != nil {
+		return nil, maxWidth, maxWidth * 0.75
+	}
+
+	resized := imaging.Resize(src, reportImageWidth, 0, imaging.Lanczos)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, resized, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, maxWidth, maxWidth * 0.75
+	}
+
+	bounds := resized.Bounds()
+	width, height := maxWidth, maxWidth*float64(bounds.Dy())/float64(bounds.Dx())
+	if height > maxHeight {
+		width, height = width*maxHeight/height, maxHeight
+	}
+	return doc.AddJPEG(buf.Bytes(), bounds.Dx(), bounds.Dy()), width, height
+}
+
+func drawImage(page *pdf.Page, img *pdf.Image, x, y, w, h float64, label string) {
+	if img == nil {
+		page.SetStrokeColor(0.6, 0.6, 0.6)
+		page.Rect(x, y, w, h, false)
+		page.Text(x+10, y+h/2, 10, false, label+" image unavailable")
+	} else {
+		page.Image(img, x, y, w, h)
+	}
+	page.Text(x, y+h+12, 9, false, label)
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
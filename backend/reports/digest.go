@@ -0,0 +1,317 @@
+package reports
+
+import (
+	"bytes"
+	"deforestation/authz"
+	"deforestation/models"
+	"deforestation/notifications"
+	"fmt"
+	"html/template"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// AreaDigest summarizes one area over a week. DeforestedArea and Change
+// are null for a week without captures.
+type AreaDigest struct {
+	AreaID                 uint     `json:"area_id"`
+	AreaName               string   `json:"area_name"`
+	DeforestedArea         *float64 `json:"deforested_area"`
+	PreviousDeforestedArea *float64 `json:"previous_deforested_area"`
+	Change                 *float64 `json:"change"`
+	Captures               int      `json:"captures"`
+	FailedRuns             int      `json:"failed_runs"`
+	OpenAlerts             int      `json:"open_alerts"`
+}
+
+// AlertDigest is an alert still open at the end of the week
+type AlertDigest struct {
+	AlertID   uint      `json:"alert_id"`
+	AreaID    uint      `json:"area_id"`
+	Kind      string    `json:"kind"`
+	Threshold float64   `json:"threshold"`
+	Value     float64   `json:"value"`
+	Message   string    `json:"message"`
+	RaisedAt  time.Time `json:"raised_at"`
+}
+
+func newAlertDigest(a models.Alert) AlertDigest {
+	return AlertDigest{
+		AlertID:   a.ID,
+		AreaID:    a.AreaID,
+		Kind:      a.Kind,
+		Threshold: a.Threshold,
+		Value:     a.Value,
+		Message:   a.Message,
+		RaisedAt:  a.CreatedAt,
+	}
+}
+
+// Digest is the weekly report of all areas a user may read
+type Digest struct {
+	UserID     uint          `json:"user_id"`
+	Username   string        `json:"username"`
+	WeekStart  time.Time     `json:"week_start"`
+	WeekEnd    time.Time     `json:"week_end"`
+	Areas      []AreaDigest  `json:"areas"`
+	FailedRuns int           `json:"failed_runs"`
+	OpenAlerts []AlertDigest `json:"open_alerts"`
+}
+
+// StartOfWeek returns Monday 00:00 UTC of the week containing t
+func StartOfWeek(t time.Time) time.Time {
+	t = t.UTC()
+	offset := (int(t.Weekday()) + 6) % 7
+	return time.Date(t.Year(), t.Month(), t.Day()-offset, 0, 0, 0, 0, time.UTC)
+}
+
+// ParseWeek accepts an ISO week ("2024-W07") or any date within the week
+// ("2024-02-14") and returns the start of that week. An empty string selects
+// the current week.
+func ParseWeek(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return StartOfWeek(now), nil
+	}
+
+	if year, week, ok := strings.Cut(s, "-W"); ok {
+		y, err := strconv.Atoi(year)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid week %q", s)
+		}
+		w, err := strconv.Atoi(week)
+		if err != nil || w < 1 || w > 53 {
+			return time.Time{}, fmt.Errorf("invalid week %q", s)
+		}
+		// January 4th always falls in ISO week 1
+		start := StartOfWeek(time.Date(y, time.January, 4, 0, 0, 0, 0, time.UTC)).AddDate(0, 0, 7*(w-1))
+		if _, isoWeek := start.ISOWeek(); isoWeek != w {
+			return time.Time{}, fmt.Errorf("invalid week %q", s)
+		}
+		return start, nil
+	}
+
+	date, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid week %q", s)
+	}
+	return StartOfWeek(date), nil
+}
+
+// BuildDigest summarizes the areas the user may read, their private ones and
+// those of their organizations, for the week starting at weekStart
+func BuildDigest(db *gorm.DB, userID uint, weekStart time.Time) (*Digest, error) {
+	var user models.User
+	if err := db.First(&user, userID).Error; err != nil {
+		return nil, err
+	}
+	subject, err := authz.SubjectFor(db, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := &Digest{
+		UserID:     user.ID,
+		Username:   user.Username,
+		WeekStart:  weekStart,
+		WeekEnd:    weekStart.AddDate(0, 0, 7),
+		Areas:      []AreaDigest{},
+		OpenAlerts: []AlertDigest{},
+	}
+
+	var areas []models.Area
+	if err := authz.Areas(db, subject).Order("id").Find(&areas).Error; err != nil {
+		return nil, err
+	}
+
+	areaIDs := make([]uint, len(areas))
+	for i, area := range areas {
+		areaIDs[i] = area.ID
+	}
+
+	for _, area := range areas {
+		summary := AreaDigest{
+			AreaID:   area.ID,
+			AreaName: area.AreaName,
+		}
+
+		// Only captures of the week count, a week without any is reported
+		// as such rather than with an older value
+		var latest models.History
+		err := db.Where("area_id = ? AND date >= ? AND date < ?", area.ID, digest.WeekStart, digest.WeekEnd).
+			Order("date desc").First(&latest).Error
+		if err == nil {
+			summary.DeforestedArea = &latest.DeforestedArea
+		} else if !gorm.IsRecordNotFoundError(err) {
+			return nil, err
+		}
+
+		var previous models.History
+		err = db.Where("area_id = ? AND date < ?", area.ID, digest.WeekStart).Order("date desc").First(&previous).Error
+		if err == nil {
+			summary.PreviousDeforestedArea = &previous.DeforestedArea
+			if summary.DeforestedArea != nil {
+				change := *summary.DeforestedArea - previous.DeforestedArea
+				summary.Change = &change
+			}
+		} else if !gorm.IsRecordNotFoundError(err) {
+			return nil, err
+		}
+
+		if err := db.Model(&models.History{}).
+			Where("area_id = ? AND date >= ? AND date < ?", area.ID, digest.WeekStart, digest.WeekEnd).
+			Count(&summary.Captures).Error; err != nil {
+			return nil, err
+		}
+
+		if err := db.Model(&models.AnalysisRun{}).
+			Where("area_id = ? AND status = ? AND started_at >= ? AND started_at < ?",
+				area.ID, models.AnalysisRunFailed, digest.WeekStart, digest.WeekEnd).
+			Count(&summary.FailedRuns).Error; err != nil {
+			return nil, err
+		}
+
+		digest.FailedRuns += summary.FailedRuns
+		digest.Areas = append(digest.Areas, summary)
+	}
+
+	if len(areaIDs) > 0 {
+		var alerts []models.Alert
+		if err := db.Where("area_id IN (?) AND state = ? AND created_at < ?", areaIDs, models.AlertStateOpen, digest.WeekEnd).
+			Order("created_at desc").Find(&alerts).Error; err != nil {
+			return nil, err
+		}
+		for _, alert := range alerts {
+			digest.OpenAlerts = append(digest.OpenAlerts, newAlertDigest(alert))
+		}
+	}
+	for _, alert := range digest.OpenAlerts {
+		for i := range digest.Areas {
+			if digest.Areas[i].AreaID == alert.AreaID {
+				digest.Areas[i].OpenAlerts++
+			}
+		}
+	}
+
+	return digest, nil
+}
+
+// HTML renders the digest as a standalone HTML document
+func (d Digest) HTML() (string, error) {
+	return d.render("page")
+}
+
+func (d Digest) EmailSubject() string {
+	return "Weekly deforestation digest for the week of " + d.WeekStart.Format("2006-01-02")
+}
+
+func (d Digest) EmailHTML() (string, error) {
+	return d.render("body")
+}
+
+func (d Digest) render(name string) (string, error) {
+	var buf bytes.Buffer
+	if err := digestTemplate.ExecuteTemplate(&buf, name, d); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func (d Digest) EmailAreaIDs() []uint {
+	ids := make([]uint, len(d.Areas))
+	for i, area := range d.Areas {
+		ids[i] = area.AreaID
+	}
+	return ids
+}
+
+// digestRecipients lists the creators of private areas and the members of
+// organizations that have areas
+const digestRecipients = `SELECT user_id FROM areas
+	WHERE deleted_at IS NULL AND organization_id IS NULL
+	UNION
+	SELECT m.user_id FROM memberships m
+	JOIN areas a ON a.organization_id = m.organization_id AND a.deleted_at IS NULL
+	WHERE m.deleted_at IS NULL`
+
+// SendWeeklyDigests publishes the digest of the week before now for every
+// user that may read at least one area
+func SendWeeklyDigests(db *gorm.DB, now time.Time) {
+	weekStart := StartOfWeek(now).AddDate(0, 0, -7)
+
+	userIDs, err := digestUsers(db)
+	if err != nil {
+		log.Printf("Error listing users for weekly digest: %v", err)
+		return
+	}
+
+	for _, userID := range userIDs {
+		digest, err := BuildDigest(db, userID, weekStart)
+		if err != nil {
+			log.Printf("Error building weekly digest for user %d: %v", userID, err)
+			continue
+		}
+
+		notifications.Publish(notifications.Event{
+			Type:   notifications.EventDigestWeekly,
+			UserID: userID,
+			Data:   *digest,
+		})
+	}
+}
+
+func digestUsers(db *gorm.DB) ([]uint, error) {
+	rows, err := db.Raw(digestRecipients + " ORDER BY user_id").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var userIDs []uint
+	for rows.Next() {
+		var userID uint
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, rows.Err()
+}
+
+var digestTemplate = template.Must(template.New("digest").Funcs(template.FuncMap{
+	"pct": func(v *float64) string {
+		if v == nil {
+			return "no capture"
+		}
+		return fmt.Sprintf("%.2f%%", *v)
+	},
+	"change": func(v *float64) string {
+		if v == nil {
+			return "n/a"
+		}
+		return fmt.Sprintf("%+.2f%%", *v)
+	},
+	"date":    func(t time.Time) string { return t.Format("2006-01-02") },
+	"lastDay": func(t time.Time) time.Time { return t.AddDate(0, 0, -1) },
+}).Parse(`{{define "page"}}<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Weekly digest</title></head>
+<body>
+{{template "body" .}}
+</body>
+</html>
+{{end}}{{define "body"}}<h2>Weekly digest for {{.Username}}</h2>
+<p>Week of {{date .WeekStart}} to {{date (lastDay .WeekEnd)}}</p>
+<table border="1" cellpadding="4" cellspacing="0">
+<tr><th>Area</th><th>Deforested area</th><th>Change since last week</th><th>Captures</th><th>Failed runs</th><th>Open alerts</th></tr>
+{{range .Areas}}<tr><td>{{.AreaName}}</td><td>{{pct .DeforestedArea}}</td><td>{{change .Change}}</td><td>{{.Captures}}</td><td>{{.FailedRuns}}</td><td>{{.OpenAlerts}}</td></tr>
+{{else}}<tr><td colspan="6">No areas are being monitored.</td></tr>
+{{end}}</table>
+{{if .OpenAlerts}}<h3>Open alerts</h3>
+<ul>
+{{range .OpenAlerts}}<li>{{.Message}} ({{date .RaisedAt}})</li>
+{{end}}</ul>{{end}}
+{{end}}`))
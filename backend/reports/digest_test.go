@@ -0,0 +1,241 @@
+package reports
+
+import (
+	"deforestation/models"
+	"deforestation/testdb"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+func TestStartOfWeek(t *testing.T) {
+	tests := []struct {
+		name string
+		t    time.Time
+		want string
+	}{
+		{"wednesday", time.Date(2024, 2, 14, 15, 0, 0, 0, time.UTC), "2024-02-12"},
+		{"monday midnight", time.Date(2024, 2, 12, 0, 0, 0, 0, time.UTC), "2024-02-12"},
+		{"sunday night", time.Date(2024, 2, 18, 23, 59, 59, 0, time.UTC), "2024-02-12"},
+		{"across the year", time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC), "2024-12-30"},
+		{"across the month", time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC), "2024-02-26"},
+		{"still sunday in UTC", time.Date(2024, 2, 12, 1, 0, 0, 0, time.FixedZone("UTC+2", 2*3600)), "2024-02-05"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := StartOfWeek(tt.t)
+			if got.Format(time.RFC3339) != tt.want+"T00:00:00Z" {
+				t.Errorf("StartOfWeek = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseWeek(t *testing.T) {
+	now := time.Date(2024, 5, 8, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"", "2024-05-06"},
+		{"2024-W07", "2024-02-12"},
+		{"2024-W01", "2024-01-01"},
+		{"2021-W01", "2021-01-04"},
+		{"2015-W53", "2015-12-28"},
+		{"2020-W53", "2020-12-28"},
+		{"2024-02-14", "2024-02-12"},
+		{"2024-02-12", "2024-02-12"},
+		{"2021-W53", ""},
+		{"2024-W00", ""},
+		{"2024-W54", ""},
+		{"2024-Wx", ""},
+		{"abcd-W01", ""},
+		{"2024-w07", ""},
+		{"2024-02-30", ""},
+		{"14/02/2024", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseWeek(tt.in, now)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("ParseWeek = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseWeek: %v", err)
+			}
+			if got.Format(time.RFC3339) != tt.want+"T00:00:00Z" {
+				t.Errorf("ParseWeek = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildDigestScope(t *testing.T) {
+	db := testdb.Open(t)
+	weekStart := time.Date(2024, 2, 12, 0, 0, 0, 0, time.UTC)
+
+	create := func(value interface{}) {
+		t.Helper()
+		if err := db.Create(value).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	creator := models.User{Username: "creator", Password: "x"}
+	member := models.User{Username: "member", Password: "x"}
+	loner := models.User{Username: "loner", Password: "x"}
+	for _, user := range []*models.User{&creator, &member, &loner} {
+		create(user)
+	}
+	org := models.Organization{Name: "Reserve"}
+	create(&org)
+	create(&models.Membership{OrganizationID: org.ID, UserID: member.ID, Role: models.RoleViewer})
+	left := models.Membership{OrganizationID: org.ID, UserID: creator.ID, Role: models.RoleEditor}
+	create(&left)
+	if err := db.Delete(&left).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	shared := models.Area{AreaName: "shared", UserID: creator.ID, OrganizationID: &org.ID}
+	private := models.Area{AreaName: "private", UserID: creator.ID}
+	create(&shared)
+	create(&private)
+	// Raised by the member's rule on an area they did not create
+	raised := gorm.Model{CreatedAt: weekStart.Add(24 * time.Hour)}
+	create(&models.Alert{Model: raised, RuleID: 1, UserID: member.ID, AreaID: shared.ID, Kind: models.AlertKindAbsolute,
+		State: models.AlertStateOpen, Message: "shared alert"})
+	create(&models.Alert{Model: raised, RuleID: 2, UserID: creator.ID, AreaID: private.ID, Kind: models.AlertKindAbsolute,
+		State: models.AlertStateOpen, Message: "private alert"})
+
+	tests := []struct {
+		name   string
+		user   models.User
+		areas  []string
+		alerts []string
+	}{
+		{"member sees shared areas they did not create", member, []string{"shared"}, []string{"shared alert"}},
+		{"creator who left keeps only private areas", creator, []string{"private"}, []string{"private alert"}},
+		{"user without areas", loner, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			digest, err := BuildDigest(db, tt.user.ID, weekStart)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var areas, alerts []string
+			for _, area := range digest.Areas {
+				areas = append(areas, area.AreaName)
+			}
+			for _, alert := range digest.OpenAlerts {
+				alerts = append(alerts, alert.Message)
+			}
+			if !reflect.DeepEqual(areas, tt.areas) || !reflect.DeepEqual(alerts, tt.alerts) {
+				t.Errorf("digest lists areas %q and alerts %q, want %q and %q", areas, alerts, tt.areas, tt.alerts)
+			}
+		})
+	}
+
+	userIDs, err := digestUsers(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint{creator.ID, member.ID}; !reflect.DeepEqual(userIDs, want) {
+		t.Errorf("digests go to %v, want %v", userIDs, want)
+	}
+}
+
+func TestBuildDigestCaptures(t *testing.T) {
+	db := testdb.Open(t)
+	weekStart := time.Date(2024, 2, 12, 0, 0, 0, 0, time.UTC)
+
+	user := models.User{Username: "ana", Password: "x"}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	capture := func(area models.Area, date time.Time, deforested float64) {
+		t.Helper()
+		history := models.History{Date: date, ImagePath: "image.png", MaskedImagePath: "mask.png",
+			DeforestedArea: deforested, AreaID: area.ID}
+		if err := db.Create(&history).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// DeforestedArea of the area is the latest value, which the digest of
+	// a week without captures must not report
+	captured := models.Area{AreaName: "captured", UserID: user.ID, DeforestedArea: 14}
+	skipped := models.Area{AreaName: "skipped", UserID: user.ID, DeforestedArea: 14}
+	fresh := models.Area{AreaName: "fresh", UserID: user.ID}
+	for _, area := range []*models.Area{&captured, &skipped, &fresh} {
+		if err := db.Create(area).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	capture(captured, weekStart.AddDate(0, 0, -7), 10)
+	capture(captured, weekStart.AddDate(0, 0, 1), 11)
+	capture(captured, weekStart.AddDate(0, 0, 3), 12.5)
+	capture(captured, weekStart.AddDate(0, 0, 7), 14)
+	capture(skipped, weekStart.AddDate(0, 0, -7), 10)
+	capture(skipped, weekStart.AddDate(0, 0, 7), 14)
+
+	digest, err := BuildDigest(db, user.ID, weekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := func(v *float64) interface{} {
+		if v == nil {
+			return nil
+		}
+		return *v
+	}
+	want := map[string][4]interface{}{
+		// deforested, previous, change, captures
+		"captured": {12.5, 10.0, 2.5, 2},
+		"skipped":  {nil, 10.0, nil, 0},
+		"fresh":    {nil, nil, nil, 0},
+	}
+	for _, area := range digest.Areas {
+		got := [4]interface{}{value(area.DeforestedArea), value(area.PreviousDeforestedArea), value(area.Change), area.Captures}
+		if got != want[area.AreaName] {
+			t.Errorf("%s: digest = %v, want %v", area.AreaName, got, want[area.AreaName])
+		}
+	}
+}
+
+func TestDigestHTML(t *testing.T) {
+	deforested := 12.5
+	digest := Digest{
+		Username:  "ana",
+		WeekStart: time.Date(2024, 2, 12, 0, 0, 0, 0, time.UTC),
+		WeekEnd:   time.Date(2024, 2, 19, 0, 0, 0, 0, time.UTC),
+		Areas: []AreaDigest{
+			{AreaName: "captured", DeforestedArea: &deforested, Captures: 1},
+			{AreaName: "skipped"},
+		},
+		OpenAlerts: []AlertDigest{{Message: "threshold crossed", RaisedAt: time.Date(2024, 2, 13, 8, 0, 0, 0, time.UTC)}},
+	}
+
+	html, err := digest.HTML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Week of 2024-02-12 to 2024-02-18",
+		"<td>captured</td><td>12.50%</td><td>n/a</td>",
+		"<td>skipped</td><td>no capture</td><td>n/a</td>",
+		"<li>threshold crossed (2024-02-13)</li>",
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("digest HTML does not contain %q:\n%s", want, html)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package reports
+
+import (
+	"deforestation/models"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Bucket is one interval of a time series. Value is nil for intervals
+// without captures.
+type Bucket struct {
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Value   *float64  `json:"value"`
+	Count   int       `json:"count"`
+	Missing bool      `json:"missing"`
+}
+
+// Trend is the least squares line through the non-empty buckets, with x
+// measured in intervals since the first bucket
+type Trend struct {
+	SlopePerInterval float64 `json:"slope_per_interval"`
+	Intercept        float64 `json:"intercept"`
+	R2               float64 `json:"r2"`
+}
+
+// RateOfLoss extrapolates the trend to a yearly deforestation rate
+type RateOfLoss struct {
+	PercentPerYear  float64 `json:"percent_per_year"`
+	HectaresPerYear float64 `json:"hectares_per_year"`
+}
+
+// TimeSeries is History.DeforestedArea bucketed per week or month
+type TimeSeries struct {
+	Interval    string      `json:"interval"`
+	Aggregation string      `json:"aggregation"`
+	Buckets     []Bucket    `json:"buckets"`
+	Trend       *Trend      `json:"trend"`
+	RateOfLoss  *RateOfLoss `json:"rate_of_loss"`
+}
+
+// BuildTimeSeries buckets the histories, which must be sorted by date, into
+// week or month intervals aggregated with avg, max or last. Intervals without
+// captures are included with a nil value. surfaceHectares is used to express
+// the rate of loss in hectares.
+func BuildTimeSeries(histories []models.History, surfaceHectares float64, interval, agg string) (*TimeSeries, error) {
+	var start func(time.Time) time.Time
+	var next func(time.Time) time.Time
+	var intervalDays float64
+
+	switch interval {
+	case "week":
+		start = StartOfWeek
+		next = func(t time.Time) time.Time { return t.AddDate(0, 0, 7) }
+		intervalDays = 7
+	case "month":
+		start = func(t time.Time) time.Time {
+			t = t.UTC()
+			return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+		}
+		next = func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }
+		intervalDays = 365.25 / 12
+	default:
+		return nil, fmt.Errorf("invalid interval %q", interval)
+	}
+
+	switch agg {
+	case "avg", "max", "last":
+	default:
+		return nil, fmt.Errorf("invalid aggregation %q", agg)
+	}
+
+	series := &TimeSeries{Interval: interval, Aggregation: agg, Buckets: []Bucket{}}
+	if len(histories) == 0 {
+		return series, nil
+	}
+
+	i := 0
+	last := start(histories[len(histories)-1].Date)
+	for bucketStart := start(histories[0].Date); !bucketStart.After(last); bucketStart = next(bucketStart) {
+		bucket := Bucket{Start: bucketStart, End: next(bucketStart)}
+
+		var sum float64
+		for ; i < len(histories) && histories[i].Date.Before(bucket.End); i++ {
+			value := histories[i].DeforestedArea
+			sum += value
+			switch {
+			case bucket.Count == 0, agg == "last":
+				bucket.Value = &value
+			case agg == "max" && value > *bucket.Value:
+				bucket.Value = &value
+			}
+			bucket.Count++
+		}
+
+		if bucket.Count == 0 {
+			bucket.Missing = true
+		} else if agg == "avg" {
+			avg := sum / float64(bucket.Count)
+			bucket.Value = &avg
+		}
+
+		series.Buckets = append(series.Buckets, bucket)
+	}
+
+	if trend := linearTrend(series.Buckets); trend != nil {
+		series.Trend = trend
+		percentPerYear := trend.SlopePerInterval / intervalDays * 365.25
+		series.RateOfLoss = &RateOfLoss{
+			PercentPerYear:  percentPerYear,
+			HectaresPerYear: percentPerYear / 100 * surfaceHectares,
+		}
+	}
+
+	return series, nil
+}
+
+// linearTrend fits a line through the non-empty buckets. It needs at least
+// two of them.
+func linearTrend(buckets []Bucket) *Trend {
+	var n, sumX, sumY, sumXY, sumXX float64
+	for x, bucket := range buckets {
+		if bucket.Value == nil {
+			continue
+		}
+		fx, y := float64(x), *bucket.Value
+		n++
+		sumX += fx
+		sumY += y
+		sumXY += fx * y
+		sumXX += fx * fx
+	}
+	if n < 2 {
+		return nil
+	}
+
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return nil
+	}
+	slope := (n*sumXY - sumX*sumY) / denominator
+	intercept := (sumY - slope*sumX) / n
+
+	meanY := sumY / n
+	var ssTotal, ssResidual float64
+	for x, bucket := range buckets {
+		if bucket.Value == nil {
+			continue
+		}
+		predicted := intercept + slope*float64(x)
+		ssTotal += math.Pow(*bucket.Value-meanY, 2)
+		ssResidual += math.Pow(*bucket.Value-predicted, 2)
+	}
+
+	r2 := 1.0
+	if ssTotal > 0 {
+		r2 = 1 - ssResidual/ssTotal
+	}
+
+	return &Trend{SlopePerInterval: slope, Intercept: intercept, R2: r2}
+}
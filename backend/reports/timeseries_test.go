@@ -0,0 +1,182 @@
+package reports
+
+import (
+	"deforestation/models"
+	"math"
+	"testing"
+	"time"
+)
+
+// measurements returns histories at the given RFC 3339 dates with the
+// given deforested areas
+func measurements(t *testing.T, points ...interface{}) []models.History {
+	t.Helper()
+	var histories []models.History
+	for i := 0; i < len(points); i += 2 {
+		date, err := time.Parse(time.RFC3339, points[i].(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		histories = append(histories, models.History{Date: date, DeforestedArea: points[i+1].(float64)})
+	}
+	return histories
+}
+
+func value(v float64) *float64 {
+	return &v
+}
+
+func TestBuildTimeSeries(t *testing.T) {
+	weekly := measurements(t,
+		"2024-02-12T00:00:00Z", 10.0,
+		"2024-02-14T10:00:00Z", 14.0,
+		"2024-02-18T23:59:59Z", 12.0,
+		"2024-02-27T08:00:00Z", 20.0,
+	)
+	monthly := measurements(t,
+		"2024-01-31T23:00:00Z", 5.0,
+		"2024-02-01T00:00:00Z", 7.0,
+		"2024-03-01T01:00:00+02:00", 8.0, // still February in UTC
+		"2024-04-15T00:00:00Z", 9.0,
+	)
+
+	type bucket struct {
+		start string
+		value *float64
+		count int
+	}
+	tests := []struct {
+		name      string
+		histories []models.History
+		interval  string
+		agg       string
+		want      []bucket
+		lastEnd   string
+	}{
+		{"weekly average", weekly, "week", "avg", []bucket{
+			{"2024-02-12", value(12), 3},
+			{"2024-02-19", nil, 0},
+			{"2024-02-26", value(20), 1},
+		}, "2024-03-04"},
+		{"weekly maximum", weekly, "week", "max", []bucket{
+			{"2024-02-12", value(14), 3},
+			{"2024-02-19", nil, 0},
+			{"2024-02-26", value(20), 1},
+		}, "2024-03-04"},
+		{"weekly last", weekly, "week", "last", []bucket{
+			{"2024-02-12", value(12), 3},
+			{"2024-02-19", nil, 0},
+			{"2024-02-26", value(20), 1},
+		}, "2024-03-04"},
+		{"monthly", monthly, "month", "last", []bucket{
+			{"2024-01-01", value(5), 1},
+			{"2024-02-01", value(8), 2},
+			{"2024-03-01", nil, 0},
+			{"2024-04-01", value(9), 1},
+		}, "2024-05-01"},
+		{"no captures", nil, "month", "avg", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			series, err := BuildTimeSeries(tt.histories, 1000, tt.interval, tt.agg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(series.Buckets) != len(tt.want) {
+				t.Fatalf("%d buckets, want %d", len(series.Buckets), len(tt.want))
+			}
+			for i, want := range tt.want {
+				got := series.Buckets[i]
+				if got.Start.Format("2006-01-02") != want.start || got.Count != want.count || got.Missing != (want.count == 0) {
+					t.Errorf("bucket %d = %s with %d captures (missing %v), want %s with %d",
+						i, got.Start.Format("2006-01-02"), got.Count, got.Missing, want.start, want.count)
+				}
+				if (got.Value == nil) != (want.value == nil) || got.Value != nil && *got.Value != *want.value {
+					t.Errorf("bucket %d value = %v, want %v", i, got.Value, want.value)
+				}
+				if i > 0 && !series.Buckets[i-1].End.Equal(got.Start) {
+					t.Errorf("bucket %d starts at %v, the previous one ends at %v", i, got.Start, series.Buckets[i-1].End)
+				}
+			}
+			if len(tt.want) > 0 {
+				if end := series.Buckets[len(series.Buckets)-1].End.Format("2006-01-02"); end != tt.lastEnd {
+					t.Errorf("last bucket ends on %s, want %s", end, tt.lastEnd)
+				}
+			} else if series.Buckets == nil || series.Trend != nil || series.RateOfLoss != nil {
+				t.Errorf("series without captures = %+v", series)
+			}
+		})
+	}
+
+	for _, params := range [][2]string{{"day", "avg"}, {"week", "median"}, {"", ""}} {
+		if _, err := BuildTimeSeries(weekly, 1000, params[0], params[1]); err == nil {
+			t.Errorf("BuildTimeSeries accepted interval %q and aggregation %q", params[0], params[1])
+		}
+	}
+}
+
+func TestBuildTimeSeriesRateOfLoss(t *testing.T) {
+	// Weekly averages of 12 and, two weeks later, 20
+	histories := measurements(t,
+		"2024-02-12T00:00:00Z", 10.0,
+		"2024-02-14T00:00:00Z", 14.0,
+		"2024-02-27T00:00:00Z", 20.0,
+	)
+	series, err := BuildTimeSeries(histories, 1000, "week", "avg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if series.Trend == nil || series.RateOfLoss == nil {
+		t.Fatalf("series = %+v, want a trend", series)
+	}
+	if series.Trend.SlopePerInterval != 4 {
+		t.Errorf("slope = %v per week, want 4", series.Trend.SlopePerInterval)
+	}
+	wantPercent := 4.0 / 7 * 365.25
+	if math.Abs(series.RateOfLoss.PercentPerYear-wantPercent) > 1e-9 ||
+		math.Abs(series.RateOfLoss.HectaresPerYear-wantPercent*10) > 1e-9 {
+		t.Errorf("rate of loss = %+v, want %v %%/year on 1000 ha", *series.RateOfLoss, wantPercent)
+	}
+}
+
+func TestLinearTrend(t *testing.T) {
+	buckets := func(values ...*float64) []Bucket {
+		b := make([]Bucket, len(values))
+		for i, v := range values {
+			b[i].Value = v
+		}
+		return b
+	}
+
+	tests := []struct {
+		name    string
+		buckets []Bucket
+		want    *Trend
+	}{
+		{"exact line", buckets(value(1), value(3), value(5)), &Trend{SlopePerInterval: 2, Intercept: 1, R2: 1}},
+		{"gaps keep their position", buckets(value(1), nil, value(5)), &Trend{SlopePerInterval: 2, Intercept: 1, R2: 1}},
+		{"leading gap", buckets(nil, value(3), value(5)), &Trend{SlopePerInterval: 2, Intercept: 1, R2: 1}},
+		{"constant", buckets(value(4), value(4), value(4)), &Trend{SlopePerInterval: 0, Intercept: 4, R2: 1}},
+		{"noisy", buckets(value(1), value(3), value(2)), &Trend{SlopePerInterval: 0.5, Intercept: 1.5, R2: 0.25}},
+		{"decreasing", buckets(value(9), value(6), value(3), value(0)), &Trend{SlopePerInterval: -3, Intercept: 9, R2: 1}},
+		{"single value", buckets(nil, value(3), nil), nil},
+		{"no values", buckets(nil, nil), nil},
+		{"no buckets", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := linearTrend(tt.buckets)
+			if got == nil || tt.want == nil {
+				if got != tt.want {
+					t.Errorf("linearTrend = %+v, want %+v", got, tt.want)
+				}
+				return
+			}
+			if math.Abs(got.SlopePerInterval-tt.want.SlopePerInterval) > 1e-9 ||
+				math.Abs(got.Intercept-tt.want.Intercept) > 1e-9 ||
+				math.Abs(got.R2-tt.want.R2) > 1e-9 {
+				t.Errorf("linearTrend = %+v, want %+v", *got, *tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+// Package retention expires old captures and removes image objects that are
+// no longer referenced by any history entry.
+package retention
+
+import (
+	"context"
+	"deforestation/models"
+	"deforestation/renditions"
+	"deforestation/storage"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Policy decides which captures keep their images. The baseline (first)
+// capture of an area, the KeepLast most recent captures and every capture
+// younger than MonthlyAfter are kept. Older captures are thinned out to the
+// first capture of each calendar month.
+type Policy struct {
+	KeepLast     int
+	MonthlyAfter time.Duration
+	// OrphanGrace protects unreferenced objects younger than this, such as
+	// the images of a capture that is still being analysed
+	OrphanGrace time.Duration
+}
+
+// PolicyFromEnv reads RETENTION_KEEP_LAST, RETENTION_MONTHLY_AFTER_WEEKS and
+// RETENTION_ORPHAN_GRACE_HOURS
+func PolicyFromEnv() Policy {
+	return Policy{
+		KeepLast:     envInt("RETENTION_KEEP_LAST", 12),
+		MonthlyAfter: time.Duration(envInt("RETENTION_MONTHLY_AFTER_WEEKS", 26)) * 7 * 24 * time.Hour,
+		OrphanGrace:  time.Duration(envInt("RETENTION_ORPHAN_GRACE_HOURS", 24)) * time.Hour,
+	}
+}
+
+func envInt(name string, fallback int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil && v >= 0 {
+		return v
+	}
+	return fallback
+}
+
+// Report summarizes a garbage collection run
+type Report struct {
+	ExpiredCaptures int   `json:"expired_captures"`
+	DeletedObjects  int   `json:"deleted_objects"`
+	ReclaimedBytes  int64 `json:"reclaimed_bytes"`
+	Errors          int   `json:"errors"`
+}
+
+func (r *Report) add(other Report) {
+	r.ExpiredCaptures += other.ExpiredCaptures
+	r.DeletedObjects += other.DeletedObjects
+	r.ReclaimedBytes += other.ReclaimedBytes
+	r.Errors += other.Errors
+}
+
+// Expired returns the captures whose images fall outside the policy.
+// histories must be sorted by date, oldest first.
+func (p Policy) Expired(histories []models.History, now time.Time) []models.History {
+	var expired []models.History
+	monthly := map[string]bool{}
+
+	for i, history := range histories {
+		keep := i == 0 || // baseline
+			i >= len(histories)-p.KeepLast ||
+			now.Sub(history.Date) < p.MonthlyAfter
+
+		month := history.Date.UTC().Format("2006-01")
+		if !keep && !monthly[month] {
+			keep = true
+		}
+		monthly[month] = true
+
+		if !keep {
+			expired = append(expired, history)
+		}
+	}
+
+	return expired
+}
+
+// Run applies the policy to every area and then deletes orphaned objects:
+// images of deleted areas or histories and files left behind by failed
+// captures
+func Run(ctx context.Context, db *gorm.DB, store storage.BlobStore, cache *renditions.Service, policy Policy, now time.Time) (Report, error) {
+	var report Report
+
+	var areas []models.Area
+	if err := db.Find(&areas).Error; err != nil {
+		return report, err
+	}
+
+	for _, area := range areas {
+		var histories []models.History
+		if err := db.Where("area_id = ? AND image_path <> ''", area.ID).Order("date asc").Find(&histories).Error; err != nil {
+			return report, err
+		}
+
+		for _, history := range policy.Expired(histories, now) {
+			r, err := purge(ctx, db, store, cache, history)
+			report.add(r)
+			if err != nil {
+				log.Printf("Error expiring capture %d: %v", history.ID, err)
+				report.Errors++
+				continue
+			}
+			report.ExpiredCaptures++
+		}
+	}
+
+	r, err := collectOrphans(ctx, db, store, cache, policy, now)
+	report.add(r)
+	return report, err
+}
+
+// PurgeArea deletes the images of every capture of an area
+func PurgeArea(ctx context.Context, db *gorm.DB, store storage.BlobStore, cache *renditions.Service, areaID uint) (Report, error) {
+	var report Report
+
+	var histories []models.History
+	if err := db.Unscoped().Where("area_id = ?", areaID).Find(&histories).Error; err != nil {
+		return report, err
+	}
+
+	for _, history := range histories {
+		r, err := purge(ctx, db, store, cache, history)
+		report.add(r)
+		if err != nil {
+			return report, err
+		}
+		report.ExpiredCaptures++
+	}
+
+	return report, nil
+}
+
+// purge deletes both images of a capture and clears its object keys while
+// keeping the measurement itself
+func purge(ctx context.Context, db *gorm.DB, store storage.BlobStore, cache *renditions.Service, history models.History) (Report, error) {
+	var report Report
+
+	for _, key := range []string{history.ImagePath, history.MaskedImagePath} {
+		if key == "" {
+			continue
+		}
+		r, err := deleteObject(ctx, store, key)
+		report.add(r)
+		if err != nil {
+			return report, err
+		}
+		evictRenditions(cache, key)
+	}
+
+	err := db.Unscoped().Model(&models.History{}).Where("id = ?", history.ID).
+		Updates(map[string]interface{}{"image_path": "", "masked_image_path": ""}).Error
+	return report, err
+}
+
+func deleteObject(ctx context.Context, store storage.BlobStore, key string) (Report, error) {
+	var report Report
+
+	info, err := store.Stat(ctx, key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return report, nil
+	} else if err != nil {
+		return report, err
+	}
+
+	if err := store.Delete(ctx, key); err != nil {
+		return report, err
+	}
+
+	report.DeletedObjects++
+	report.ReclaimedBytes += info.Size
+	return report, nil
+}
+
+func collectOrphans(ctx context.Context, db *gorm.DB, store storage.BlobStore, cache *renditions.Service, policy Policy, now time.Time) (Report, error) {
+	var report Report
+
+	// Only live histories of live areas keep their images
+	rows, err := db.Raw(`SELECT h.image_path, h.masked_image_path FROM histories h
+		JOIN areas a ON a.id = h.area_id AND a.deleted_at IS NULL
+		WHERE h.deleted_at IS NULL`).Rows()
+	if err != nil {
+		return report, err
+	}
+	referenced := map[string]bool{}
+	for rows.Next() {
+		var image, masked string
+		if err := rows.Scan(&image, &masked); err != nil {
+			rows.Close()
+			return report, err
+		}
+		referenced[image] = true
+		referenced[masked] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return report, err
+	}
+
+	objects, err := store.List(ctx, "")
+	if err != nil {
+		return report, err
+	}
+
+	for _, object := range objects {
+		if referenced[object.Key] || now.Sub(object.ModTime) < policy.OrphanGrace {
+			continue
+		}
+		if err := store.Delete(ctx, object.Key); err != nil {
+			log.Printf("Error deleting orphaned image %s: %v", object.Key, err)
+			report.Errors++
+			continue
+		}
+		evictRenditions(cache, object.Key)
+		report.DeletedObjects++
+		report.ReclaimedBytes += object.Size
+	}
+
+	return report, nil
+}
+
+// evictRenditions removes the cached renditions of a deleted object from
+// cache, which may be nil. Failures are only logged since the object itself
+// is already gone.
+func evictRenditions(cache *renditions.Service, key string) {
+	if cache == nil {
+		return
+	}
+	if err := cache.Evict(key); err != nil {
+		log.Printf("Error evicting renditions of %s: %v", key, err)
+	}
+}
@@ -0,0 +1,125 @@
+package retention
+
+import (
+	"deforestation/models"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// captures returns histories at the given RFC 3339 dates, numbered from 1
+func captures(t *testing.T, dates ...string) []models.History {
+	t.Helper()
+	histories := make([]models.History, len(dates))
+	for i, date := range dates {
+		d, err := time.Parse(time.RFC3339, date)
+		if err != nil {
+			t.Fatal(err)
+		}
+		histories[i].ID = uint(i + 1)
+		histories[i].Date = d
+	}
+	return histories
+}
+
+func ids(histories []models.History) []uint {
+	var ids []uint
+	for _, history := range histories {
+		ids = append(ids, history.ID)
+	}
+	return ids
+}
+
+func TestPolicyExpired(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	// Captures from before 2024-10-03 are thinned out
+	const monthlyAfter = 90 * 24 * time.Hour
+
+	tests := []struct {
+		name     string
+		keepLast int
+		dates    []string
+		want     []uint
+	}{
+		{"no captures", 2, nil, nil},
+		{"baseline only", 0, []string{"2023-01-01T00:00:00Z"}, nil},
+		{
+			"first capture of each month",
+			0,
+			[]string{
+				"2024-01-10T00:00:00Z", // baseline
+				"2024-01-20T00:00:00Z",
+				"2024-02-03T00:00:00Z",
+				"2024-02-28T00:00:00Z",
+				"2024-03-31T23:30:00Z",
+				"2024-04-01T00:30:00Z",
+				"2024-05-01T01:00:00+02:00", // still April in UTC
+				"2024-05-02T00:00:00Z",
+			},
+			[]uint{2, 4, 7},
+		},
+		{
+			"max age boundary",
+			0,
+			[]string{
+				"2024-09-01T00:00:00Z",
+				"2024-10-01T00:00:00Z",
+				"2024-10-03T00:00:00Z", // exactly MonthlyAfter old
+				"2024-10-03T00:01:00Z",
+				"2024-12-30T00:00:00Z",
+			},
+			[]uint{3},
+		},
+		{
+			"keep the latest N",
+			3,
+			[]string{
+				"2024-06-01T00:00:00Z",
+				"2024-06-02T00:00:00Z",
+				"2024-06-03T00:00:00Z",
+				"2024-06-04T00:00:00Z",
+				"2024-06-05T00:00:00Z",
+				"2024-06-06T00:00:00Z",
+			},
+			[]uint{2, 3},
+		},
+		{
+			"keep more than there are",
+			10,
+			[]string{"2024-06-01T00:00:00Z", "2024-06-02T00:00:00Z", "2024-06-03T00:00:00Z"},
+			nil,
+		},
+		{
+			"recent captures are all kept",
+			0,
+			[]string{"2024-11-01T00:00:00Z", "2024-11-02T00:00:00Z", "2024-11-03T00:00:00Z"},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := Policy{KeepLast: tt.keepLast, MonthlyAfter: monthlyAfter}
+			got := ids(policy.Expired(captures(t, tt.dates...), now))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expired = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Every area keeps its own baseline and monthly captures, even when they
+// share a month with the thinned captures of another area
+func TestPolicyExpiredPerArea(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	policy := Policy{MonthlyAfter: 90 * 24 * time.Hour}
+
+	first := captures(t, "2024-03-01T00:00:00Z", "2024-03-05T00:00:00Z", "2024-04-10T00:00:00Z", "2024-04-20T00:00:00Z")
+	second := captures(t, "2024-03-10T00:00:00Z", "2024-04-15T00:00:00Z")
+
+	if got := ids(policy.Expired(first, now)); !reflect.DeepEqual(got, []uint{2, 4}) {
+		t.Errorf("first area expired %v, want [2 4]", got)
+	}
+	if got := ids(policy.Expired(second, now)); got != nil {
+		t.Errorf("second area expired %v, want none", got)
+	}
+}
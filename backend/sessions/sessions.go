@@ -0,0 +1,204 @@
+// Package sessions issues access and refresh tokens for logins and keeps
+// track of the sessions they belong to, so they can be revoked server side.
+package sessions
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"deforestation/auth"
+	"deforestation/models"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+var (
+	// ErrInvalidToken is returned for unknown, expired or revoked refresh
+	// tokens
+	ErrInvalidToken = errors.New("invalid refresh token")
+	// ErrTokenReused is returned when a refresh token is presented a second
+	// time. The token was probably stolen, so its whole session is revoked.
+	ErrTokenReused = errors.New("refresh token reused")
+)
+
+// RefreshTokenTTL is how long a refresh token may be exchanged,
+// REFRESH_TOKEN_TTL or 30 days. Every exchange extends the session.
+var RefreshTokenTTL = refreshTTLFromEnv()
+
+func refreshTTLFromEnv() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("REFRESH_TOKEN_TTL")); err == nil && d > 0 {
+		return d
+	}
+	return 30 * 24 * time.Hour
+}
+
+// Tokens are handed to the client after a login or a refresh
+type Tokens struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// Create starts a session for user and issues its first tokens
+func Create(db *gorm.DB, user models.User, userAgent, ip string) (Tokens, error) {
+	now := time.Now()
+	session := models.Session{
+		UserID:     user.ID,
+		ExpiresAt:  now.Add(RefreshTokenTTL),
+		LastUsedAt: now,
+		UserAgent:  truncate(userAgent, 256),
+		IP:         truncate(ip, 64),
+	}
+
+	var tokens Tokens
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&session).Error; err != nil {
+			return err
+		}
+		var err error
+		tokens, err = issue(tx, user, session, now)
+		return err
+	})
+	return tokens, err
+}
+
+// Refresh exchanges a refresh token for new tokens. The presented token is
+// used up, so each refresh token works exactly once.
+func Refresh(db *gorm.DB, refreshToken string) (Tokens, error) {
+	var tokens Tokens
+	var reused bool
+	var reusedSession uint
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var token models.RefreshToken
+		if err := tx.Set("gorm:query_option", "FOR UPDATE").
+			Where("token_hash = ?", hashToken(refreshToken)).First(&token).Error; err != nil {
+			if gorm.IsRecordNotFoundError(err) {
+				return ErrInvalidToken
+			}
+			return err
+		}
+
+		if token.UsedAt != nil {
+			reused, reusedSession = true, token.SessionID
+			return ErrTokenReused
+		}
+
+		now := time.Now()
+		if now.After(token.ExpiresAt) {
+			return ErrInvalidToken
+		}
+
+		var session models.Session
+		if err := tx.First(&session, token.SessionID).Error; err != nil {
+			return ErrInvalidToken
+		}
+		if session.RevokedAt != nil || now.After(session.ExpiresAt) {
+			return ErrInvalidToken
+		}
+
+		var user models.User
+		if err := tx.First(&user, session.UserID).Error; err != nil {
+			return ErrInvalidToken
+		}
+
+		if err := tx.Model(&token).Update("used_at", now).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&session).Updates(map[string]interface{}{
+			"expires_at":   now.Add(RefreshTokenTTL),
+			"last_used_at": now,
+		}).Error; err != nil {
+			return err
+		}
+
+		var err error
+		tokens, err = issue(tx, user, session, now)
+		return err
+	})
+
+	// The revocation must survive the rollback of the refresh itself
+	if reused {
+		if err := Revoke(db, reusedSession); err != nil {
+			return tokens, err
+		}
+	}
+	return tokens, err
+}
+
+// Revoke ends a session. Its access tokens are rejected from then on and its
+// refresh tokens can no longer be exchanged.
+func Revoke(db *gorm.DB, sessionID uint) error {
+	return db.Model(&models.Session{}).Where("id = ? AND revoked_at IS NULL", sessionID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// RevokeAll ends every session of a user
+func RevokeAll(db *gorm.DB, userID uint) error {
+	return db.Model(&models.Session{}).Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// RevokeOthers ends every session of a user except the given one
+func RevokeOthers(db *gorm.DB, userID, sessionID uint) error {
+	return db.Model(&models.Session{}).Where("user_id = ? AND id <> ? AND revoked_at IS NULL", userID, sessionID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// Active reports whether access tokens of the session are still accepted
+func Active(db *gorm.DB, sessionID, userID uint) (bool, error) {
+	var session models.Session
+	if err := db.First(&session, sessionID).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return session.UserID == userID && session.RevokedAt == nil && time.Now().Before(session.ExpiresAt), nil
+}
+
+// issue signs an access token and stores a new refresh token for session
+func issue(db *gorm.DB, user models.User, session models.Session, now time.Time) (Tokens, error) {
+	accessToken, err := auth.GenerateJWT(user.Username, session.ID)
+	if err != nil {
+		return Tokens{}, err
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return Tokens{}, err
+	}
+	refreshToken := base64.RawURLEncoding.EncodeToString(b)
+
+	record := models.RefreshToken{
+		SessionID: session.ID,
+		TokenHash: hashToken(refreshToken),
+		ExpiresAt: now.Add(RefreshTokenTTL),
+	}
+	if err := db.Create(&record).Error; err != nil {
+		return Tokens{}, err
+	}
+
+	return Tokens{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(auth.AccessTokenTTL.Seconds()),
+	}, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
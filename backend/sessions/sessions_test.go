@@ -0,0 +1,122 @@
+package sessions
+
+import (
+	"deforestation/auth"
+	"deforestation/models"
+	"deforestation/testdb"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// signingKeys installs an HS256 key, so access tokens can be issued
+func signingKeys(t *testing.T) {
+	t.Helper()
+	t.Setenv("JWT_ALG", "HS256")
+	t.Setenv("JWT_SECRET_KEYS", "test:0123456789abcdef0123456789abcdef")
+	t.Setenv("JWT_ACTIVE_KID", "")
+	if err := auth.Init(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	db := testdb.Open(t)
+	signingKeys(t)
+
+	// A refresh presents the token issued by the login (0) or by the nth
+	// successful refresh (n). -1 presents a token that was never issued.
+	type refresh struct {
+		token int
+		want  error
+	}
+	past := time.Now().Add(-time.Minute)
+
+	tests := []struct {
+		name      string
+		prepare   func(tx *gorm.DB, session models.Session) error
+		refreshes []refresh
+		active    bool
+	}{
+		{"rotation", nil, []refresh{{0, nil}, {1, nil}, {2, nil}}, true},
+		{"login token reused", nil, []refresh{{0, nil}, {0, ErrTokenReused}, {1, ErrInvalidToken}}, false},
+		{"rotated token reused", nil, []refresh{{0, nil}, {1, nil}, {1, ErrTokenReused}, {2, ErrInvalidToken}, {0, ErrTokenReused}}, false},
+		{"unknown token", nil, []refresh{{-1, ErrInvalidToken}, {0, nil}}, true},
+		{"expired token", func(tx *gorm.DB, session models.Session) error {
+			return tx.Model(&models.RefreshToken{}).Where("session_id = ?", session.ID).Update("expires_at", past).Error
+		}, []refresh{{0, ErrInvalidToken}}, true},
+		{"revoked session", func(tx *gorm.DB, session models.Session) error {
+			return Revoke(tx, session.ID)
+		}, []refresh{{0, ErrInvalidToken}}, false},
+		{"expired session", func(tx *gorm.DB, session models.Session) error {
+			return tx.Model(&session).Update("expires_at", past).Error
+		}, []refresh{{0, ErrInvalidToken}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := models.User{Username: tt.name, Password: "x"}
+			if err := db.Create(&user).Error; err != nil {
+				t.Fatal(err)
+			}
+			login, err := Create(db, user, "test", "127.0.0.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var session models.Session
+			if err := db.Where("user_id = ?", user.ID).First(&session).Error; err != nil {
+				t.Fatal(err)
+			}
+			if tt.prepare != nil {
+				if err := tt.prepare(db, session); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			issued := []Tokens{login}
+			for n, r := range tt.refreshes {
+				presented := "never-issued"
+				if r.token >= 0 {
+					presented = issued[r.token].RefreshToken
+				}
+				tokens, err := Refresh(db, presented)
+				if !errors.Is(err, r.want) {
+					t.Fatalf("refresh %d with token %d = %v, want %v", n, r.token, err, r.want)
+				}
+				if err != nil {
+					continue
+				}
+
+				if tokens.RefreshToken == presented {
+					t.Errorf("refresh %d returned the presented token", n)
+				}
+				claims, err := auth.ParseJWT(tokens.AccessToken)
+				if err != nil || claims.SessionID != session.ID || claims.Username != user.Username {
+					t.Errorf("refresh %d access token = %+v, %v", n, claims, err)
+				}
+				issued = append(issued, tokens)
+			}
+
+			active, err := Active(db, session.ID, user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if active != tt.active {
+				t.Errorf("Active = %v, want %v", active, tt.active)
+			}
+		})
+	}
+}
+
+func TestHashToken(t *testing.T) {
+	tests := map[string]string{
+		"":    "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		"abc": "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+	}
+	for token, want := range tests {
+		if got := hashToken(token); got != want {
+			t.Errorf("hashToken(%q) = %s, want %s", token, got, want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"area_1_20240101000000.png", true},
+		{"renditions/abc.webp", true},
+		{"a b/c+d.png", true},
+		{"", false},
+		{"/etc/passwd", false},
+		{"../secret.png", false},
+		{"renditions/../../secret.png", false},
+		{"a/..", false},
+		{"..", false},
+		{".", false},
+		{"./a.png", false},
+		{"a//b.png", false},
+		{"a/b/", false},
+		{`a\..\b.png`, false},
+		{`..\secret.png`, false},
+		{".env", false},
+		{"renditions/.upload-123", false},
+		{".hidden/a.png", false},
+	}
+	for _, tt := range tests {
+		if got := ValidKey(tt.key); got != tt.want {
+			t.Errorf("ValidKey(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	root := t.TempDir()
+	store := NewFileStore(root + "/")
+	ctx := context.Background()
+
+	if err := store.Put(ctx, "renditions/a.webp", strings.NewReader("webp"), 4, "image/webp"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := store.Put(ctx, "area_1.png", strings.NewReader("png"), 3, "image/png"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := store.Put(ctx, "area_1.png", strings.NewReader("png2"), 4, "image/png"); err != nil {
+		t.Fatalf("Put over an existing object: %v", err)
+	}
+
+	if data, err := os.ReadFile(filepath.Join(root, "renditions", "a.webp")); err != nil || string(data) != "webp" {
+		t.Errorf("file below the root = %q, %v", data, err)
+	}
+
+	r, info, err := store.Get(ctx, "area_1.png")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	body, _ := io.ReadAll(r)
+	r.Close()
+	if string(body) != "png2" || info.Key != "area_1.png" || info.Size != 4 {
+		t.Errorf("Get = %q, %+v", body, info)
+	}
+
+	if _, err := store.Stat(ctx, "renditions"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Stat of a directory = %v, want ErrNotFound", err)
+	}
+	if _, _, err := store.Get(ctx, "missing.png"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of a missing object = %v, want ErrNotFound", err)
+	}
+
+	// Leftover uploads and other hidden files are not objects
+	if err := os.WriteFile(filepath.Join(root, "renditions", ".upload-1"), []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	objects, err := store.List(ctx, "")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(objects) != 2 || objects[0].Key != "area_1.png" || objects[1].Key != "renditions/a.webp" {
+		t.Errorf("List = %+v", objects)
+	}
+	if objects, err := store.List(ctx, "renditions/"); err != nil || len(objects) != 1 {
+		t.Errorf("List(renditions/) = %+v, %v", objects, err)
+	}
+
+	if err := store.Delete(ctx, "area_1.png"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := store.Delete(ctx, "area_1.png"); err != nil {
+		t.Errorf("Delete of a deleted object: %v", err)
+	}
+	if _, err := store.Stat(ctx, "area_1.png"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Stat after Delete = %v, want ErrNotFound", err)
+	}
+}
+
+func TestFileStoreStaysInRoot(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "images")
+	store := NewFileStore(root)
+	ctx := context.Background()
+
+	secret := filepath.Join(parent, "secret.png")
+	if err := os.WriteFile(secret, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"../secret.png", "a/../../secret.png", secret, `..\secret.png`} {
+		if _, _, err := store.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get(%q) = %v, want ErrNotFound", key, err)
+		}
+		if err := store.Put(ctx, key, strings.NewReader("x"), 1, ""); err == nil {
+			t.Errorf("Put(%q) succeeded", key)
+		}
+		if err := store.Delete(ctx, key); err == nil {
+			t.Errorf("Delete(%q) succeeded", key)
+		}
+	}
+
+	if data, err := os.ReadFile(secret); err != nil || string(data) != "secret" {
+		t.Errorf("file outside the root was changed: %q, %v", data, err)
+	}
+
+	// A store whose root does not exist yet lists nothing
+	if objects, err := store.List(ctx, ""); err != nil || len(objects) != 0 {
+		t.Errorf("List of a missing root = %+v, %v", objects, err)
+	}
+}
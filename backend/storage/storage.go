@@ -0,0 +1,128 @@
+// Package storage abstracts where captures and masks are kept. Images are
+// addressed by object keys such as "area_1_20240101000000.png".
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+// ErrNotFound is returned when an object does not exist
+var ErrNotFound = errors.New("object not found")
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// BlobStore stores image objects by key
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error)
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
+
+var Store BlobStore
+
+// Init configures the store from the environment. STORAGE_BACKEND selects
+// "fs" (default), rooted at IMAGE_DIR, or "s3", configured by the S3_*
+// variables.
+func Init() error {
+	store, err := FromEnv()
+	if err != nil {
+		return err
+	}
+	Store = store
+	return nil
+}
+
+func GetStore() BlobStore {
+	return Store
+}
+
+// FromEnv builds the store selected by STORAGE_BACKEND
+func FromEnv() (BlobStore, error) {
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "fs":
+		return NewFileStore(ImageDir()), nil
+	case "s3":
+		store := &S3Store{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			Region:    os.Getenv("S3_REGION"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+		}
+		if store.Endpoint == "" || store.Bucket == "" {
+			return nil, fmt.Errorf("S3_ENDPOINT and S3_BUCKET are required for the s3 storage backend")
+		}
+		if store.Region == "" {
+			store.Region = "us-east-1"
+		}
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
+
+// ImageDir is the directory shared with the CV service, which reads the
+// stitched captures from it and writes the masks next to them
+func ImageDir() string {
+	if dir := os.Getenv("IMAGE_DIR"); dir != "" {
+		return dir
+	}
+	return "/app/images" // This should match the volume mount point
+}
+
+// Import moves a local file into the store under key. Files that already
+// live at the right place in a FileStore are left untouched.
+func Import(ctx context.Context, store BlobStore, key, localPath string) error {
+	if fs, ok := store.(*FileStore); ok {
+		if path, err := fs.Path(key); err == nil && path == filepath.Clean(localPath) {
+			return nil
+		}
+	}
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := store.Put(ctx, key, f, info.Size(), "image/png"); err != nil {
+		return err
+	}
+
+	if err := os.Remove(localPath); err != nil {
+		log.Printf("Error removing imported file %s: %v", localPath, err)
+	}
+	return nil
+}
+
+// DecodeImage reads and decodes a stored image
+func DecodeImage(ctx context.Context, store BlobStore, key string) (image.Image, error) {
+	r, _, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return imaging.Decode(r)
+}
@@ -0,0 +1,72 @@
+// Package testdb gives tests a scratch PostgreSQL schema with the
+// application tables. Tests using it are skipped unless TEST_DATABASE_URL
+// points to a database they may create schemas in.
+package testdb
+
+import (
+	"crypto/rand"
+	"deforestation/migrations"
+	"encoding/hex"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+)
+
+// Open migrates a new schema and returns a connection using it. The schema
+// is dropped when the test ends.
+func Open(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	admin, err := gorm.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("connecting to the test database: %v", err)
+	}
+
+	suffix := make([]byte, 6)
+	if _, err := rand.Read(suffix); err != nil {
+		t.Fatal(err)
+	}
+	schema := "test_" + hex.EncodeToString(suffix)
+	if err := admin.Exec("CREATE SCHEMA " + schema).Error; err != nil {
+		admin.Close()
+		t.Fatalf("creating schema: %v", err)
+	}
+
+	db, err := gorm.Open("postgres", withSearchPath(dsn, schema))
+	if err != nil {
+		admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+		admin.Close()
+		t.Fatalf("connecting to schema %s: %v", schema, err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+		admin.Close()
+	})
+
+	migrations.Migrate(db)
+	return db
+}
+
+// withSearchPath adds the schema to a URL or key=value connection string
+func withSearchPath(dsn, schema string) string {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err == nil {
+			query := u.Query()
+			query.Set("search_path", schema)
+			u.RawQuery = query.Encode()
+			return u.String()
+		}
+	}
+	return dsn + " search_path=" + schema
+}
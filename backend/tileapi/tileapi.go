@@ -0,0 +1,162 @@
+// Package tileapi keeps the backend within the rate limit and the daily
+// quota of the satellite tile API. All captures share one rate limiter, and
+// the requests of a capture are taken from a per UTC day count in the
+// database before it starts, so the count survives restarts and concurrent
+// captures cannot overrun the quota together.
+package tileapi
+
+import (
+	"context"
+	"deforestation/models"
+	"deforestation/ratelimit"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+var (
+	limiterOnce sync.Once
+	limiter     *ratelimit.Limiter
+)
+
+// Wait blocks until the rate limit allows another tile request. The limit
+// is TILE_RATE_PER_SECOND (default 5) with bursts of TILE_BURST (default
+// 10), read on first use so a .env file is taken into account.
+func Wait(ctx context.Context) error {
+	limiterOnce.Do(func() {
+		limiter = ratelimit.New(envFloat("TILE_RATE_PER_SECOND", 5), max(1, envInt("TILE_BURST", 10)))
+	})
+	return limiter.Wait(ctx, "tiles")
+}
+
+// Budget is the number of tile requests that may be made per UTC day.
+// Scheduled captures leave Reserve requests untouched, so on-demand
+// analyses still work when the weekly jobs have used up most of the day.
+type Budget struct {
+	DailyQuota int
+	Reserve    int
+}
+
+// BudgetFromEnv reads TILE_DAILY_QUOTA (default 50000, 0 for no quota) and
+// TILE_QUOTA_RESERVE (default a tenth of the quota)
+func BudgetFromEnv() Budget {
+	b := Budget{DailyQuota: envInt("TILE_DAILY_QUOTA", 50000)}
+	b.Reserve = envInt("TILE_QUOTA_RESERVE", b.DailyQuota/10)
+	return b
+}
+
+// ExhaustedError is returned when a capture does not fit in what is left
+// of the day's quota. RetryAfter is the time until the quota resets.
+type ExhaustedError struct {
+	Used, Needed, Available int
+	Reset                   time.Time
+}
+
+func (e *ExhaustedError) Error() string {
+	return fmt.Sprintf("tile quota exhausted: %d of %d requests left today, %d needed",
+		e.Available-e.Used, e.Available, e.Needed)
+}
+
+// RetryAfter returns how long until the quota resets
+func (e *ExhaustedError) RetryAfter() time.Duration {
+	return time.Until(e.Reset)
+}
+
+// Allow reports whether needed requests fit into the rest of today's quota,
+// without taking them. Scheduled work must leave the reserve.
+func (b Budget) Allow(db *gorm.DB, needed int, scheduled bool, now time.Time) error {
+	if b.DailyQuota <= 0 {
+		return nil
+	}
+
+	used, err := Used(db, now)
+	if err != nil {
+		return err
+	}
+
+	available := b.available(scheduled)
+	if used+needed > available {
+		return b.exhausted(used, needed, scheduled, now)
+	}
+	return nil
+}
+
+// Take counts needed requests against today's quota before they are made.
+// The check and the count are a single statement, so of two captures that
+// only fit one at a time the second gets an *ExhaustedError. Scheduled work
+// must leave the reserve.
+func (b Budget) Take(db *gorm.DB, needed int, scheduled bool, now time.Time) error {
+	if b.DailyQuota <= 0 {
+		return record(db, needed, now)
+	}
+
+	if err := db.Exec(`INSERT INTO tile_usages (day, requests, updated_at) VALUES (?, 0, ?)
+		ON CONFLICT (day) DO NOTHING`, day(now), now).Error; err != nil {
+		return err
+	}
+	result := db.Exec(`UPDATE tile_usages SET requests = requests + ?, updated_at = ?
+		WHERE day = ? AND requests + ? <= ?`, needed, now, day(now), needed, b.available(scheduled))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		used, err := Used(db, now)
+		if err != nil {
+			return err
+		}
+		return b.exhausted(used, needed, scheduled, now)
+	}
+	return nil
+}
+
+func (b Budget) available(scheduled bool) int {
+	if scheduled {
+		return b.DailyQuota - b.Reserve
+	}
+	return b.DailyQuota
+}
+
+func (b Budget) exhausted(used, needed int, scheduled bool, now time.Time) *ExhaustedError {
+	return &ExhaustedError{Used: used, Needed: needed, Available: b.available(scheduled), Reset: day(now).AddDate(0, 0, 1)}
+}
+
+// Used returns the number of requests made on the UTC day of now
+func Used(db *gorm.DB, now time.Time) (int, error) {
+	var usage models.TileUsage
+	err := db.Where("day = ?", day(now)).First(&usage).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return 0, nil
+	}
+	return usage.Requests, err
+}
+
+// record counts n requests made at now
+func record(db *gorm.DB, n int, now time.Time) error {
+	return db.Exec(`INSERT INTO tile_usages (day, requests, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT (day) DO UPDATE SET requests = tile_usages.requests + EXCLUDED.requests, updated_at = EXCLUDED.updated_at`,
+		day(now), n, now).Error
+}
+
+// day is the start of the UTC day of t
+func day(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func envInt(name string, fallback int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil && v >= 0 {
+		return v
+	}
+	return fallback
+}
+
+func envFloat(name string, fallback float64) float64 {
+	if v, err := strconv.ParseFloat(os.Getenv(name), 64); err == nil && v > 0 {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,116 @@
+package tileapi
+
+import (
+	"deforestation/testdb"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBudgetAllow(t *testing.T) {
+	now := time.Date(2024, 5, 6, 15, 0, 0, 0, time.UTC)
+	budget := Budget{DailyQuota: 100, Reserve: 10}
+
+	tests := []struct {
+		name      string
+		used      int
+		needed    int
+		scheduled bool
+		ok        bool
+	}{
+		{"fits", 50, 40, false, true},
+		{"uses up the quota", 50, 50, false, true},
+		{"over the quota", 50, 51, false, false},
+		{"scheduled fits outside the reserve", 50, 40, true, true},
+		{"scheduled eats into the reserve", 50, 41, true, false},
+		{"on-demand uses the reserve", 90, 10, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := testdb.Open(t)
+			if err := record(db, tt.used, now); err != nil {
+				t.Fatal(err)
+			}
+
+			err := budget.Allow(db, tt.needed, tt.scheduled, now)
+			if tt.ok {
+				if err != nil {
+					t.Errorf("Allow = %v, want nil", err)
+				}
+				return
+			}
+			var exhausted *ExhaustedError
+			if !errors.As(err, &exhausted) {
+				t.Fatalf("Allow = %v, want *ExhaustedError", err)
+			}
+			if want := time.Date(2024, 5, 7, 0, 0, 0, 0, time.UTC); !exhausted.Reset.Equal(want) {
+				t.Errorf("Reset = %v, want %v", exhausted.Reset, want)
+			}
+		})
+	}
+
+	t.Run("no quota", func(t *testing.T) {
+		if err := (Budget{}).Allow(nil, 1e9, true, now); err != nil {
+			t.Errorf("Allow = %v, want nil", err)
+		}
+	})
+}
+
+func TestBudgetTake(t *testing.T) {
+	db := testdb.Open(t)
+	now := time.Date(2024, 5, 6, 23, 0, 0, 0, time.UTC)
+	budget := Budget{DailyQuota: 100, Reserve: 20}
+
+	if err := budget.Take(db, 70, true, now); err != nil {
+		t.Fatalf("Take = %v", err)
+	}
+	if err := budget.Take(db, 20, true, now); err == nil {
+		t.Error("scheduled Take ate into the reserve")
+	}
+	if err := budget.Take(db, 30, false, now); err != nil {
+		t.Errorf("on-demand Take = %v", err)
+	}
+	if err := budget.Take(db, 1, false, now); err == nil {
+		t.Error("Take went over the quota")
+	}
+
+	// Refused requests are not counted, and the next day starts over
+	if used, err := Used(db, now); err != nil || used != 100 {
+		t.Errorf("Used = %d, %v, want 100", used, err)
+	}
+	if err := budget.Take(db, 80, true, now.Add(2*time.Hour)); err != nil {
+		t.Errorf("Take on the next day = %v", err)
+	}
+}
+
+func TestBudgetTakeConcurrent(t *testing.T) {
+	db := testdb.Open(t)
+	now := time.Now()
+	budget := Budget{DailyQuota: 100}
+
+	var wg sync.WaitGroup
+	results := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results <- budget.Take(db, 30, false, now)
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	taken := 0
+	for err := range results {
+		if err == nil {
+			taken++
+		}
+	}
+	if taken != 3 {
+		t.Errorf("%d captures of 30 tiles fit in a quota of 100, want 3", taken)
+	}
+	if used, err := Used(db, now); err != nil || used != 90 {
+		t.Errorf("Used = %d, %v, want 90", used, err)
+	}
+}
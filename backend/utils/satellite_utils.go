@@ -2,7 +2,9 @@ package utils
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
 	"image/jpeg"
@@ -11,13 +13,23 @@ import (
 	"math"
 	"net/http"
 	"os"
+	"path"
+	"path/filepath"
 	"time"
 
+	"deforestation/alerts"
+	"deforestation/audit"
+	"deforestation/authz"
 	"deforestation/models"
+	"deforestation/notifications"
+	"deforestation/quota"
 
 	"deforestation/database"
+	"deforestation/storage"
+	"deforestation/tileapi"
 
 	"github.com/disintegration/imaging"
+	"github.com/jinzhu/gorm"
 	"github.com/joho/godotenv"
 )
 
@@ -37,7 +49,13 @@ func latLonToTile(lat, lon float64, zoom int) (int, int) {
 	return x, y
 }
 
+// getSatelliteImageTile downloads one tile, within the rate limit of the
+// tile API. The capture took the request from the daily quota beforehand.
 func getSatelliteImageTile(z, x, y int) ([]byte, error) {
+	if err := tileapi.Wait(context.Background()); err != nil {
+		return nil, err
+	}
+
 	url := fmt.Sprintf("https://api.tomtom.com/map/1/tile/sat/main/%d/%d/%d.jpg?key=%s", z, x, y, apiKey)
 	resp, err := http.Get(url)
 	if err != nil {
@@ -131,9 +149,17 @@ func generateStitchedImage(latMin, lonMin, latMax, lonMax float64, zoom int) (*b
 	return buf, nil
 }
 
+// GetSatelliteImage captures and analyses an area, then notifies its readers
+// of the outcome and the owners of the rules of any alert it fired. It
+// returns an *tileapi.ExhaustedError without starting when the capture does
+// not fit in today's tile quota, and a *quota.ExceededError when the account
+// has no analysis left this month.
 func GetSatelliteImage(areaID uint) error {
+	return getSatelliteImage(areaID, false)
+}
+
+func getSatelliteImage(areaID uint, scheduled bool) error {
 	log.Println("Getting Image..")
-	zoom := 15
 	db := database.GetDB()
 
 	var area models.Area
@@ -142,44 +168,200 @@ func GetSatelliteImage(areaID uint) error {
 		return err
 	}
 
+	var run models.AnalysisRun
+	err := quota.Lock(db, quota.AccountOf(area), func(tx *gorm.DB) error {
+		var err error
+		run, err = StartAnalysis(tx, area, scheduled, time.Now())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return Analyse(db, area, run)
+}
+
+// StartAnalysis checks that the account of the area has an analysis left
+// this month, takes the tiles of the capture from today's tile quota and
+// stores the running analysis run. It must be called within quota.Lock on
+// the account of the area, so that concurrent analyses of the account
+// cannot all pass the check.
+func StartAnalysis(tx *gorm.DB, area models.Area, scheduled bool, now time.Time) (models.AnalysisRun, error) {
+	run := models.AnalysisRun{AreaID: area.ID, Status: models.AnalysisRunRunning, StartedAt: now}
+	if err := quota.CheckAnalysis(tx, quota.DefaultsFromEnv(), quota.AccountOf(area), now); err != nil {
+		return run, err
+	}
+	if err := tileapi.BudgetFromEnv().Take(tx, TileCount(area), scheduled, now); err != nil {
+		return run, err
+	}
+	return run, tx.Create(&run).Error
+}
+
+// Analyse captures and analyses an area for a run started by StartAnalysis,
+// records the outcome in the run, then notifies the readers of the area and
+// the owners of the rules of any alert it fired
+func Analyse(db *gorm.DB, area models.Area, run models.AnalysisRun) error {
+	history, err := captureArea(db, &area)
+	run.FinishedAt = time.Now()
+	if err != nil {
+		run.Status = models.AnalysisRunFailed
+		run.Error = err.Error()
+	} else {
+		run.Status = models.AnalysisRunSucceeded
+		run.HistoryID = &history.ID
+	}
+	if err := db.Save(&run).Error; err != nil {
+		log.Printf("Error saving analysis run: %v", err)
+	}
+
+	if err != nil {
+		publishToReaders(db, area, notifications.EventAnalysisFailed, notifications.AnalysisPayload{
+			AreaID:         area.ID,
+			AreaName:       area.AreaName,
+			DeforestedArea: area.DeforestedArea,
+			Error:          err.Error(),
+		})
+		return err
+	}
+
+	publishToReaders(db, area, notifications.EventAnalysisCompleted, notifications.AnalysisPayload{
+		AreaID:          area.ID,
+		AreaName:        area.AreaName,
+		HistoryID:       history.ID,
+		Date:            &history.Date,
+		DeforestedArea:  history.DeforestedArea,
+		ImagePath:       history.ImagePath,
+		MaskedImagePath: history.MaskedImagePath,
+	})
+
+	// Evaluate alert rules against the new capture
+	fired, err := alerts.Evaluate(db, area, *history)
+	if err != nil {
+		log.Printf("Error evaluating alert rules: %v", err)
+	}
+	for _, alert := range fired {
+		notifications.Publish(notifications.Event{
+			Type:   notifications.EventAlertFired,
+			UserID: alert.UserID,
+			AreaID: area.ID,
+			Data: notifications.AlertPayload{
+				AlertID:   alert.ID,
+				RuleID:    alert.RuleID,
+				AreaID:    area.ID,
+				AreaName:  area.AreaName,
+				HistoryID: alert.HistoryID,
+				Kind:      alert.Kind,
+				Threshold: alert.Threshold,
+				Value:     alert.Value,
+				Message:   alert.Message,
+			},
+		})
+	}
+
+	return nil
+}
+
+// publishToReaders notifies everyone who may read the area: its creator,
+// or the current members of its organization
+func publishToReaders(db *gorm.DB, area models.Area, eventType string, payload notifications.AnalysisPayload) {
+	userIDs, err := authz.Readers(db, area)
+	if err != nil {
+		log.Printf("Error listing the readers of area %d: %v", area.ID, err)
+		return
+	}
+	for _, userID := range userIDs {
+		notifications.Publish(notifications.Event{
+			Type:   eventType,
+			UserID: userID,
+			AreaID: area.ID,
+			Data:   payload,
+		})
+	}
+}
+
+// RunScheduledCapture is GetSatelliteImage as run by the weekly job, which
+// records the outcome of every run in the audit log
+func RunScheduledCapture(areaID uint) error {
+	db := database.GetDB()
+	entry := models.AuditLog{
+		Action:       audit.ActionScheduledRun,
+		ResourceType: audit.ResourceArea,
+		ResourceID:   &areaID,
+		Outcome:      models.AuditSucceeded,
+	}
+
+	var area models.Area
+	if err := db.First(&area, areaID).Error; err != nil {
+		return err
+	}
+	entry.OrganizationID = area.OrganizationID
+
+	// Runs over the monthly quota are skipped, the next week may fit again.
+	// Runs that would eat into the tile quota reserve are deferred until the
+	// quota resets, the job retries them then.
+	if err := getSatelliteImage(areaID, true); err != nil {
+		var exceeded *quota.ExceededError
+		var exhausted *tileapi.ExhaustedError
+		if errors.As(err, &exceeded) {
+			entry.Outcome = models.AuditDenied
+		} else if errors.As(err, &exhausted) {
+			entry.Outcome = models.AuditDeferred
+		} else {
+			entry.Outcome = models.AuditFailed
+		}
+		entry.Detail = err.Error()
+		audit.Record(db, entry)
+		return err
+	}
+	audit.Record(db, entry)
+	return nil
+}
+
+// captureArea downloads and stitches the area's tiles, has the CV service
+// analyse them and stores the result as a new history entry
+func captureArea(db *gorm.DB, area *models.Area) (*models.History, error) {
+	zoom := CaptureZoom
+	areaID := area.ID
+
 	// Generate the stitched image
 	buf, err := generateStitchedImage(area.BottomLeftLat, area.BottomLeftLon, area.TopRightLat, area.TopRightLon, zoom)
 	if err != nil {
 		log.Printf("Error generating stitched image: %v", err)
-		return err
+		return nil, err
 	}
 
-	// Define a directory and filename
-	imageDir := "/app/images" // This should match the volume mount point
-	imageFilename := fmt.Sprintf("area_%d_%s.png", areaID, time.Now().Format("20060102150405"))
-	imagePath := fmt.Sprintf("%s/%s", imageDir, imageFilename)
+	// The CV service reads the capture from the shared image directory and
+	// writes the mask next to it
+	imageDir := storage.ImageDir()
+	imageKey := fmt.Sprintf("area_%d_%s.png", areaID, time.Now().Format("20060102150405"))
+	imagePath := filepath.Join(imageDir, imageKey)
 
 	// Ensure the directory exists
 	if err := createDirIfNotExists(imageDir); err != nil {
 		log.Printf("Error ensuring directory exists: %v", err)
-		return err
+		return nil, err
 	}
 
 	// Save the image to the specified path
 	if err := os.WriteFile(imagePath, buf.Bytes(), 0644); err != nil {
 		log.Printf("Error saving stitched image: %v", err)
-		return err
+		return nil, err
 	}
 
 	fmt.Printf("Stitched image saved as %s\n", imagePath)
 
 	// Send request to the CV microservice to calculate deforestation
-	cvMicroserviceURL := "http://computer-vision:5000/calculate-deforestation/" + imageFilename
+	cvMicroserviceURL := "http://computer-vision:5000/calculate-deforestation/" + imageKey
 	resp, err := http.Get(cvMicroserviceURL)
 	if err != nil {
 		log.Printf("Error requesting CV microservice: %v", err)
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		log.Printf("CV microservice returned non-200 status: %d", resp.StatusCode)
-		return err
+		return nil, fmt.Errorf("CV microservice returned status %d", resp.StatusCode)
 	}
 
 	// Parse the response from the CV microservice
@@ -191,26 +373,38 @@ func GetSatelliteImage(areaID uint) error {
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		log.Printf("Error reading CV microservice response: %v", err)
-		return err
+		return nil, err
 	}
 
 	if err := json.Unmarshal(body, &result); err != nil {
 		log.Printf("Error unmarshalling CV microservice response: %v", err)
-		return err
+		return nil, err
+	}
+
+	// Move both images into the blob store
+	maskedImageKey := path.Base(result.MaskedImagePath)
+	store := storage.GetStore()
+	if err := storage.Import(context.Background(), store, imageKey, imagePath); err != nil {
+		log.Printf("Error storing stitched image: %v", err)
+		return nil, err
+	}
+	if err := storage.Import(context.Background(), store, maskedImageKey, filepath.Join(imageDir, maskedImageKey)); err != nil {
+		log.Printf("Error storing masked image: %v", err)
+		return nil, err
 	}
 
 	// Update the Area model with the deforested area
 	area.DeforestedArea = 100 - result.ForestedArea
 	log.Println(area.DeforestedArea)
-	if err := db.Save(&area).Error; err != nil {
+	if err := db.Save(area).Error; err != nil {
 		log.Printf("Error updating Area model: %v", err)
-		return err
+		return nil, err
 	}
 
 	// Create a history record
 	history := models.History{
-		ImagePath:       imagePath,
-		MaskedImagePath: result.MaskedImagePath,
+		ImagePath:       imageKey,
+		MaskedImagePath: maskedImageKey,
 		DeforestedArea:  area.DeforestedArea,
 		AreaID:          areaID,
 		Date:            time.Now(),
@@ -218,10 +412,10 @@ func GetSatelliteImage(areaID uint) error {
 
 	if err := db.Create(&history).Error; err != nil {
 		log.Printf("Error saving history record: %v", err)
-		return err
+		return nil, err
 	}
 
-	return nil
+	return &history, nil
 }
 
 // CreateDirIfNotExists ensures that a directory exists, creating it if necessary
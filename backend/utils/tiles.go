@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"deforestation/models"
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// CaptureZoom is the zoom level satellite captures are stitched at
+const CaptureZoom = 15
+
+// TileSize is the edge length of XYZ tiles in pixels
+const TileSize = 256
+
+// TileRange returns the tiles covered by captures of the area at CaptureZoom,
+// matching the range downloaded by downloadTiles
+func TileRange(area models.Area) (xMin, yMin, xMax, yMax int) {
+	xMin, yMin = latLonToTile(area.TopRightLat, area.BottomLeftLon, CaptureZoom)
+	xMax, yMax = latLonToTile(area.BottomLeftLat, area.TopRightLon, CaptureZoom)
+	return xMin, yMin, xMax, yMax
+}
+
+// TileCount returns the number of tiles a capture of the area downloads
+func TileCount(area models.Area) int {
+	xMin, yMin, xMax, yMax := TileRange(area)
+	return (xMax - xMin + 1) * (yMax - yMin + 1)
+}
+
+// RenderTile cuts the XYZ tile z/x/y out of a stitched capture of the area.
+// Parts of the tile outside the capture are transparent. ok is false when the
+// tile does not overlap the capture at all.
+func RenderTile(capture image.Image, area models.Area, z, x, y int) (tile image.Image, ok bool) {
+	xMin, yMin, _, _ := TileRange(area)
+
+	// Size of the requested tile in capture pixels
+	scale := math.Pow(2, float64(CaptureZoom-z))
+	size := TileSize * scale
+	left := float64(x)*size - float64(xMin*TileSize)
+	top := float64(y)*size - float64(yMin*TileSize)
+
+	bounds := capture.Bounds()
+	src := image.Rect(
+		int(math.Max(math.Floor(left), 0)),
+		int(math.Max(math.Floor(top), 0)),
+		int(math.Min(math.Ceil(left+size), float64(bounds.Dx()))),
+		int(math.Min(math.Ceil(top+size), float64(bounds.Dy()))),
+	)
+	if src.Empty() {
+		return nil, false
+	}
+
+	// Where the capture pixels land inside the tile
+	dst := image.Rect(
+		int(math.Round((float64(src.Min.X)-left)/scale)),
+		int(math.Round((float64(src.Min.Y)-top)/scale)),
+		int(math.Round((float64(src.Max.X)-left)/scale)),
+		int(math.Round((float64(src.Max.Y)-top)/scale)),
+	)
+	if dst.Empty() {
+		return nil, false
+	}
+
+	part := imaging.Crop(capture, src.Add(bounds.Min))
+	part = imaging.Resize(part, dst.Dx(), dst.Dy(), imaging.Linear)
+
+	out := imaging.New(TileSize, TileSize, image.Transparent)
+	return imaging.Paste(out, part, dst.Min), true
+}
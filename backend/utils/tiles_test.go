@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"deforestation/models"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// sixTiles spans the capture tiles x 16384-16385 and y 16382-16384
+var sixTiles = models.Area{BottomLeftLat: -0.005, BottomLeftLon: 0.005, TopRightLat: 0.015, TopRightLon: 0.015}
+
+func TestTileRange(t *testing.T) {
+	tests := []struct {
+		name                   string
+		area                   models.Area
+		xMin, yMin, xMax, yMax int
+	}{
+		{"inside one tile", models.Area{BottomLeftLat: 0.001, BottomLeftLon: 0.001, TopRightLat: 0.002, TopRightLon: 0.002}, 16384, 16383, 16384, 16383},
+		{"across the equator", sixTiles, 16384, 16382, 16385, 16384},
+		{"across the prime meridian", models.Area{BottomLeftLat: 0.001, BottomLeftLon: -0.005, TopRightLat: 0.002, TopRightLon: 0.005}, 16383, 16383, 16384, 16383},
+		{"southern hemisphere", models.Area{BottomLeftLat: -3.01, BottomLeftLon: -60.01, TopRightLat: -3, TopRightLon: -60}, 10921, 16657, 10922, 16658},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			xMin, yMin, xMax, yMax := TileRange(tt.area)
+			if xMin != tt.xMin || yMin != tt.yMin || xMax != tt.xMax || yMax != tt.yMax {
+				t.Errorf("TileRange = x %d-%d, y %d-%d, want x %d-%d, y %d-%d",
+					xMin, xMax, yMin, yMax, tt.xMin, tt.xMax, tt.yMin, tt.yMax)
+			}
+		})
+	}
+}
+
+// blockColor is the color of the capture tile in column col and row row
+func blockColor(col, row int) color.NRGBA {
+	return color.NRGBA{R: uint8(60*col + 20), G: uint8(60*row + 20), B: 200, A: 255}
+}
+
+func TestRenderTile(t *testing.T) {
+	// A capture of sixTiles: two columns and three rows of single colored tiles
+	capture := imaging.New(2*TileSize, 3*TileSize, color.Transparent)
+	for col := 0; col < 2; col++ {
+		for row := 0; row < 3; row++ {
+			block := imaging.New(TileSize, TileSize, blockColor(col, row))
+			capture = imaging.Paste(capture, block, image.Pt(col*TileSize, row*TileSize))
+		}
+	}
+	transparent := color.NRGBA{}
+
+	type pixel struct {
+		x, y int
+		want color.NRGBA
+	}
+	tests := []struct {
+		name    string
+		z, x, y int
+		ok      bool
+		pixels  []pixel
+	}{
+		{"capture tile", 15, 16384, 16382, true, []pixel{{0, 0, blockColor(0, 0)}, {255, 255, blockColor(0, 0)}}},
+		{"last capture tile", 15, 16385, 16384, true, []pixel{{128, 128, blockColor(1, 2)}}},
+		{"east of the capture", 15, 16386, 16382, false, nil},
+		{"north of the capture", 15, 16384, 16381, false, nil},
+		{"zoomed out", 14, 8192, 8191, true, []pixel{
+			{64, 64, blockColor(0, 0)}, {192, 64, blockColor(1, 0)}, {64, 192, blockColor(0, 1)}, {192, 192, blockColor(1, 1)},
+		}},
+		{"zoomed out, half covered", 14, 8192, 8192, true, []pixel{{64, 64, blockColor(0, 2)}, {64, 192, transparent}}},
+		{"zoomed in", 16, 32768, 32764, true, []pixel{{0, 0, blockColor(0, 0)}, {255, 255, blockColor(0, 0)}}},
+		{"zoomed in, second half", 16, 32771, 32769, true, []pixel{{128, 128, blockColor(1, 2)}}},
+		{"far out", 12, 2048, 2047, true, []pixel{{16, 200, blockColor(0, 0)}, {100, 100, transparent}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tile, ok := RenderTile(capture, sixTiles, tt.z, tt.x, tt.y)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if b := tile.Bounds(); b.Dx() != TileSize || b.Dy() != TileSize {
+				t.Fatalf("tile is %v", b)
+			}
+			for _, p := range tt.pixels {
+				if got := color.NRGBAModel.Convert(tile.At(p.x, p.y)).(color.NRGBA); got != p.want {
+					t.Errorf("pixel %d,%d = %v, want %v", p.x, p.y, got, p.want)
+				}
+			}
+		})
+	}
+}
+
+func TestTileCount(t *testing.T) {
+	tests := []struct {
+		name string
+		area models.Area
+		want int
+	}{
+		{"inside one tile", models.Area{BottomLeftLat: 0.001, BottomLeftLon: 0.001, TopRightLat: 0.002, TopRightLon: 0.002}, 1},
+		{"two columns, three rows", models.Area{BottomLeftLat: -0.005, BottomLeftLon: 0.005, TopRightLat: 0.015, TopRightLon: 0.015}, 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := TileCount(tt.area); got != tt.want {
+				xMin, yMin, xMax, yMax := TileRange(tt.area)
+				t.Errorf("TileCount = %d for tiles x %d-%d, y %d-%d, want %d", got, xMin, xMax, yMin, yMax, tt.want)
+			}
+		})
+	}
+}
@@ -19,7 +19,7 @@ export interface History {
   MaskedImagePath: string;
   DeforestedArea: number;
   AreaID: number;
-  Area: Area;
+  Area?: Area;
 }
 
 // Define the structure of the API response
@@ -27,6 +27,19 @@ interface ApiResponse<T> {
   data: T;
 }
 
+// List endpoints return one page at a time along with the cursor of the next
+interface ListResponse<T> {
+  data: T[];
+  meta: {
+    limit: number;
+    total: number;
+    next_cursor?: string;
+  };
+}
+
+// Largest page the list endpoints accept
+const PAGE_SIZE = 500;
+
 class APIClient {
   private client;
 
@@ -41,18 +54,57 @@ class APIClient {
         delete this.client.defaults.headers.common['Authorization'];
       }
     });
+
+    // Access tokens are short-lived: renew them once with the refresh token
+    // when a request is rejected, then replay the request
+    this.client.interceptors.response.use(undefined, async error => {
+      const request = error.config;
+      const refreshToken = localStorage.getItem('refreshToken');
+      if (error.response?.status !== 401 || !refreshToken || request._retried || request.url === '/auth/refresh') {
+        throw error;
+      }
+
+      request._retried = true;
+      try {
+        await this.refresh(refreshToken);
+      } catch {
+        this.clearSession();
+        throw error;
+      }
+      request.headers['Authorization'] = this.client.defaults.headers.common['Authorization'];
+      return this.client(request);
+    });
+  }
+
+  private storeTokens(token: string, refreshToken: string): void {
+    localStorage.setItem('authToken', token);
+    localStorage.setItem('refreshToken', refreshToken);
+    authToken.set(token);
+    isAuthenticated.set(true);
+  }
+
+  private clearSession(): void {
+    localStorage.removeItem('authToken');
+    localStorage.removeItem('refreshToken');
+    authToken.set(null);
+    isAuthenticated.set(false);
+  }
+
+  private async refresh(refreshToken: string): Promise<void> {
+    const response = await this.client.post<{ token: string; refresh_token: string }>('/auth/refresh', {
+      refresh_token: refreshToken,
+    });
+    this.storeTokens(response.data.token, response.data.refresh_token);
   }
 
   // Login method
   async login(username: string, password: string): Promise<void> {
     try {
-      const response = await this.client.post<ApiResponse<{ token: string }>>('/login', { username, password });
-      const { token } = response.data;
+      const response = await this.client.post<{ token: string; refresh_token: string }>('/login', { username, password });
+      const { token, refresh_token } = response.data;
 
-      // Store token in localStorage and update store
-      localStorage.setItem('authToken', token);
-      authToken.set(token);
-      isAuthenticated.set(true);
+      // Store tokens in localStorage and update store
+      this.storeTokens(token, refresh_token);
     } catch (error) {
       console.error('Login failed', error);
       throw error;
@@ -61,10 +113,13 @@ class APIClient {
 
   // Logout method
   async logout(): Promise<void> {
-    // Clear token from localStorage and update store
-    localStorage.removeItem('authToken');
-    authToken.set(null);
-    isAuthenticated.set(false);
+    // Revoke the session server side, then clear the tokens either way
+    try {
+      await this.client.post('/logout');
+    } catch (error) {
+      console.error('Logout failed', error);
+    }
+    this.clearSession();
   }
 
   // Check authentication
@@ -97,16 +152,28 @@ class APIClient {
     return response.data.data;
   }
 
+  // Fetch every item of a list endpoint by following its cursors
+  private async listAll<T>(url: string, params: Record<string, string> = {}): Promise<T[]> {
+    const items: T[] = [];
+    let cursor: string | undefined;
+    do {
+      const response = await this.client.get<ListResponse<T>>(url, {
+        params: { ...params, limit: PAGE_SIZE, ...(cursor ? { cursor } : {}) },
+      });
+      items.push(...response.data.data);
+      cursor = response.data.meta?.next_cursor;
+    } while (cursor);
+    return items;
+  }
+
   // Get all areas
   async getAllAreas(): Promise<Area[]> {
-    const response = await this.client.get<ApiResponse<Area[]>>('/areas');
-    return response.data.data;
+    return this.listAll<Area>('/areas');
   }
 
-  // Get all histories
+  // Get all histories, oldest first
   async getAllHistories(): Promise<History[]> {
-    const response = await this.client.get<ApiResponse<History[]>>('/histories');
-    return response.data.data;
+    return this.listAll<History>('/histories', { sort: 'date' });
   }
 
   // Get history by ID
@@ -115,9 +182,9 @@ class APIClient {
     return response.data;
   }
 
+  // Get every history of an area, oldest first as the chart expects
   async getHistoryByAreaId(areaID: number): Promise<History[]> {
-    const response = await this.client.get<ApiResponse<History[]>>(`/histories/area/${areaID}`);
-    return response.data.data;
+    return this.listAll<History>(`/histories/area/${areaID}`, { sort: 'date' });
   }
 
   async getImageByPath(imagePath: string): Promise<any> {